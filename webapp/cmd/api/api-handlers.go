@@ -1,14 +1,19 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/crypto/bcrypt"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
 	"time"
 	"webapp/pkg/data"
+	"webapp/pkg/repository"
 )
 
 type Credentials struct {
@@ -27,7 +32,7 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// look up the user by email address
-	user, err := app.DB.GetUserByEmail(creds.Username)
+	user, err := app.db(r).GetUserByEmail(creds.Username)
 	if err != nil {
 		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
 		return
@@ -40,6 +45,12 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// only users who have verified their email address may log in
+	if !user.EmailVerified {
+		app.errorJSON(w, errors.New("email address not verified"), http.StatusForbidden)
+		return
+	}
+
 	// generate tokens
 	tokenPairs, err := app.generateTokenPair(user)
 	if err != nil {
@@ -94,7 +105,7 @@ func (app *application) refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := app.DB.GetUser(userID)
+	user, err := app.db(r).GetUser(userID)
 	if err != nil {
 		app.errorJSON(w, errors.New("unknown user"), http.StatusBadRequest)
 		return
@@ -147,7 +158,7 @@ func (app *application) refreshUsingCookie(w http.ResponseWriter, r *http.Reques
 				return
 			}
 
-			user, err := app.DB.GetUser(userID)
+			user, err := app.db(r).GetUser(userID)
 			if err != nil {
 				app.errorJSON(w, errors.New("unknown user"), http.StatusBadRequest)
 				return
@@ -182,12 +193,16 @@ func (app *application) refreshUsingCookie(w http.ResponseWriter, r *http.Reques
 }
 
 func (app *application) allUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := app.DB.AllUsers()
+	users, err := app.db(r).AllUsers()
 	if err != nil {
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
-	_ = app.writeJSON(w, http.StatusOK, users)
+	response := make([]userResponse, 0, len(users))
+	for _, u := range users {
+		response = append(response, newUserResponse(u))
+	}
+	_ = app.writeJSON(w, http.StatusOK, response)
 }
 
 func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
@@ -196,26 +211,124 @@ func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
-	user, err := app.DB.GetUser(userID)
+	user, err := app.db(r).GetUser(userID)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
-	_ = app.writeJSON(w, http.StatusOK, user)
+	w.Header().Set("ETag", userETag(user.Version))
+	_ = app.writeJSON(w, http.StatusOK, newUserResponse(user))
 }
 
+// updateUser applies a partial update to the user named in the URL, sent as
+// an RFC 7396 merge patch or, with the application/json-patch+json content
+// type, an RFC 6902 JSON Patch. Users may change their own names; admins may
+// change anyone's names, email address and admin rights.
+//
+// The request must have an If-Match header holding the ETag the client got
+// the user with, so that it can't overwrite changes it hasn't seen: a stale
+// ETag gets 412, and losing a race with another update after the check gets
+// 409.
 func (app *application) updateUser(w http.ResponseWriter, r *http.Request) {
-	var user data.User
-	err := app.readJSON(w, r, &user)
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
-	err = app.DB.UpdateUser(user)
+
+	var apply func(userPatcher, *data.User, []byte) error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case mergePatchType, "application/json", "":
+		apply = userPatcher.applyMergePatch
+	case jsonPatchType:
+		apply = userPatcher.applyJSONPatch
+	default:
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		app.errorJSON(w, fmt.Errorf("unsupported patch format %s", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1024*1024))
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		app.errorJSON(w, errors.New("an If-Match header with the user's ETag is required"), http.StatusPreconditionRequired)
+		return
+	}
+
+	caller, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
+		return
+	}
+	patcher := userPatcher{allowed: adminPatchable}
+	if !caller.IsAdmin {
+		if caller.ID != userID {
+			app.errorJSON(w, errors.New("you may only change your own account"), http.StatusForbidden)
+			return
+		}
+		patcher.allowed = selfPatchable
+	}
+
+	current, err := app.db(r).GetUser(userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if !etagMatches(ifMatch, userETag(current.Version)) {
+		app.errorJSON(w, errors.New("the user has changed; fetch it again before updating it"), http.StatusPreconditionFailed)
+		return
+	}
+
+	user := *current
+	err = apply(patcher, &user, body)
+	var forbidden patchForbiddenError
+	switch {
+	case errors.As(err, &forbidden):
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	case errors.Is(err, errPatchTestFailed):
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	case err != nil:
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if caller.ID == user.ID && caller.IsAdmin && !user.IsAdmin {
+		app.errorJSON(w, errors.New("you cannot remove your own admin rights"), http.StatusForbidden)
+		return
+	}
+	if user.Email != current.Email {
+		if existing, err := app.db(r).GetUserByEmail(user.Email); err == nil && existing.ID != user.ID {
+			app.errorJSON(w, errors.New("email address is already in use"), http.StatusConflict)
+			return
+		}
+	}
+
+	if user == *current {
+		// nothing changed, so there is no new version
+		w.Header().Set("ETag", userETag(current.Version))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = app.db(r).UpdateUser(user)
+	if errors.Is(err, repository.ErrConflict) {
+		app.errorJSON(w, errors.New("the user was changed by someone else; fetch it again before updating it"), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(user.Version+1))
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -225,7 +338,7 @@ func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
-	err = app.DB.DeleteUser(userID)
+	err = app.db(r).DeleteUser(userID)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
@@ -233,21 +346,196 @@ func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (app *application) insertUser(w http.ResponseWriter, r *http.Request) {
-	var user data.User
-	err := app.readJSON(w, r, &user)
+// restoreUser undoes the deletion of a user that has not been purged yet.
+// Only admins may restore users, and not once someone else has taken the
+// user's email address, which answers 409.
+func (app *application) restoreUser(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.callerIsAdmin(w, r); !ok {
+		return
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	err = app.db(r).RestoreUser(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("no deleted user with that id"), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, repository.ErrConflict) {
+		app.errorJSON(w, errors.New("another user has this user's email address now"), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createUser adds a user, answering 201 with the new user and its URL. Only
+// admins may create users, and as an admin vouches for them they start out
+// verified.
+func (app *application) createUser(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.callerIsAdmin(w, r); !ok {
+		return
+	}
+
+	var req userRequest
+	err := app.readJSON(w, r, &req)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(true); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if _, err := app.db(r).GetUserByEmail(req.Email); err == nil {
+		app.errorJSON(w, errors.New("email address is already in use"), http.StatusConflict)
+		return
+	}
+
+	user := req.user()
+	user.ID, err = app.db(r).InsertUser(user)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeCreatedUser(w, &user)
+}
+
+// putUser replaces the user named in the URL with the one in the body, or
+// creates it with that id if there is no such user, so that repeating the
+// request leaves the same user behind. Replacing a user honours If-Match, and
+// keeps their password unless a new one is sent; If-None-Match: * only
+// creates. Only admins may put users.
+func (app *application) putUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || userID < 1 {
+		app.errorJSON(w, errors.New("invalid user id"), http.StatusBadRequest)
+		return
+	}
+	caller, ok := app.callerIsAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req userRequest
+	err = app.readJSON(w, r, &req)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
 
-	_, err = app.DB.InsertUser(user)
+	current, err := app.db(r).GetUser(userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.createUserWithID(w, r, userID, req)
+		return
+	}
 	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if r.Header.Get("If-None-Match") == "*" ||
+		(r.Header.Get("If-Match") != "" && !etagMatches(r.Header.Get("If-Match"), userETag(current.Version))) {
+		app.errorJSON(w, errors.New("the user has changed; fetch it again before replacing it"), http.StatusPreconditionFailed)
+		return
+	}
+	if err := req.validate(false); err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
+	if existing, err := app.db(r).GetUserByEmail(req.Email); err == nil && existing.ID != userID {
+		app.errorJSON(w, errors.New("email address is already in use"), http.StatusConflict)
+		return
+	}
 
-	w.WriteHeader(http.StatusNoContent)
+	user := *current
+	user.FirstName = req.FirstName
+	user.LastName = req.LastName
+	user.Email = req.Email
+	user.IsAdmin = bool(req.IsAdmin)
+	if caller.ID == userID && !user.IsAdmin {
+		app.errorJSON(w, errors.New("you cannot remove your own admin rights"), http.StatusForbidden)
+		return
+	}
+
+	// the user's details and password are replaced together, or not at all
+	err = app.db(r).WithTx(func(repo repository.DatabaseRepo) error {
+		err := repo.UpdateUser(user)
+		if err != nil || req.Password == "" {
+			return err
+		}
+		return repo.ResetPassword(userID, req.Password)
+	})
+	if errors.Is(err, repository.ErrConflict) {
+		app.errorJSON(w, errors.New("the user was changed by someone else; fetch it again before replacing it"), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(user.Version+1))
+	_ = app.writeJSON(w, http.StatusOK, newUserResponse(&user))
+}
+
+// createUserWithID is the half of putUser that creates a user.
+func (app *application) createUserWithID(w http.ResponseWriter, r *http.Request, userID int, req userRequest) {
+	if r.Header.Get("If-Match") != "" {
+		app.errorJSON(w, errors.New("user not found"), http.StatusPreconditionFailed)
+		return
+	}
+	if err := req.validate(true); err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+	if _, err := app.db(r).GetUserByEmail(req.Email); err == nil {
+		app.errorJSON(w, errors.New("email address is already in use"), http.StatusConflict)
+		return
+	}
+
+	user := req.user()
+	user.ID = userID
+	err := app.db(r).InsertUserWithID(user)
+	if errors.Is(err, repository.ErrConflict) {
+		app.errorJSON(w, errors.New("the id belongs to a deleted user; restore it instead"), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeCreatedUser(w, &user)
+}
+
+// writeCreatedUser answers a request that created user.
+func (app *application) writeCreatedUser(w http.ResponseWriter, user *data.User) {
+	w.Header().Set("Location", fmt.Sprintf("/v1/users/%d", user.ID))
+	w.Header().Set("ETag", userETag(1))
+	_ = app.writeJSON(w, http.StatusCreated, newUserResponse(user))
+}
+
+// callerIsAdmin returns the user who made the request and whether they are an
+// admin, and answers the request with 401 or 403 if not.
+func (app *application) callerIsAdmin(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	caller, err := app.requestUser(r)
+	if err != nil {
+		app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
+		return nil, false
+	}
+	if !caller.IsAdmin {
+		app.errorJSON(w, errors.New("only admins may do that"), http.StatusForbidden)
+		return nil, false
+	}
+	return caller, true
 }
 
 func (app *application) deleteRefreshCookie(w http.ResponseWriter, r *http.Request) {
@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 	"webapp/pkg/data"
+	"webapp/pkg/repository"
+	"webapp/pkg/repository/dbrepo"
 )
 
 func Test_app_authenticate(t *testing.T) {
@@ -49,8 +55,20 @@ func Test_app_authenticate(t *testing.T) {
 			requestBody:    `{"email":"randomguy@example.com", "password":"secret"}`,
 			expectedStatus: http.StatusUnauthorized,
 		},
+		{
+			name:           "email not verified",
+			requestBody:    `{"email":"unverified@example.com", "password":"secret"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "email not verified, wrong password",
+			requestBody:    `{"email":"unverified@example.com", "password":"password"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
 	}
 	for _, e := range tests {
+		resetDB()
+
 		var reader io.Reader = strings.NewReader(e.requestBody)
 		req, _ := http.NewRequest(http.MethodPost, "/v1/auth", reader)
 		rr := httptest.NewRecorder()
@@ -70,20 +88,24 @@ func Test_app_refresh(t *testing.T) {
 		token              string
 		expectedStatusCode int
 		resetRefreshTime   bool
+		userID             int
 	}{
-		{"valid", "", http.StatusOK, true},
-		{"valid but not yet ready to expire", "", http.StatusTooEarly, false},
-		{"expired token", expiredToken, http.StatusBadRequest, false},
+		{"valid", "", http.StatusOK, true, 1},
+		{"valid but not yet ready to expire", "", http.StatusTooEarly, false, 1},
+		{"expired token", expiredToken, http.StatusBadRequest, false, 1},
+		{"deleted user", "", http.StatusBadRequest, true, 5},
 	}
-	testUser := data.User{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@example.com"}
 
 	oldRefreshTime := jwtRefreshTokenExpiry
 	for _, e := range tests {
+		resetDB()
+
 		var tkn string
 		if e.token == "" {
 			if e.resetRefreshTime {
 				jwtRefreshTokenExpiry = 1 * time.Second
 			}
+			testUser := data.User{ID: e.userID, FirstName: "Admin", LastName: "User", Email: "admin@example.com"}
 			tokens, _ := app.generateTokenPair(&testUser)
 			tkn = tokens.RefreshToken
 		} else {
@@ -131,17 +153,19 @@ func Test_app_userHandlers(t *testing.T) {
 			"update user invalid json", http.MethodPatch, `{"id":1, first_name: "Administrator", "last_name": "User", "email": "admin@example.com"}`, "1", app.updateUser, http.StatusBadRequest,
 		},
 		{
-			"insert user", http.MethodPut, `{"first_name": "Jack", "last_name": "Smith", "email": "jack@example.com"}`, "", app.insertUser, http.StatusNoContent,
+			"create user", http.MethodPost, `{"first_name": "Jack", "last_name": "Smith", "email": "jack@example.com", "password": "secret"}`, "", app.createUser, http.StatusCreated,
 		},
 		{
-			"insert invalid user", http.MethodPut, `{ "foo": "bar","first_name: "Jack", "last_name": "Smith", "email": "jack@example.com"}`, "", app.insertUser, http.StatusBadRequest,
+			"create invalid user", http.MethodPost, `{ "foo": "bar","first_name: "Jack", "last_name": "Smith", "email": "jack@example.com"}`, "", app.createUser, http.StatusBadRequest,
 		},
 		{
-			"insert user invalid json", http.MethodPut, `{ first_name: "Jack", "last_name": "Smith", "email": "jack@example.com"}`, "", app.insertUser, http.StatusBadRequest,
+			"create user invalid json", http.MethodPost, `{ first_name: "Jack", "last_name": "Smith", "email": "jack@example.com"}`, "", app.createUser, http.StatusBadRequest,
 		},
 	}
 
 	for _, e := range tests {
+		resetDB()
+
 		var req *http.Request
 		if e.json == "" {
 			req, _ = http.NewRequest(e.method, "/v1/users", nil)
@@ -153,6 +177,13 @@ func Test_app_userHandlers(t *testing.T) {
 			chiCtx.URLParams.Add("id", e.paramID)
 			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
 		}
+		if e.method == http.MethodPatch {
+			// the test database's admin is at version 1
+			req.Header.Set("If-Match", userETag(1))
+		}
+		if e.method == http.MethodPatch || e.method == http.MethodPost {
+			req = withCaller(req, 1)
+		}
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(e.handler)
 		handler.ServeHTTP(rr, req)
@@ -162,10 +193,358 @@ func Test_app_userHandlers(t *testing.T) {
 	}
 }
 
+// withCaller returns r as if authRequired had let it through with a token
+// for the user with the given id.
+func withCaller(r *http.Request, id int) *http.Request {
+	claims := &Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.Itoa(id)}}
+	return r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+}
+
+func Test_app_updateUser(t *testing.T) {
+	var tests = []struct {
+		name               string
+		callerID           int
+		paramID            string
+		contentType        string
+		body               string
+		ifMatch            string
+		expectedStatusCode int
+		expectedETag       string
+	}{
+		{"merge patch", 1, "1", mergePatchType, `{"first_name":"Administrator"}`, `"1"`, http.StatusNoContent, `"2"`},
+		{"plain json", 1, "1", "application/json", `{"last_name":"Person"}`, `"1"`, http.StatusNoContent, `"2"`},
+		{"whole user", 1, "1", "application/json", `{"id":1,"first_name":"Admin","last_name":"User","email":"admin@example.com","is_admin":1}`, `"1"`, http.StatusNoContent, `"1"`},
+		{"no changes", 1, "1", mergePatchType, `{}`, `"1"`, http.StatusNoContent, `"1"`},
+		{"any etag", 1, "1", mergePatchType, `{"first_name":"Administrator"}`, "*", http.StatusNoContent, `"2"`},
+		{"stale etag", 1, "1", mergePatchType, `{"first_name":"Administrator"}`, `"0"`, http.StatusPreconditionFailed, ""},
+		{"missing etag", 1, "1", mergePatchType, `{"first_name":"Administrator"}`, "", http.StatusPreconditionRequired, ""},
+		{"blank name", 1, "1", mergePatchType, `{"first_name":"  "}`, `"1"`, http.StatusBadRequest, ""},
+		{"removing a field", 1, "1", mergePatchType, `{"last_name":null}`, `"1"`, http.StatusBadRequest, ""},
+		{"invalid email", 1, "1", mergePatchType, `{"email":"Admin <admin@example.com>"}`, `"1"`, http.StatusBadRequest, ""},
+		{"email in use", 1, "3", mergePatchType, `{"email":"admin@example.com"}`, `"1"`, http.StatusConflict, ""},
+		{"unknown field", 1, "1", mergePatchType, `{"password":"secret"}`, `"1"`, http.StatusBadRequest, ""},
+		{"id in body differs", 1, "1", mergePatchType, `{"id":3}`, `"1"`, http.StatusBadRequest, ""},
+		{"email_verified is ignored", 1, "3", mergePatchType, `{"email_verified":true}`, `"1"`, http.StatusNoContent, `"1"`},
+		{"not an object", 1, "1", mergePatchType, `["first_name"]`, `"1"`, http.StatusBadRequest, ""},
+		{"admin making someone admin", 1, "3", mergePatchType, `{"is_admin":true}`, `"1"`, http.StatusNoContent, `"2"`},
+		{"admin dropping own rights", 1, "1", mergePatchType, `{"is_admin":false}`, `"1"`, http.StatusForbidden, ""},
+		{"user renaming self", 3, "3", mergePatchType, `{"first_name":"Jack"}`, `"1"`, http.StatusNoContent, `"2"`},
+		{"user making self admin", 3, "3", mergePatchType, `{"is_admin":true}`, `"1"`, http.StatusForbidden, ""},
+		{"user changing own email", 3, "3", mergePatchType, `{"email":"jack@example.com"}`, `"1"`, http.StatusForbidden, ""},
+		{"user sending own email unchanged", 3, "3", mergePatchType, `{"first_name":"Jack","email":"unverified@example.com","is_admin":0}`, `"1"`, http.StatusNoContent, `"2"`},
+		{"user changing someone else", 3, "1", mergePatchType, `{"first_name":"Jack"}`, `"1"`, http.StatusForbidden, ""},
+		{"unknown user", 1, "2", mergePatchType, `{"first_name":"Jack"}`, `"1"`, http.StatusNotFound, ""},
+		{"json patch", 1, "1", jsonPatchType, `[{"op":"test","path":"/is_admin","value":1},{"op":"replace","path":"/first_name","value":"Administrator"}]`, `"1"`, http.StatusNoContent, `"2"`},
+		{"json patch failed test", 1, "1", jsonPatchType, `[{"op":"test","path":"/first_name","value":"Someone"},{"op":"replace","path":"/first_name","value":"Administrator"}]`, `"1"`, http.StatusConflict, ""},
+		{"json patch remove", 1, "1", jsonPatchType, `[{"op":"remove","path":"/first_name"}]`, `"1"`, http.StatusBadRequest, ""},
+		{"json patch forbidden field", 3, "3", jsonPatchType, `[{"op":"add","path":"/is_admin","value":true}]`, `"1"`, http.StatusForbidden, ""},
+		{"json patch bad path", 1, "1", jsonPatchType, `[{"op":"replace","path":"first_name","value":"Administrator"}]`, `"1"`, http.StatusBadRequest, ""},
+		{"unsupported format", 1, "1", "text/plain", `first_name=Administrator`, `"1"`, http.StatusUnsupportedMediaType, ""},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest(http.MethodPatch, "/v1/users/"+e.paramID, strings.NewReader(e.body))
+		req.Header.Set("Content-Type", e.contentType)
+		if e.ifMatch != "" {
+			req.Header.Set("If-Match", e.ifMatch)
+		}
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("id", e.paramID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		req = withCaller(req, e.callerID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.updateUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body)
+		}
+		if etag := rr.Header().Get("ETag"); etag != e.expectedETag {
+			t.Errorf("%s: expected ETag %q, got %q", e.name, e.expectedETag, etag)
+		}
+	}
+}
+
+func Test_app_updateUser_roundTrip(t *testing.T) {
+	var tests = []struct {
+		name     string
+		callerID int
+		id       string
+	}{
+		{"admin", 1, "1"},
+		{"user", 3, "3"},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("id", e.id)
+		ctx := context.WithValue(context.Background(), chi.RouteCtxKey, chiCtx)
+
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/v1/users/"+e.id, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.getUser).ServeHTTP(rr, withCaller(req, e.callerID))
+		etag := rr.Header().Get("ETag")
+
+		// send back exactly what was fetched, email_verified and all
+		req, _ = http.NewRequestWithContext(ctx, http.MethodPatch, "/v1/users/"+e.id, rr.Body)
+		req.Header.Set("Content-Type", mergePatchType)
+		req.Header.Set("If-Match", etag)
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(app.updateUser).ServeHTTP(rr, withCaller(req, e.callerID))
+
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("%s: expected status %d sending back the fetched user, got %d: %s", e.name, http.StatusNoContent, rr.Code, rr.Body)
+		}
+		if rr.Header().Get("ETag") != etag {
+			t.Errorf("%s: expected the ETag to stay %s, got %s", e.name, etag, rr.Header().Get("ETag"))
+		}
+	}
+}
+
+func Test_app_getUser_etag(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/v1/users/1", nil)
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("id", "1")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.getUser)
+	handler.ServeHTTP(rr, req)
+
+	if etag := rr.Header().Get("ETag"); etag != `"1"` {
+		t.Errorf("expected ETag %q, got %q", `"1"`, etag)
+	}
+}
+
+func Test_app_getUser_hidesInternalFields(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/v1/users/1", nil)
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("id", "1")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.getUser)
+	handler.ServeHTTP(rr, req)
+
+	for _, field := range []string{"password", "version", "created_at", "updated_at", "deleted_at"} {
+		if strings.Contains(rr.Body.String(), `"`+field+`"`) {
+			t.Errorf("expected %s not to be in the response, got %s", field, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_restoreUser(t *testing.T) {
+	var tests = []struct {
+		name               string
+		callerID           int
+		paramID            string
+		expectedStatusCode int
+	}{
+		{"deleted user", 1, "5", http.StatusNoContent},
+		{"not an admin", 3, "5", http.StatusForbidden},
+		{"user not deleted", 1, "1", http.StatusNotFound},
+		{"invalid param", 1, "Y", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest(http.MethodPost, "/v1/users/"+e.paramID+"/restore", nil)
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("id", e.paramID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		req = withCaller(req, e.callerID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.restoreUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_restoreUserEmailTaken(t *testing.T) {
+	memApp := app
+	repo := dbrepo.NewMemoryDBRepo()
+	memApp.DB = repo
+	admin, _ := repo.InsertUser(data.User{FirstName: "Admin", LastName: "User", Email: "admin@example.com", Password: "secret", IsAdmin: true})
+	deleted, _ := repo.InsertUser(data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Password: "secret"})
+	_ = repo.DeleteUser(deleted)
+	_, _ = repo.InsertUser(data.User{FirstName: "Jack", LastName: "Jones", Email: "jack@example.com", Password: "secret"})
+
+	id := strconv.Itoa(deleted)
+	req, _ := http.NewRequest(http.MethodPost, "/v1/users/"+id+"/restore", nil)
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("id", id)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	req = withCaller(req, admin)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(memApp.restoreUser)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected status %d, got %d: %s", http.StatusConflict, rr.Code, rr.Body.String())
+	}
+	if _, err := repo.GetUser(deleted); err == nil {
+		t.Error("expected the user to stay deleted")
+	}
+}
+
+func Test_app_createUser(t *testing.T) {
+	var tests = []struct {
+		name               string
+		callerID           int
+		body               string
+		expectedStatusCode int
+		expectedLocation   string
+	}{
+		{"valid", 1, `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret","is_admin":false}`, http.StatusCreated, "/v1/users/6"},
+		{"not an admin", 3, `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}`, http.StatusForbidden, ""},
+		{"no password", 1, `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com"}`, http.StatusBadRequest, ""},
+		{"invalid email", 1, `{"first_name":"Jack","last_name":"Smith","email":"jack.example.com","password":"secret"}`, http.StatusBadRequest, ""},
+		{"email in use", 1, `{"first_name":"Jack","last_name":"Smith","email":"admin@example.com","password":"secret"}`, http.StatusConflict, ""},
+		{"internal field", 1, `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret","email_verified":false}`, http.StatusBadRequest, ""},
+		{"id", 1, `{"id":7,"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}`, http.StatusBadRequest, ""},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(e.body))
+		req = withCaller(req, e.callerID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.createUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+		if location := rr.Header().Get("Location"); location != e.expectedLocation {
+			t.Errorf("%s: expected Location %q, got %q", e.name, e.expectedLocation, location)
+		}
+		if rr.Code == http.StatusCreated {
+			var created userResponse
+			_ = json.NewDecoder(rr.Body).Decode(&created)
+			if created.ID != 6 || created.Email != "jack@example.com" || !created.EmailVerified {
+				t.Errorf("%s: unexpected user in response: %+v", e.name, created)
+			}
+		}
+	}
+}
+
+func Test_app_putUser(t *testing.T) {
+	var tests = []struct {
+		name               string
+		callerID           int
+		paramID            string
+		body               string
+		ifMatch            string
+		ifNoneMatch        string
+		expectedStatusCode int
+		expectedETag       string
+	}{
+		{"replace", 1, "3", `{"first_name":"Old","last_name":"User","email":"unverified@example.com"}`, "", "", http.StatusOK, `"2"`},
+		{"replace with etag", 1, "3", `{"first_name":"Old","last_name":"User","email":"unverified@example.com"}`, `"1"`, "", http.StatusOK, `"2"`},
+		{"replace with new password", 1, "3", `{"first_name":"Old","last_name":"User","email":"unverified@example.com","password":"secret"}`, "", "", http.StatusOK, `"2"`},
+		{"replace with stale etag", 1, "3", `{"first_name":"Old","last_name":"User","email":"unverified@example.com"}`, `"0"`, "", http.StatusPreconditionFailed, ""},
+		{"replace when creating", 1, "3", `{"first_name":"Old","last_name":"User","email":"unverified@example.com"}`, "", "*", http.StatusPreconditionFailed, ""},
+		{"replace with short password", 1, "3", `{"first_name":"Old","last_name":"User","email":"unverified@example.com","password":"abc"}`, "", "", http.StatusBadRequest, ""},
+		{"replace with email in use", 1, "3", `{"first_name":"Old","last_name":"User","email":"admin@example.com"}`, "", "", http.StatusConflict, ""},
+		{"replace own admin rights", 1, "1", `{"first_name":"Admin","last_name":"User","email":"admin@example.com","is_admin":false}`, "", "", http.StatusForbidden, ""},
+		{"replace self", 1, "1", `{"first_name":"Admin","last_name":"User","email":"admin@example.com","is_admin":true}`, "", "", http.StatusOK, `"2"`},
+		{"create", 1, "2", `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}`, "", "", http.StatusCreated, `"1"`},
+		{"create only", 1, "2", `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}`, "", "*", http.StatusCreated, `"1"`},
+		{"create with etag", 1, "2", `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}`, `"1"`, "", http.StatusPreconditionFailed, ""},
+		{"create without password", 1, "2", `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com"}`, "", "", http.StatusBadRequest, ""},
+		{"create with email in use", 1, "2", `{"first_name":"Jack","last_name":"Smith","email":"admin@example.com","password":"secret"}`, "", "", http.StatusConflict, ""},
+		{"create over deleted user", 1, "5", `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}`, "", "", http.StatusConflict, ""},
+		{"not an admin", 3, "3", `{"first_name":"Old","last_name":"User","email":"unverified@example.com"}`, "", "", http.StatusForbidden, ""},
+		{"internal field", 1, "3", `{"first_name":"Old","last_name":"User","email":"unverified@example.com","version":7}`, "", "", http.StatusBadRequest, ""},
+		{"invalid id", 1, "Y", `{"first_name":"Old","last_name":"User","email":"unverified@example.com"}`, "", "", http.StatusBadRequest, ""},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest(http.MethodPut, "/v1/users/"+e.paramID, strings.NewReader(e.body))
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("id", e.paramID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		req = withCaller(req, e.callerID)
+		if e.ifMatch != "" {
+			req.Header.Set("If-Match", e.ifMatch)
+		}
+		if e.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", e.ifNoneMatch)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.putUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+		if etag := rr.Header().Get("ETag"); etag != e.expectedETag {
+			t.Errorf("%s: expected ETag %q, got %q", e.name, e.expectedETag, etag)
+		}
+		if rr.Code == http.StatusCreated && rr.Header().Get("Location") != "/v1/users/"+e.paramID {
+			t.Errorf("%s: expected Location /v1/users/%s, got %q", e.name, e.paramID, rr.Header().Get("Location"))
+		}
+	}
+}
+
+// unreadableUserRepo fails to read one user, as if the database had gone
+// away, and otherwise reads from the repo it wraps.
+type unreadableUserRepo struct {
+	repository.DatabaseRepo
+	id int
+}
+
+func (repo unreadableUserRepo) Primary() repository.DatabaseRepo { return repo }
+
+func (repo unreadableUserRepo) GetUser(id int) (*data.User, error) {
+	if id == repo.id {
+		return nil, errors.New("connection refused")
+	}
+	return repo.DatabaseRepo.GetUser(id)
+}
+
+func Test_app_putUserReadFails(t *testing.T) {
+	brokenApp := app
+	brokenApp.DB = unreadableUserRepo{DatabaseRepo: app.DB, id: 3}
+
+	req, _ := http.NewRequest(http.MethodPut, "/v1/users/3", strings.NewReader(`{"first_name":"Old","last_name":"User","email":"unverified@example.com"}`))
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("id", "3")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	req = withCaller(req, 1)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(brokenApp.putUser)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d: %s", http.StatusInternalServerError, rr.Code, rr.Body.String())
+	}
+}
+
 func Test_app_refreshUsingCookie(t *testing.T) {
 	testUser := data.User{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@example.com"}
 	tokens, _ := app.generateTokenPair(&testUser)
 	testCookie := &http.Cookie{Name: "_Host-refresh_token", Path: "./", Value: tokens.RefreshToken, Expires: time.Now().Add(jwtRefreshTokenExpiry), MaxAge: int(jwtRefreshTokenExpiry.Seconds()), SameSite: http.SameSiteStrictMode, Domain: "localhost", HttpOnly: true, Secure: true}
+	deletedUser := data.User{ID: 5, FirstName: "Deleted", LastName: "User", Email: "deleted@example.com"}
+	deletedTokens, _ := app.generateTokenPair(&deletedUser)
+	deletedCookie := &http.Cookie{Name: "_Host-refresh_token", Path: "./", Value: deletedTokens.RefreshToken, Expires: time.Now().Add(jwtRefreshTokenExpiry), MaxAge: int(jwtRefreshTokenExpiry.Seconds()), SameSite: http.SameSiteStrictMode, Domain: "localhost", HttpOnly: true, Secure: true}
 	badCookie := &http.Cookie{Name: "_Host-refresh_token", Path: "./", Value: "somebadstring", Expires: time.Now().Add(jwtRefreshTokenExpiry), MaxAge: int(jwtRefreshTokenExpiry.Seconds()), SameSite: http.SameSiteStrictMode, Domain: "localhost", HttpOnly: true, Secure: true}
 
 	tests := []struct {
@@ -176,9 +555,12 @@ func Test_app_refreshUsingCookie(t *testing.T) {
 	}{
 		{"valid cookie", true, testCookie, http.StatusOK},
 		{"invalid cookie", true, badCookie, http.StatusBadRequest},
+		{"deleted user", true, deletedCookie, http.StatusBadRequest},
 		{"invalid cookie", false, nil, http.StatusUnauthorized},
 	}
 	for _, e := range tests {
+		resetDB()
+
 		rr := httptest.NewRecorder()
 		req, _ := http.NewRequest(http.MethodGet, "/web/refresh-token", nil)
 		if e.addCookie {
@@ -213,3 +595,50 @@ func Test_app_deleteRefreshCookie(t *testing.T) {
 		t.Error("_Host-refresh_token cookie not found")
 	}
 }
+
+func Test_app_createdUserCanBeRead(t *testing.T) {
+	memApp := app
+	repo := dbrepo.NewMemoryDBRepo()
+	memApp.DB = repo
+	admin, _ := repo.InsertUser(data.User{FirstName: "Admin", LastName: "User", Email: "admin@example.com", Password: "secret", IsAdmin: true})
+
+	serve := func(handler http.HandlerFunc, method, id, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/v1/users/"+id, strings.NewReader(body))
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("id", id)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		req = withCaller(req, admin)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(memApp.createUser, http.MethodPost, "", `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d creating a user, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	id := strings.TrimPrefix(rr.Header().Get("Location"), "/v1/users/")
+
+	rr = serve(memApp.getUser, http.MethodGet, id, "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"email":"jack@example.com"`) {
+		t.Errorf("expected to read back the created user, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = serve(memApp.putUser, http.MethodPut, id, `{"first_name":"John","last_name":"Smith","email":"john@example.com"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d replacing the user, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	rr = serve(memApp.getUser, http.MethodGet, id, "")
+	if !strings.Contains(rr.Body.String(), `"email":"john@example.com"`) || rr.Header().Get("ETag") != `"2"` {
+		t.Errorf("expected to read back the replaced user at version 2, got %s: %s", rr.Header().Get("ETag"), rr.Body.String())
+	}
+
+	rr = serve(memApp.deleteUser, http.MethodDelete, id, "")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected status %d deleting the user, got %d", http.StatusNoContent, rr.Code)
+	}
+	rr = serve(memApp.getUser, http.MethodGet, id, "")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected a deleted user not to be found, got %d", rr.Code)
+	}
+}
@@ -1,14 +1,21 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"webapp/pkg/data"
+)
 
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8090")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 		if r.Method == http.MethodOptions {
 			w.Header().Set("Access-Control-Allow-Credentials", "true")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, X-CSRF-Token")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, If-Match, X-CSRF-Token")
 			return
 		} else {
 			next.ServeHTTP(w, r)
@@ -16,14 +23,34 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
+// claimsKey is the request context key of the verified token's claims.
+const claimsKey contextKey = "claims"
+
+type contextKey string
+
 func (app *application) authRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// get the token from the header and verify it
-		_, _, err := app.getTokenFromHeaderAndVerify(w, r)
+		_, claims, err := app.getTokenFromHeaderAndVerify(w, r)
 		if err != nil {
 			app.errorJSON(w, err, http.StatusUnauthorized)
 			return
 		}
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), claimsKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// requestUser returns the user whose token authorized r, which must have
+// passed through authRequired.
+func (app *application) requestUser(r *http.Request) (*data.User, error) {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	if !ok {
+		return nil, errors.New("request is not authenticated")
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	return app.db(r).GetUser(id)
+}
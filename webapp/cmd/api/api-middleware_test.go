@@ -37,7 +37,9 @@ func Test_app_enableCORS(t *testing.T) {
 }
 
 func Test_app_authRequired(t *testing.T) {
+	var caller *data.User
 	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, _ = app.requestUser(r)
 	})
 
 	testUser := data.User{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@example.com"}
@@ -71,5 +73,10 @@ func Test_app_authRequired(t *testing.T) {
 		if rr.Code != http.StatusUnauthorized && !e.expectAuthorized {
 			t.Errorf("%s: expected unauthorized, got authorized", e.name)
 		}
+
+		if e.expectAuthorized && (caller == nil || caller.ID != testUser.ID) {
+			t.Errorf("%s: expected the token's user to be available to the next handler", e.name)
+		}
+		caller = nil
 	}
 }
@@ -22,16 +22,21 @@ func (app *application) routes() http.Handler {
 	// authentication routes - auth handler, refresh handler
 	mux.Post("/v1/auth", app.authenticate)
 	mux.Post("/v1/refresh-token", app.refresh)
+	mux.Post("/v1/register", app.register)
 
 	// protected routes
 	mux.Route("/v1/users", func(mux chi.Router) {
 		mux.Use(app.authRequired)
 
 		mux.Get("/", app.allUsers)
+		mux.Post("/", app.createUser)
+		mux.Post("/import", app.importUsers)
+		mux.Get("/export", app.exportUsers)
 		mux.Get("/{id}", app.getUser)
 		mux.Delete("/{id}", app.deleteUser)
-		mux.Put("/{id}", app.insertUser)
-		mux.Patch("/", app.updateUser)
+		mux.Post("/{id}/restore", app.restoreUser)
+		mux.Put("/{id}", app.putUser)
+		mux.Patch("/{id}", app.updateUser)
 	})
 
 	return mux
@@ -14,11 +14,16 @@ func Test_application_routes(t *testing.T) {
 	}{
 		{"/v1/auth", "POST"},
 		{"/v1/refresh-token", "POST"},
+		{"/v1/register", "POST"},
 		{"/v1/users/", "GET"},
+		{"/v1/users/", "POST"},
+		{"/v1/users/import", "POST"},
+		{"/v1/users/export", "GET"},
 		{"/v1/users/{id}", "GET"},
 		{"/v1/users/{id}", "DELETE"},
+		{"/v1/users/{id}/restore", "POST"},
 		{"/v1/users/{id}", "PUT"},
-		{"/v1/users/", "PATCH"},
+		{"/v1/users/{id}", "PATCH"},
 	}
 
 	mux := app.routes()
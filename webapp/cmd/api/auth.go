@@ -82,11 +82,7 @@ func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
 	claims["sub"] = fmt.Sprint(user.ID)
 	claims["aud"] = app.Domain
 	claims["iss"] = app.Domain
-	if user.IsAdmin == 1 {
-		claims["admin"] = true
-	} else {
-		claims["admin"] = false
-	}
+	claims["admin"] = user.IsAdmin
 
 	// set the expiry
 	claims["exp"] = time.Now().Add(jwtTokenExpiry).Unix()
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"webapp/pkg/userfile"
+)
+
+// maxImportBytes limits the size of an import file.
+const maxImportBytes = 10 * 1024 * 1024
+
+// importUsers adds the users in a CSV or NDJSON file, sent with the text/csv
+// or application/x-ndjson content type. By default the file is imported all
+// or nothing, and a file with any invalid row gets 422 with every row's
+// errors; mode=best-effort imports the valid rows and reports the rest.
+// dry_run=true reports what would happen without importing anything. Only
+// admins may import users.
+func (app *application) importUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.callerIsAdmin(w, r); !ok {
+		return
+	}
+
+	format, err := userfile.ParseFormat(r.Header.Get("Content-Type"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var opts userfile.ImportOptions
+	switch mode := r.URL.Query().Get("mode"); mode {
+	case "", "atomic":
+	case "best-effort":
+		opts.BestEffort = true
+	default:
+		app.errorJSON(w, fmt.Errorf("unknown mode %q; use atomic or best-effort", mode), http.StatusBadRequest)
+		return
+	}
+	if dryRun := r.URL.Query().Get("dry_run"); dryRun != "" {
+		opts.DryRun, err = strconv.ParseBool(dryRun)
+		if err != nil {
+			app.errorJSON(w, fmt.Errorf("dry_run must be true or false, not %q", dryRun), http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := userfile.Read(http.MaxBytesReader(w, r.Body, maxImportBytes), format)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	result, err := userfile.Import(app.db(r), records, opts)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if len(result.Errors) > 0 && !opts.BestEffort && !opts.DryRun {
+		status = http.StatusUnprocessableEntity
+	}
+	_ = app.writeJSON(w, status, result)
+}
+
+// exportUsers streams every user as CSV or, with format=ndjson, as NDJSON.
+// Only admins may export users.
+func (app *application) exportUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.callerIsAdmin(w, r); !ok {
+		return
+	}
+
+	format := userfile.CSV
+	if name := r.URL.Query().Get("format"); name != "" {
+		var err error
+		format, err = userfile.ParseFormat(name)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", format.MediaType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+
+	out := userfile.NewWriter(w, format)
+	err := app.db(r).EachUser(out.Write)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		// the response has started, so all that can be done is to stop it
+		log.Println("exporting users:", err)
+		panic(http.ErrAbortHandler)
+	}
+}
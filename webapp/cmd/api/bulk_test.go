@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"webapp/pkg/userfile"
+)
+
+func Test_app_importUsers(t *testing.T) {
+	valid := "first_name,last_name,email,password\nJack,Smith,jack@example.com,secret\n"
+	invalid := valid + "Admin,User,admin@example.com,secret\n"
+	ndjson := `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}` + "\n"
+
+	var tests = []struct {
+		name               string
+		callerID           int
+		contentType        string
+		query              string
+		body               string
+		expectedStatusCode int
+		expectedImported   int
+	}{
+		{"csv", 1, "text/csv", "", valid, http.StatusOK, 1},
+		{"ndjson", 1, "application/x-ndjson", "", ndjson, http.StatusOK, 1},
+		{"invalid", 1, "text/csv", "", invalid, http.StatusUnprocessableEntity, 0},
+		{"invalid best effort", 1, "text/csv", "?mode=best-effort", invalid, http.StatusOK, 1},
+		{"invalid dry run", 1, "text/csv", "?dry_run=true", invalid, http.StatusOK, 0},
+		{"valid dry run", 1, "text/csv", "?dry_run=1", valid, http.StatusOK, 1},
+		{"unknown mode", 1, "text/csv", "?mode=some", valid, http.StatusBadRequest, 0},
+		{"bad dry run", 1, "text/csv", "?dry_run=maybe", valid, http.StatusBadRequest, 0},
+		{"unusable file", 1, "text/csv", "", "name,email\n", http.StatusBadRequest, 0},
+		{"unsupported type", 1, "application/json", "", ndjson, http.StatusUnsupportedMediaType, 0},
+		{"not an admin", 3, "text/csv", "", valid, http.StatusForbidden, 0},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest(http.MethodPost, "/v1/users/import"+e.query, strings.NewReader(e.body))
+		req.Header.Set("Content-Type", e.contentType)
+		req = withCaller(req, e.callerID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.importUsers)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+			continue
+		}
+		if rr.Code == http.StatusOK || rr.Code == http.StatusUnprocessableEntity {
+			var result userfile.ImportResult
+			_ = json.NewDecoder(rr.Body).Decode(&result)
+			if result.Imported != e.expectedImported {
+				t.Errorf("%s: expected %d imported, got %+v", e.name, e.expectedImported, result)
+			}
+		}
+	}
+}
+
+func Test_app_exportUsers(t *testing.T) {
+	var tests = []struct {
+		name                string
+		callerID            int
+		query               string
+		expectedStatusCode  int
+		expectedContentType string
+		expectedLines       int
+	}{
+		{"csv", 1, "", http.StatusOK, "text/csv; charset=utf-8", 3},
+		{"ndjson", 1, "?format=ndjson", http.StatusOK, "application/x-ndjson", 2},
+		{"unknown format", 1, "?format=xml", http.StatusBadRequest, "application/json", 0},
+		{"not an admin", 3, "", http.StatusForbidden, "application/json", 0},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest(http.MethodGet, "/v1/users/export"+e.query, nil)
+		req = withCaller(req, e.callerID)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.exportUsers)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != e.expectedContentType {
+			t.Errorf("%s: expected content type %q, got %q", e.name, e.expectedContentType, contentType)
+		}
+		if e.expectedLines == 0 {
+			continue
+		}
+		body := rr.Body.String()
+		if lines := strings.Count(body, "\n"); lines != e.expectedLines {
+			t.Errorf("%s: expected %d lines, got %d:\n%s", e.name, e.expectedLines, lines, body)
+		}
+		if strings.Contains(body, "$2a$") {
+			t.Errorf("%s: password hashes should never be exported:\n%s", e.name, body)
+		}
+	}
+}
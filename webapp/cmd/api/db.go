@@ -1,31 +1,11 @@
 package main
 
 import (
-	"database/sql"
-	_ "github.com/jackc/pgconn"
-	_ "github.com/jackc/pgx/v4"
-	_ "github.com/jackc/pgx/v4/stdlib"
-	"log"
+	"net/http"
+	"webapp/pkg/repository"
 )
 
-func openDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("pgx", dsn)
-	if err != nil {
-		return nil, err
-	}
-	err = db.Ping()
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
-}
-
-func (app *application) connectToDB() (*sql.DB, error) {
-	connection, err := openDB(app.DSN)
-	if err != nil {
-		return nil, err
-	}
-	log.Println("Connected to Postgres!")
-
-	return connection, nil
+// db returns the repo for r; see repository.ForRequest.
+func (app *application) db(r *http.Request) repository.DatabaseRepo {
+	return repository.ForRequest(app.DB, r)
 }
@@ -0,0 +1,63 @@
+package main
+
+import "webapp/pkg/data"
+
+// The API reads and writes users through the types below rather than
+// data.User, so that fields such as the password hash and version are never
+// written out, and can only be set by the handlers that mean to.
+
+// userResponse is a user as the API shows it.
+type userResponse struct {
+	ID            int            `json:"id"`
+	FirstName     string         `json:"first_name"`
+	LastName      string         `json:"last_name"`
+	Email         string         `json:"email"`
+	IsAdmin       data.AdminFlag `json:"is_admin"`
+	EmailVerified bool           `json:"email_verified"`
+}
+
+func newUserResponse(u *data.User) userResponse {
+	return userResponse{
+		ID:            u.ID,
+		FirstName:     u.FirstName,
+		LastName:      u.LastName,
+		Email:         u.Email,
+		IsAdmin:       data.AdminFlag(u.IsAdmin),
+		EmailVerified: u.EmailVerified,
+	}
+}
+
+// userRequest is the body of a request that creates or replaces a user.
+type userRequest struct {
+	FirstName string         `json:"first_name"`
+	LastName  string         `json:"last_name"`
+	Email     string         `json:"email"`
+	Password  string         `json:"password"`
+	IsAdmin   data.AdminFlag `json:"is_admin"`
+}
+
+// user returns the user the request describes, verified as it comes from an
+// admin.
+func (req *userRequest) user() data.User {
+	return data.User{
+		FirstName:     req.FirstName,
+		LastName:      req.LastName,
+		Email:         req.Email,
+		Password:      req.Password,
+		IsAdmin:       bool(req.IsAdmin),
+		EmailVerified: true,
+	}
+}
+
+// validate checks a user request. The password may be left out when
+// replacing a user, to keep their current one.
+func (req *userRequest) validate(passwordRequired bool) error {
+	err := data.ValidateUserDetails(&req.FirstName, &req.LastName, &req.Email)
+	if err != nil {
+		return err
+	}
+	if req.Password == "" && !passwordRequired {
+		return nil
+	}
+	return data.ValidatePassword(req.Password)
+}
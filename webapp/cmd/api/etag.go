@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// userETag returns the entity tag of a user at version. It changes whenever
+// the user is updated.
+func userETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// etagMatches reports whether an If-Match header value matches etag. The
+// header is either "*", which matches any current entity, or a comma
+// separated list of entity tags. If-Match uses strong comparison, so weak
+// tags never match.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func Test_etagMatches(t *testing.T) {
+	var tests = []struct {
+		name     string
+		header   string
+		expected bool
+	}{
+		{"same tag", `"3"`, true},
+		{"other tag", `"2"`, false},
+		{"in a list", `"1", "3"`, true},
+		{"not in a list", `"1", "2"`, false},
+		{"any", "*", true},
+		{"weak tag", `W/"3"`, false},
+		{"unquoted", "3", false},
+		{"empty", "", false},
+	}
+
+	for _, e := range tests {
+		if got := etagMatches(e.header, userETag(3)); got != e.expected {
+			t.Errorf("%s: expected %t but got %t", e.name, e.expected, got)
+		}
+	}
+}
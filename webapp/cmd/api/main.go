@@ -1,37 +1,95 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"webapp/pkg/dbconn"
+	"webapp/pkg/mail"
 	"webapp/pkg/repository"
 	"webapp/pkg/repository/dbrepo"
+	"webapp/pkg/urlsigner"
+	"webapp/templates"
 )
 
 const port = 8090
 
 type application struct {
-	DSN       string
+	DSN string
+	// DBOptions size the connection pools and say how long to wait for
+	// Postgres at startup.
+	DBOptions dbconn.Options
 	DB        repository.DatabaseRepo
 	Domain    string
 	JWTSecret string
+	// WebURL is the scheme and host of the web app, where emailed links point.
+	WebURL string
+	Mailer mail.Mailer
+	// MailTemplates renders the app's email.
+	MailTemplates *mail.Templates
+	MailFrom      string
+	// Signer signs the links in verification emails.
+	Signer urlsigner.Signer
 }
 
 func main() {
 	var app application
 	flag.StringVar(&app.Domain, "domain", "example.com", "Domain name for the application, e.g., company.com")
 	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "Postgres connection")
+	var replicaDSNs []string
+	flag.Func("replica-dsn", "Postgres connection to a read replica; repeat for each replica", func(dsn string) error {
+		replicaDSNs = append(replicaDSNs, dsn)
+		return nil
+	})
+	app.DBOptions = dbconn.DefaultOptions()
+	app.DBOptions.RegisterFlags(flag.CommandLine)
+	repoKind := flag.String("repo", "sql", "Database access for users: sql (database/sql) or pgx (a native pgx pool)")
 	flag.StringVar(&app.JWTSecret, "jwt-secret", "verysecret", "signing secret")
+	flag.StringVar(&app.WebURL, "web-url", "http://localhost:8080", "Scheme and host of the web app, used in links sent by email")
+	flag.StringVar(&app.MailFrom, "mail-from", "no-reply@example.com", "Sender address for email")
+	mailSender := flag.String("mail-sender", "file", "How email is sent: file|smtp")
+	mailDir := flag.String("mail-dir", "./tmp/mail", "Directory email is written to by the file sender")
+	var smtpServer mail.SMTPMailer
+	flag.StringVar(&smtpServer.Host, "smtp-host", "localhost", "SMTP server host")
+	flag.IntVar(&smtpServer.Port, "smtp-port", 587, "SMTP server port")
+	flag.StringVar(&smtpServer.Username, "smtp-user", "", "SMTP username, if the server requires authentication")
+	flag.StringVar(&smtpServer.Password, "smtp-password", "", "SMTP password")
+	linkSecret := flag.String("link-secret", "verysecret", "Secret for signing emailed links; must match the web app's")
 	flag.Parse()
 
-	conn, err := app.connectToDB()
+	app.Signer = urlsigner.Signer{Secret: []byte(*linkSecret)}
+
+	mailFS, err := fs.Sub(templates.FS, "mail")
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.MailTemplates, err = mail.NewTemplates(mailFS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the outbox stays on the primary whichever repo serves users
+	conns, err := dbrepo.Connect(dbrepo.Config{DSN: app.DSN, ReplicaDSNs: replicaDSNs, Repo: *repoKind, Options: app.DBOptions})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conns.Close()
+	app.DB = conns.Users
+
+	// email is queued in the database and sent in the background
+	sender, err := mail.NewSender(*mailSender, *mailDir, smtpServer)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
+	outbox := &mail.Outbox{Repo: conns.Postgres, Mailer: sender}
+	app.Mailer = outbox
 
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go outbox.Run(ctx)
 
 	log.Println("Starting API on port", port, "...")
 
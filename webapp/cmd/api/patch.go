@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	netmail "net/mail"
+	"sort"
+	"strings"
+	"unicode/utf8"
+	"webapp/pkg/data"
+)
+
+// The media types of the two patch formats updateUser accepts. Plain
+// application/json is read as a merge patch.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// errPatchTestFailed is returned when a JSON Patch test operation fails.
+var errPatchTestFailed = errors.New("patch test failed")
+
+// patchForbiddenError is returned when a patch changes a field the caller may
+// not change.
+type patchForbiddenError struct {
+	field string
+}
+
+func (e patchForbiddenError) Error() string {
+	return "you may not change " + e.field
+}
+
+// patchField is a user field that can be patched. set validates a JSON value
+// and stores it in the user; get returns the field's value, for comparing.
+type patchField struct {
+	set func(u *data.User, value json.RawMessage) error
+	get func(u *data.User) any
+}
+
+// patchFields are the user fields that can be patched by someone, keyed by
+// their JSON name.
+var patchFields = map[string]patchField{
+	"first_name": {
+		set: func(u *data.User, value json.RawMessage) error { return setName(&u.FirstName, value) },
+		get: func(u *data.User) any { return u.FirstName },
+	},
+	"last_name": {
+		set: func(u *data.User, value json.RawMessage) error { return setName(&u.LastName, value) },
+		get: func(u *data.User) any { return u.LastName },
+	},
+	"email": {
+		set: func(u *data.User, value json.RawMessage) error {
+			var email string
+			if err := json.Unmarshal(value, &email); err != nil {
+				return errors.New("must be a string")
+			}
+			email = strings.TrimSpace(email)
+			addr, err := netmail.ParseAddress(email)
+			if err != nil || addr.Address != email || utf8.RuneCountInString(email) > 255 {
+				return errors.New("must be a valid email address")
+			}
+			u.Email = email
+			return nil
+		},
+		get: func(u *data.User) any { return u.Email },
+	},
+	"is_admin": {
+		set: func(u *data.User, value json.RawMessage) error {
+			var f data.AdminFlag
+			if err := json.Unmarshal(value, &f); err != nil {
+				return errors.New("must be a boolean")
+			}
+			u.IsAdmin = bool(f)
+			return nil
+		},
+		get: func(u *data.User) any { return u.IsAdmin },
+	},
+}
+
+// Users may only change their own names; changing an email address takes the
+// account's password, so that is done on the web profile page. Admins can
+// change anyone's details.
+var (
+	selfPatchable  = []string{"first_name", "last_name"}
+	adminPatchable = []string{"first_name", "last_name", "email", "is_admin"}
+)
+
+// setName validates a first or last name and stores it in dst.
+func setName(dst *string, value json.RawMessage) error {
+	var name string
+	if err := json.Unmarshal(value, &name); err != nil {
+		return errors.New("must be a string")
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("cannot be blank")
+	}
+	if utf8.RuneCountInString(name) > 255 {
+		return errors.New("must be no more than 255 characters long")
+	}
+	*dst = name
+	return nil
+}
+
+// userPatcher applies patches to a user, allowing changes to the given fields
+// only.
+type userPatcher struct {
+	allowed []string
+}
+
+// field returns the named field, or an error if the caller may not change it.
+func (p userPatcher) field(name string) (patchField, error) {
+	f, ok := patchFields[name]
+	if !ok {
+		return patchField{}, fmt.Errorf("%s is not a field that can be changed", name)
+	}
+	for _, allowed := range p.allowed {
+		if name == allowed {
+			return f, nil
+		}
+	}
+	return patchField{}, patchForbiddenError{name}
+}
+
+// set validates value and stores it in the named field of u.
+func (p userPatcher) set(u *data.User, name string, value json.RawMessage) error {
+	f, err := p.field(name)
+	if err != nil {
+		return err
+	}
+	// null removes a member in a merge patch, and no user field is optional
+	if bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+		return fmt.Errorf("%s cannot be removed", name)
+	}
+	if err := f.set(u, value); err != nil {
+		return fmt.Errorf("%s %w", name, err)
+	}
+	return nil
+}
+
+// applyMergePatch applies an RFC 7396 merge patch to u. The patch must be an
+// object. So that clients can send back a user they fetched, members that
+// leave a field as it is are skipped, even ones the caller may not change; the
+// read-only email_verified is ignored, and id must be u's id.
+func (p userPatcher) applyMergePatch(u *data.User, body []byte) error {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		return errors.New("a merge patch must be a JSON object")
+	}
+
+	// apply in a fixed order, so the first error reported is predictable
+	names := make([]string, 0, len(patch))
+	for name := range patch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		switch {
+		case name == "id":
+			var id int
+			if err := json.Unmarshal(patch[name], &id); err != nil || id != u.ID {
+				return errors.New("id does not match the user being updated")
+			}
+			continue
+		case name == "email_verified":
+			// only the emailed link verifies an address
+			continue
+		case unchanged(u, name, patch[name]):
+			continue
+		}
+		if err := p.set(u, name, patch[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unchanged reports whether setting the named field of u to value would leave
+// it as it is.
+func unchanged(u *data.User, name string, value json.RawMessage) bool {
+	f, ok := patchFields[name]
+	if !ok || bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+		return false
+	}
+	patched := *u
+	return f.set(&patched, value) == nil && f.get(&patched) == f.get(u)
+}
+
+// jsonPatchOp is one operation of an RFC 6902 JSON Patch.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+	From  string          `json:"from"`
+}
+
+// applyJSONPatch applies an RFC 6902 JSON Patch to u. As users are flat
+// objects every path names a field, such as "/first_name". The add, replace
+// and test operations are supported, and a failed test returns
+// errPatchTestFailed; fields cannot be removed, moved or copied.
+func (p userPatcher) applyJSONPatch(u *data.User, body []byte) error {
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return errors.New("a JSON Patch must be an array of operations")
+	}
+
+	for i, op := range ops {
+		name, ok := strings.CutPrefix(op.Path, "/")
+		if !ok || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("operation %d: %q is not the path of a user field", i, op.Path)
+		}
+		if op.Value == nil && (op.Op == "add" || op.Op == "replace" || op.Op == "test") {
+			return fmt.Errorf("operation %d: %s needs a value", i, op.Op)
+		}
+
+		switch op.Op {
+		case "add", "replace":
+			if err := p.set(u, name, op.Value); err != nil {
+				return err
+			}
+		case "test":
+			f, ok := patchFields[name]
+			if !ok {
+				return fmt.Errorf("%s is not a field that can be tested", name)
+			}
+			expected := *u
+			if err := f.set(&expected, op.Value); err != nil || f.get(&expected) != f.get(u) {
+				return fmt.Errorf("%w: %s is not %s", errPatchTestFailed, name, op.Value)
+			}
+		case "remove", "move", "copy":
+			return fmt.Errorf("operation %d: %s is not supported for users", i, op.Op)
+		default:
+			return fmt.Errorf("operation %d: unknown op %q", i, op.Op)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+	"webapp/pkg/verifyemail"
+)
+
+type Registration struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+}
+
+// validate checks a registration the same way the web app's form does.
+func (reg *Registration) validate() error {
+	err := data.ValidateUserDetails(&reg.FirstName, &reg.LastName, &reg.Email)
+	if err != nil {
+		return err
+	}
+	return data.ValidatePassword(reg.Password)
+}
+
+// register creates an unverified user and emails them a link to verify their
+// address in the web app. Registering again with an address that is still
+// unverified replaces the name and password and sends a new link, voiding the
+// ones sent before; until the address is verified, nobody has shown that the
+// account is theirs.
+func (app *application) register(w http.ResponseWriter, r *http.Request) {
+	var reg Registration
+	err := app.readJSON(w, r, &reg)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	err = reg.validate()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.db(r).GetUserByEmail(reg.Email)
+	switch {
+	case err == nil && user.EmailVerified:
+		app.errorJSON(w, errors.New("email address already in use"), http.StatusConflict)
+		return
+	case err == nil:
+		user.FirstName = reg.FirstName
+		user.LastName = reg.LastName
+		err = app.db(r).WithTx(func(tx repository.DatabaseRepo) error {
+			if err := tx.UpdateUser(*user); err != nil {
+				return err
+			}
+			return tx.ResetPassword(user.ID, reg.Password)
+		})
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		// the update moved the version on, voiding the links sent before
+		user.Version++
+	default:
+		user = &data.User{
+			FirstName: reg.FirstName,
+			LastName:  reg.LastName,
+			Email:     reg.Email,
+			Password:  reg.Password,
+			// the version every new user starts at
+			Version: 1,
+		}
+		user.ID, err = app.db(r).InsertUser(*user)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = app.verifier().Send(r.Context(), user)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "check your email for a link to verify your address",
+	})
+}
+
+// verifier sends verification links to the web app, with the app's mail
+// settings.
+func (app *application) verifier() verifyemail.Sender {
+	return verifyemail.Sender{
+		Signer:    app.Signer,
+		Templates: app.MailTemplates,
+		Mailer:    app.Mailer,
+		From:      app.MailFrom,
+		WebURL:    app.WebURL,
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"webapp/pkg/mail"
+	"webapp/pkg/repository/dbrepo"
+)
+
+func Test_app_register(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestBody    string
+		expectedStatus int
+		expectMailTo   string
+	}{
+		{
+			name:           "new user",
+			requestBody:    `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}`,
+			expectedStatus: http.StatusAccepted,
+			expectMailTo:   "jack@example.com",
+		},
+		{
+			name:           "unverified user registering again",
+			requestBody:    `{"first_name":"New","last_name":"User","email":"unverified@example.com","password":"secret"}`,
+			expectedStatus: http.StatusAccepted,
+			expectMailTo:   "unverified@example.com",
+		},
+		{
+			name:           "email in use",
+			requestBody:    `{"first_name":"Admin","last_name":"User","email":"admin@example.com","password":"secret"}`,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "missing name",
+			requestBody:    `{"first_name":"","last_name":"Smith","email":"jack@example.com","password":"secret"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid email",
+			requestBody:    `{"first_name":"Jack","last_name":"Smith","email":"Jack <jack@example.com>","password":"secret"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "short password",
+			requestBody:    `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"abc"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "unknown field",
+			requestBody:    `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret","is_admin":1}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	dir := app.Mailer.(mail.FileMailer).Dir
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest(http.MethodPost, "/v1/register", strings.NewReader(e.requestBody))
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.register)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		files, _ := os.ReadDir(dir)
+		if e.expectMailTo == "" && len(files) != 0 {
+			t.Errorf("%s: expected no email but %d were sent", e.name, len(files))
+		}
+		if e.expectMailTo != "" {
+			if len(files) != 1 {
+				t.Errorf("%s: expected 1 email but %d were sent", e.name, len(files))
+			} else {
+				contents, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+				if !strings.Contains(string(contents), "To: "+e.expectMailTo) || !strings.Contains(string(contents), "http://localhost:8080/verify-email?") {
+					t.Errorf("%s: expected a verification link sent to %s, got:\n%s", e.name, e.expectMailTo, contents)
+				}
+			}
+		}
+		for _, f := range files {
+			_ = os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+func Test_app_registerTwice(t *testing.T) {
+	memApp := app
+	repo := dbrepo.NewMemoryDBRepo()
+	memApp.DB = repo
+	dir := app.Mailer.(mail.FileMailer).Dir
+	t.Cleanup(func() {
+		files, _ := os.ReadDir(dir)
+		for _, f := range files {
+			_ = os.Remove(filepath.Join(dir, f.Name()))
+		}
+	})
+
+	for _, body := range []string{
+		`{"first_name":"First","last_name":"Registrant","email":"jack@example.com","password":"first-secret"}`,
+		`{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"second-secret"}`,
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "/v1/register", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memApp.register).ServeHTTP(rr, req)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d registering, got %d: %s", http.StatusAccepted, rr.Code, rr.Body.String())
+		}
+	}
+
+	user, err := repo.GetUserByEmail("jack@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FirstName != "Jack" || user.LastName != "Smith" {
+		t.Errorf("expected the second registration's name, got %s %s", user.FirstName, user.LastName)
+	}
+	_ = repo.VerifyUserEmail(user.ID)
+
+	var tests = []struct {
+		name           string
+		password       string
+		expectedStatus int
+	}{
+		{"second password", "second-secret", http.StatusOK},
+		{"first password", "first-secret", http.StatusUnauthorized},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"email":"jack@example.com","password":"`+e.password+`"}`))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memApp.authenticate).ServeHTTP(rr, req)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d logging in, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"log"
 	"os"
 	"testing"
+	"webapp/pkg/mail"
 	"webapp/pkg/repository/dbrepo"
+	"webapp/pkg/urlsigner"
 )
 
 var app application
@@ -12,8 +15,31 @@ var expiredToken = "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJhZG1pbiI6dHJ1ZSwiYXV
 // This will be executed before all the tests
 // We can use it to run setup before the tests run
 func TestMain(m *testing.M) {
-	app.DB = &dbrepo.TestDBRepo{}
+	resetDB()
 
 	app.JWTSecret = "verysecret"
-	os.Exit(m.Run())
+
+	mailDir, err := os.MkdirTemp("", "api-mail")
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Mailer = mail.FileMailer{Dir: mailDir}
+	app.MailTemplates, err = mail.NewTemplates(os.DirFS("./../../templates/mail"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.MailFrom = "no-reply@example.com"
+	app.WebURL = "http://localhost:8080"
+	app.Signer = urlsigner.Signer{Secret: []byte("verysecret")}
+
+	code := m.Run()
+	_ = os.RemoveAll(mailDir)
+	os.Exit(code)
+}
+
+// resetDB gives app a fresh copy of the test users, so that what one test
+// writes is not seen by the next. Tests that write call it first, and table
+// tests call it for each case.
+func resetDB() {
+	app.DB = dbrepo.NewTestMemoryDBRepo()
 }
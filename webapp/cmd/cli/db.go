@@ -0,0 +1,4 @@
+package main
+
+// defaultDSN is the database the web app and API use by default.
+const defaultDSN = "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5"
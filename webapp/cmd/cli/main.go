@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
 	"log"
+	"os"
 	"time"
 )
 
@@ -17,8 +18,21 @@ type application struct {
 // the token that is printed out.
 // go run ./cmd/cli -action=valid     // will produce a valid token
 // go run ./cmd/cli -action=expired   // will produce an expired token
+//
+// It also imports and exports users in bulk, straight to and from the database:
+// go run ./cmd/cli import [-dry-run] [-best-effort] users.csv
+// go run ./cmd/cli export -format=ndjson -o users.ndjson
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		}
+	}
+
 	var app application
 	flag.StringVar(&app.JWTSecret, "jwt-secret", "verysecret", "secret")
 	flag.StringVar(&app.Action, "action", "valid", "action: valid|expired")
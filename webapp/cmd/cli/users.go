@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"webapp/pkg/dbconn"
+	"webapp/pkg/repository/dbrepo"
+	"webapp/pkg/userfile"
+)
+
+// runImport imports the users in a CSV or NDJSON file, and returns the exit
+// status: 1 if any row was not imported, 2 if the import failed.
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dsn := fs.String("dsn", defaultDSN, "Postgres connection")
+	dbOptions := dbconn.DefaultOptions()
+	dbOptions.RegisterFlags(fs)
+	formatName := fs.String("format", "", "File format: csv|ndjson; by default, from the file's extension")
+	var opts userfile.ImportOptions
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "Check the file and report what would be imported, without importing")
+	fs.BoolVar(&opts.BestEffort, "best-effort", false, "Import the valid rows and skip the rest, rather than all or nothing")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cli import [flags] file")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+
+	if *formatName == "" {
+		*formatName = filepath.Ext(path)
+	}
+	format, err := userfile.ParseFormat(*formatName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer f.Close()
+
+	records, err := userfile.Read(f, format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 2
+	}
+
+	conn, err := dbconn.Open(*dsn, dbOptions)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer conn.Close()
+
+	result, err := userfile.Import(&dbrepo.PostgresDBRepo{DB: conn}, records, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	for _, e := range result.Errors {
+		fmt.Printf("%s:%d: %s\n", path, e.Line, e.Message)
+	}
+	switch {
+	case opts.DryRun:
+		fmt.Printf("%d of %d users would be imported\n", result.Imported, result.Rows)
+	case len(result.Errors) > 0 && !opts.BestEffort:
+		fmt.Printf("nothing imported: %d of %d rows have errors\n", len(result.Errors), result.Rows)
+	default:
+		fmt.Printf("imported %d of %d users\n", result.Imported, result.Rows)
+	}
+	if len(result.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runExport writes every user to a CSV or NDJSON file, or to standard
+// output, and returns the exit status.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dsn := fs.String("dsn", defaultDSN, "Postgres connection")
+	dbOptions := dbconn.DefaultOptions()
+	dbOptions.RegisterFlags(fs)
+	formatName := fs.String("format", "csv", "File format: csv|ndjson")
+	path := fs.String("o", "", "File to write; by default, standard output")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	format, err := userfile.ParseFormat(*formatName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	conn, err := dbconn.Open(*dsn, dbOptions)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer conn.Close()
+
+	var w io.Writer = os.Stdout
+	if *path != "" {
+		f, err := os.Create(*path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer f.Close()
+		w = f
+	}
+
+	out := userfile.NewWriter(w, format)
+	db := &dbrepo.PostgresDBRepo{DB: conn}
+	err = db.EachUser(out.Write)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return 0
+}
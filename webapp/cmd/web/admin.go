@@ -0,0 +1,441 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// adminUsersPerPage is how many users the admin user list shows on a page.
+const adminUsersPerPage = 20
+
+// userForm is what the admin create and edit forms bind onto.
+type userForm struct {
+	FirstName string `form:"first_name"`
+	LastName  string `form:"last_name"`
+	Email     string `form:"email"`
+	IsAdmin   bool   `form:"is_admin"`
+	Password  string `form:"password,notrim"`
+	// Version is the version of the user the edit form was filled in from.
+	Version int `form:"version"`
+}
+
+func (app *application) AdminDashboard(w http.ResponseWriter, r *http.Request) {
+	_ = app.render(w, r, "admin.page.gohtml", &TemplateData{})
+}
+
+// AdminUsers lists users a page at a time, optionally filtered by the search
+// term q, which is matched against names and email addresses.
+func (app *application) AdminUsers(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	users, total, err := app.db(r).SearchUsers(q, adminUsersPerPage, (page-1)*adminUsersPerPage)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	pages := (total + adminUsersPerPage - 1) / adminUsersPerPage
+	if pages == 0 {
+		pages = 1
+	}
+
+	td := map[string]any{
+		"users": users,
+		"q":     q,
+		"total": total,
+		"page":  page,
+		"pages": pages,
+	}
+	if page > 1 {
+		td["prev"] = page - 1
+	}
+	if page < pages {
+		td["next"] = page + 1
+	}
+
+	_ = app.render(w, r, "admin-users.page.gohtml", &TemplateData{Data: td})
+}
+
+func (app *application) AdminNewUser(w http.ResponseWriter, r *http.Request) {
+	_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{Form: NewForm(nil)})
+}
+
+func (app *application) AdminCreateUser(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		app.clientError(w, r, http.StatusBadRequest, "The request could not be understood.")
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	app.validateUserForm(r, form, 0)
+	form.Required("password", "confirm_password")
+	form.MinLength("password", 6)
+	form.EqualTo("confirm_password", "password")
+
+	var input userForm
+	if err := form.Bind(&input); err != nil {
+		_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	id, err := app.db(r).InsertUser(data.User{
+		FirstName: input.FirstName,
+		LastName:  input.LastName,
+		Email:     input.Email,
+		Password:  input.Password,
+		IsAdmin:   input.IsAdmin,
+		// an admin vouches for the address of a user they create
+		EmailVerified: true,
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "User created")
+	http.Redirect(w, r, "/admin/users/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// AdminEditUser shows the edit form for the user named in the URL, along with
+// their profile picture and the password reset and delete forms.
+func (app *application) AdminEditUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{
+		Form: NewForm(userValues(user)),
+		Data: map[string]any{"user": user},
+	})
+}
+
+func (app *application) AdminUpdateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		app.clientError(w, r, http.StatusBadRequest, "The request could not be understood.")
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	app.validateUserForm(r, form, user.ID)
+	if user.ID == app.sessionUserID(r) {
+		form.Check(form.Has("is_admin"), "is_admin", "You cannot remove your own admin rights")
+	}
+
+	var input userForm
+	if err := form.Bind(&input); err != nil {
+		_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{
+			Form: form,
+			Data: map[string]any{"user": user},
+		})
+		return
+	}
+
+	demoted := user.IsAdmin && !input.IsAdmin
+	user.FirstName = input.FirstName
+	user.LastName = input.LastName
+	user.Email = input.Email
+	user.IsAdmin = input.IsAdmin
+	// forms without a version overwrite whatever is there
+	if input.Version != 0 {
+		user.Version = input.Version
+	}
+
+	err = app.db(r).UpdateUser(*user)
+	if err == repository.ErrConflict {
+		// show what changed, and let the admin save again over it
+		current, ok := app.adminTargetUser(w, r)
+		if !ok {
+			return
+		}
+		form.Data.Set("version", strconv.Itoa(current.Version))
+		form.Errors.Add("version", "This user was changed by someone else while you were editing. Check their details above, then save again to overwrite them.")
+		_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{
+			Form: form,
+			Data: map[string]any{"user": current},
+		})
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if demoted {
+		if err := app.logoutDemotedAdmin(r, user.ID); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+	if user.ID == app.sessionUserID(r) {
+		if err := app.refreshSessionUser(r, user.ID); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", "User updated")
+	http.Redirect(w, r, "/admin/users/"+strconv.Itoa(user.ID), http.StatusSeeOther)
+}
+
+// AdminToggleAdmin grants or revokes the admin rights of the user named in the
+// URL, logging them out everywhere when they lose them. Admins cannot revoke
+// their own rights, so there is always one left.
+func (app *application) AdminToggleAdmin(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == app.sessionUserID(r) {
+		app.Session.Put(r.Context(), "error", "You cannot remove your own admin rights")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	user.IsAdmin = !user.IsAdmin
+	err := app.db(r).UpdateUser(*user)
+	if err == repository.ErrConflict {
+		app.Session.Put(r.Context(), "error", user.Email+" was changed by someone else at the same time; try again")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if user.IsAdmin {
+		app.Session.Put(r.Context(), "flash", "Admin rights granted to "+user.Email)
+	} else {
+		if err := app.logoutDemotedAdmin(r, user.ID); err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		app.Session.Put(r.Context(), "flash", "Admin rights revoked from "+user.Email)
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// logoutDemotedAdmin logs a user who just lost their admin rights out of every
+// session, as requireAdmin trusts the user their sessions hold and would let
+// them keep using the admin pages until they logged out. Admins can't demote
+// themselves, so the session in r is never theirs.
+func (app *application) logoutDemotedAdmin(r *http.Request, userID int) error {
+	_, err := app.destroyUserSessions(r.Context(), userID, func(string) bool { return true })
+	return err
+}
+
+// AdminResetPassword sets a new password for the user named in the URL, and
+// logs them out of every session.
+func (app *application) AdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		app.clientError(w, r, http.StatusBadRequest, "The request could not be understood.")
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("new_password", "confirm_password")
+	form.MinLength("new_password", 6)
+	form.EqualTo("confirm_password", "new_password")
+
+	if !form.Valid() {
+		// keep the edit form on the same page filled in
+		for field, value := range userValues(user) {
+			form.Data[field] = value
+		}
+		_ = app.render(w, r, "admin-user.page.gohtml", &TemplateData{
+			Form: form,
+			Data: map[string]any{"user": user},
+		})
+		return
+	}
+
+	err = app.db(r).ResetPassword(user.ID, form.Data.Get("new_password"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// resetting your own password through here keeps you logged in
+	_, err = app.destroyUserSessions(r.Context(), user.ID, func(string) bool { return true })
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Password reset for "+user.Email)
+	http.Redirect(w, r, "/admin/users/"+strconv.Itoa(user.ID), http.StatusSeeOther)
+}
+
+// AdminDeleteUser deletes the user named in the URL and logs them out of every
+// session. Admins cannot delete themselves here; see DeleteAccount.
+func (app *application) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == app.sessionUserID(r) {
+		app.Session.Put(r.Context(), "error", "You cannot delete your own account from the admin pages")
+		http.Redirect(w, r, "/admin/users/"+strconv.Itoa(user.ID), http.StatusSeeOther)
+		return
+	}
+
+	err := app.db(r).DeleteUser(user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	_, err = app.destroyUserSessions(r.Context(), user.ID, func(string) bool { return true })
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Deleted "+user.Email+". The account can be restored from the deleted users page until it is purged.")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// AdminDeletedUsers lists the users that have been deleted but not yet
+// purged, with the date each will be purged.
+func (app *application) AdminDeletedUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := app.db(r).DeletedUsers()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	rows := make([]deletedUserRow, 0, len(users))
+	for _, user := range users {
+		row := deletedUserRow{User: user}
+		if user.DeletedAt != nil {
+			row.DeletedAt = *user.DeletedAt
+			row.PurgeAt = user.DeletedAt.Add(app.DeletedUserRetention)
+		}
+		rows = append(rows, row)
+	}
+
+	_ = app.render(w, r, "admin-deleted-users.page.gohtml", &TemplateData{Data: map[string]any{"users": rows}})
+}
+
+// deletedUserRow is one row of the deleted users page.
+type deletedUserRow struct {
+	User      *data.User
+	DeletedAt time.Time
+	PurgeAt   time.Time
+}
+
+// AdminRestoreUser undoes the deletion of the user named in the URL. They
+// come back as they were, but have to log in again. A user whose email
+// address someone else has taken since stays deleted.
+func (app *application) AdminRestoreUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.NotFound(w, r)
+		return
+	}
+
+	err = app.db(r).RestoreUser(id)
+	switch {
+	case err == sql.ErrNoRows:
+		app.NotFound(w, r)
+		return
+	case err == repository.ErrConflict:
+		app.Session.Put(r.Context(), "error", "Another user has this user's email address now, so they can't be restored")
+		http.Redirect(w, r, "/admin/users/deleted", http.StatusSeeOther)
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "User restored")
+	http.Redirect(w, r, "/admin/users/"+strconv.Itoa(id), http.StatusSeeOther)
+}
+
+// adminTargetUser loads the user whose id is in the URL. If there is no such
+// user it writes a 404 and returns false.
+func (app *application) adminTargetUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.NotFound(w, r)
+		return nil, false
+	}
+
+	user, err := app.db(r).GetUser(id)
+	if err != nil {
+		app.NotFound(w, r)
+		return nil, false
+	}
+	return user, true
+}
+
+// userValues returns the edit form's values for user.
+func userValues(user *data.User) url.Values {
+	values := url.Values{
+		"first_name": {user.FirstName},
+		"last_name":  {user.LastName},
+		"email":      {user.Email},
+		"version":    {strconv.Itoa(user.Version)},
+	}
+	if user.IsAdmin {
+		values.Set("is_admin", "on")
+	}
+	return values
+}
+
+// validateUserForm checks the fields shared by the create and edit forms. id
+// is the user being edited, or 0 for a new user, and is allowed to keep its
+// own email address.
+func (app *application) validateUserForm(r *http.Request, form *Form, id int) {
+	form.Required("first_name", "last_name", "email")
+	form.MaxLength("first_name", 255)
+	form.MaxLength("last_name", 255)
+	form.MaxLength("email", 255)
+	form.Email("email")
+
+	email := strings.TrimSpace(form.Data.Get("email"))
+	if email == "" {
+		return
+	}
+	if existing, err := app.db(r).GetUserByEmail(email); err == nil && existing.ID != id {
+		form.Errors.Add("email", "This email address is already in use")
+	}
+}
+
+// sessionUserID returns the id of the logged in user.
+func (app *application) sessionUserID(r *http.Request) int {
+	user, _ := app.Session.Get(r.Context(), "user").(data.User)
+	return user.ID
+}
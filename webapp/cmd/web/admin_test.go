@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository/dbrepo"
+)
+
+// newAdminRequest returns a request to an admin handler made by the admin
+// with id actingID, with the {id} URL parameter set to paramID.
+func newAdminRequest(method, target, paramID string, actingID int, postedData url.Values) *http.Request {
+	var req *http.Request
+	if postedData == nil {
+		req, _ = http.NewRequest(method, target, nil)
+	} else {
+		req, _ = http.NewRequest(method, target, strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req = addContextAndSessionToRequest(req, app)
+
+	if paramID != "" {
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("id", paramID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	}
+
+	app.Session.Put(req.Context(), "user", data.User{ID: actingID, IsAdmin: true})
+	return req
+}
+
+func Test_app_AdminUsers(t *testing.T) {
+	var tests = []struct {
+		name         string
+		query        string
+		expectedHTML string
+		unexpected   string
+	}{
+		{"all users", "", "admin@example.com", ""},
+		{"matching search", "?q=ADMIN", "admin@example.com", ""},
+		{"search by full name", "?q=admin+user", "admin@example.com", ""},
+		{"no matches", "?q=nobody", "0 users found", "admin@example.com"},
+		{"page past the end", "?page=3", "Page 3 of 1", "admin@example.com"},
+		{"bad page", "?page=abc", "Page 1 of 1", ""},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req := newAdminRequest("GET", "/admin/users"+e.query, "", 1, nil)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminUsers)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, http.StatusOK, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %s in response body", e.name, e.expectedHTML)
+		}
+		if e.unexpected != "" && strings.Contains(rr.Body.String(), e.unexpected) {
+			t.Errorf("%s: unexpectedly found %s in response body", e.name, e.unexpected)
+		}
+	}
+}
+
+func Test_app_AdminCreateUser(t *testing.T) {
+	var tests = []struct {
+		name               string
+		postedData         url.Values
+		expectedStatusCode int
+		expectedLoc        string
+		expectedHTML       string
+	}{
+		{
+			name: "valid",
+			postedData: url.Values{
+				"first_name":       {"Jack"},
+				"last_name":        {"Smith"},
+				"email":            {"jack@example.com"},
+				"password":         {"secret"},
+				"confirm_password": {"secret"},
+				"is_admin":         {"on"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectedLoc:        "/admin/users/6",
+		},
+		{
+			name: "email in use",
+			postedData: url.Values{
+				"first_name":       {"Jack"},
+				"last_name":        {"Smith"},
+				"email":            {"admin@example.com"},
+				"password":         {"secret"},
+				"confirm_password": {"secret"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "This email address is already in use",
+		},
+		{
+			name: "passwords differ",
+			postedData: url.Values{
+				"first_name":       {"Jack"},
+				"last_name":        {"Smith"},
+				"email":            {"jack@example.com"},
+				"password":         {"secret"},
+				"confirm_password": {"secret2"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "is-invalid",
+		},
+		{
+			name:               "missing fields",
+			postedData:         url.Values{},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "This field cannot be blank",
+		},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req := newAdminRequest("POST", "/admin/users/new", "", 1, e.postedData)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminCreateUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectedLoc != "" {
+			if loc, _ := rr.Result().Location(); loc == nil || loc.String() != e.expectedLoc {
+				t.Errorf("%s: expected location %s but got %v", e.name, e.expectedLoc, loc)
+			}
+		}
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %s in response body", e.name, e.expectedHTML)
+		}
+	}
+}
+
+func Test_app_AdminEditUser(t *testing.T) {
+	var tests = []struct {
+		name               string
+		paramID            string
+		expectedStatusCode int
+	}{
+		{"existing user", "1", http.StatusOK},
+		{"unknown user", "2", http.StatusNotFound},
+		{"bad id", "abc", http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req := newAdminRequest("GET", "/admin/users/"+e.paramID, e.paramID, 1, nil)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminEditUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectedStatusCode == http.StatusOK {
+			body := rr.Body.String()
+			if !strings.Contains(body, `value="admin@example.com"`) || !strings.Contains(body, "checked") || !strings.Contains(body, `name="version" value="1"`) {
+				t.Errorf("%s: expected the form to be filled in from the user", e.name)
+			}
+			if strings.Contains(body, "/admin/users/1/delete") {
+				t.Errorf("%s: admins should not be offered deleting themselves", e.name)
+			}
+		}
+	}
+}
+
+func Test_app_AdminUpdateUser(t *testing.T) {
+	var tests = []struct {
+		name               string
+		actingID           int
+		postedData         url.Values
+		expectedStatusCode int
+		expectedHTML       string
+		expectLoggedOut    bool
+	}{
+		{
+			name:     "valid",
+			actingID: 99,
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"admin@example.com"},
+				"is_admin":   {"on"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+		},
+		{
+			name:     "dropping admin",
+			actingID: 99,
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"admin@example.com"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectLoggedOut:    true,
+		},
+		{
+			name:     "own account keeping admin",
+			actingID: 1,
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"admin@example.com"},
+				"is_admin":   {"on"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+		},
+		{
+			name:     "own account dropping admin",
+			actingID: 1,
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"admin@example.com"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "You cannot remove your own admin rights",
+		},
+		{
+			name:     "current version",
+			actingID: 99,
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"admin@example.com"},
+				"is_admin":   {"on"},
+				"version":    {"1"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+		},
+		{
+			name:     "changed by someone else",
+			actingID: 99,
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"admin@example.com"},
+				"version":    {"2"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "changed by someone else while you were editing",
+		},
+		{
+			name:     "invalid email",
+			actingID: 99,
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"admin.example.com"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "Invalid email address",
+		},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		target := addStoredSession(t, 1, "target")
+
+		req := newAdminRequest("POST", "/admin/users/1", "1", e.actingID, e.postedData)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminUpdateUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %s in response body", e.name, e.expectedHTML)
+		}
+		if e.expectLoggedOut == sessionIsStored(target) {
+			t.Errorf("%s: expected the user's sessions logged out to be %t", e.name, e.expectLoggedOut)
+		}
+		_ = app.Session.Store.Delete(target)
+	}
+}
+
+func Test_app_AdminToggleAdmin(t *testing.T) {
+	var tests = []struct {
+		name            string
+		actingID        int
+		expectFlash     string
+		expectError     string
+		expectLoggedOut bool
+	}{
+		{"another user", 99, "Admin rights revoked from admin@example.com", "", true},
+		{"own account", 1, "", "You cannot remove your own admin rights", false},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		target := addStoredSession(t, 1, "target")
+
+		req := newAdminRequest("POST", "/admin/users/1/toggle-admin", "1", e.actingID, url.Values{})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminToggleAdmin)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != e.expectFlash {
+			t.Errorf("%s: expected flash %q but got %q", e.name, e.expectFlash, flash)
+		}
+		if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectError {
+			t.Errorf("%s: expected error %q but got %q", e.name, e.expectError, msg)
+		}
+		if e.expectLoggedOut == sessionIsStored(target) {
+			t.Errorf("%s: expected the user's sessions logged out to be %t", e.name, e.expectLoggedOut)
+		}
+		_ = app.Session.Store.Delete(target)
+	}
+}
+
+func Test_app_AdminResetPassword(t *testing.T) {
+	var tests = []struct {
+		name               string
+		postedData         url.Values
+		expectedStatusCode int
+		expectLoggedOut    bool
+	}{
+		{
+			name:               "valid",
+			postedData:         url.Values{"new_password": {"newsecret"}, "confirm_password": {"newsecret"}},
+			expectedStatusCode: http.StatusSeeOther,
+			expectLoggedOut:    true,
+		},
+		{
+			name:               "too short",
+			postedData:         url.Values{"new_password": {"abc"}, "confirm_password": {"abc"}},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "confirmation does not match",
+			postedData:         url.Values{"new_password": {"newsecret"}, "confirm_password": {"oldsecret"}},
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		target := addStoredSession(t, 1, "target")
+
+		req := newAdminRequest("POST", "/admin/users/1/password", "1", 99, e.postedData)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminResetPassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectLoggedOut == sessionIsStored(target) {
+			t.Errorf("%s: expected the user's sessions logged out to be %t", e.name, e.expectLoggedOut)
+		}
+		if !app.Session.Exists(req.Context(), "user") {
+			t.Errorf("%s: the admin should stay logged in", e.name)
+		}
+		_ = app.Session.Store.Delete(target)
+	}
+}
+
+func Test_app_AdminDeleteUser(t *testing.T) {
+	var tests = []struct {
+		name            string
+		actingID        int
+		expectedLoc     string
+		expectLoggedOut bool
+	}{
+		{"another user", 99, "/admin/users", true},
+		{"own account", 1, "/admin/users/1", false},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		target := addStoredSession(t, 1, "target")
+
+		req := newAdminRequest("POST", "/admin/users/1/delete", "1", e.actingID, url.Values{})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminDeleteUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if loc, _ := rr.Result().Location(); loc == nil || loc.String() != e.expectedLoc {
+			t.Errorf("%s: expected location %s but got %v", e.name, e.expectedLoc, loc)
+		}
+		if e.expectLoggedOut == sessionIsStored(target) {
+			t.Errorf("%s: expected the user's sessions logged out to be %t", e.name, e.expectLoggedOut)
+		}
+		_ = app.Session.Store.Delete(target)
+	}
+}
+
+func Test_app_AdminDeletedUsers(t *testing.T) {
+	req := newAdminRequest("GET", "/admin/users/deleted", "", 1, nil)
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.AdminDeletedUsers)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("wrong status code; expected %d but got %d", http.StatusOK, rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "deleted@example.com") || !strings.Contains(body, "/admin/users/5/restore") {
+		t.Error("expected the deleted user to be listed with a restore button")
+	}
+	if purgeAt := humanDate(time.Now().Add(-time.Hour).Add(app.DeletedUserRetention)); !strings.Contains(body, purgeAt[:11]) {
+		t.Errorf("expected the purge date %s to be shown", purgeAt[:11])
+	}
+}
+
+func Test_app_AdminRestoreUser(t *testing.T) {
+	var tests = []struct {
+		name               string
+		paramID            string
+		expectedStatusCode int
+		expectedLoc        string
+	}{
+		{"deleted user", "5", http.StatusSeeOther, "/admin/users/5"},
+		{"user not deleted", "1", http.StatusNotFound, ""},
+		{"bad id", "abc", http.StatusNotFound, ""},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req := newAdminRequest("POST", "/admin/users/"+e.paramID+"/restore", e.paramID, 1, url.Values{})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.AdminRestoreUser)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectedLoc != "" {
+			if loc, _ := rr.Result().Location(); loc == nil || loc.String() != e.expectedLoc {
+				t.Errorf("%s: expected location %s but got %v", e.name, e.expectedLoc, loc)
+			}
+		}
+	}
+}
+
+func Test_app_AdminRestoreUserEmailTaken(t *testing.T) {
+	memApp := app
+	repo := dbrepo.NewMemoryDBRepo()
+	memApp.DB = repo
+	deleted, _ := repo.InsertUser(data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Password: "secret"})
+	_ = repo.DeleteUser(deleted)
+	_, _ = repo.InsertUser(data.User{FirstName: "Jack", LastName: "Jones", Email: "jack@example.com", Password: "secret"})
+
+	id := strconv.Itoa(deleted)
+	req := newAdminRequest("POST", "/admin/users/"+id+"/restore", id, 1, url.Values{})
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(memApp.AdminRestoreUser)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("wrong status code; expected %d but got %d", http.StatusSeeOther, rr.Code)
+	}
+	if loc, _ := rr.Result().Location(); loc == nil || loc.String() != "/admin/users/deleted" {
+		t.Errorf("expected to be sent back to the deleted users, got %v", loc)
+	}
+	if msg := app.Session.GetString(req.Context(), "error"); msg == "" {
+		t.Error("expected an error to be flashed")
+	}
+	if _, err := repo.GetUser(deleted); err == nil {
+		t.Error("expected the user to stay deleted")
+	}
+}
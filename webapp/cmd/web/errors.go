@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// clientError shows the error page for status, which should be a 4xx code,
+// explaining the problem with message. Statuses without a page of their own,
+// such as 404.page.gohtml, use the generic error.page.gohtml.
+func (app *application) clientError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	page := fmt.Sprintf("%d.page.gohtml", status)
+	if _, err := app.Templates.Lookup(page); err != nil {
+		page = "error.page.gohtml"
+	}
+
+	_ = app.renderStatus(w, r, status, page, &TemplateData{
+		Data: map[string]any{
+			"status":  status,
+			"title":   http.StatusText(status),
+			"message": message,
+		},
+	})
+}
+
+// serverError logs err and shows the server error page. The details of err
+// are only shown in dev mode. If the error page itself can't be rendered, a
+// plain text response is sent instead.
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("Error: %s\n%s", err, debug.Stack())
+
+	detail := ""
+	if app.DevMode {
+		detail = err.Error()
+	}
+
+	buf, renderErr := app.executeTemplate(r, "500.page.gohtml", &TemplateData{
+		Data: map[string]any{"detail": detail},
+	})
+	if renderErr != nil {
+		log.Println("Error rendering the server error page:", renderErr)
+		message := http.StatusText(http.StatusInternalServerError)
+		if detail != "" {
+			message += ": " + detail
+		}
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	_, _ = buf.WriteTo(w)
+}
+
+// NotFound is used by the router for requests that match no route.
+func (app *application) NotFound(w http.ResponseWriter, r *http.Request) {
+	app.clientError(w, r, http.StatusNotFound, "The page you were looking for doesn't exist.")
+}
+
+// MethodNotAllowed is used by the router for requests to a route that does not
+// accept the request's method.
+func (app *application) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	app.clientError(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("%s requests are not allowed here.", r.Method))
+}
+
+// recoverPanic shows the server error page for a panic in any later handler.
+// It needs the session, so it is registered after LoadAndSave; chi's
+// Recoverer remains in front of everything as a plain text last resort.
+func (app *application) recoverPanic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rvr := recover(); rvr != nil {
+				if rvr == http.ErrAbortHandler {
+					// let the server abort the response, as it intends to
+					panic(rvr)
+				}
+				w.Header().Set("Connection", "close")
+				app.serverError(w, r, fmt.Errorf("panic: %v", rvr))
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
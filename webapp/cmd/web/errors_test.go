@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_app_errorPages(t *testing.T) {
+	var tests = []struct {
+		name               string
+		method             string
+		url                string
+		expectedStatusCode int
+		expectedHTML       string
+	}{
+		{"not found", http.MethodGet, "/fern", http.StatusNotFound, "Page Not Found"},
+		{"method not allowed", http.MethodGet, "/login", http.StatusMethodNotAllowed, "405 Method Not Allowed"},
+	}
+
+	routes := app.routes()
+
+	for _, e := range tests {
+		req := httptest.NewRequest(e.method, e.url, nil)
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %s in response body", e.name, e.expectedHTML)
+		}
+	}
+}
+
+func Test_app_clientError(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req = addContextAndSessionToRequest(req, app)
+	rr := httptest.NewRecorder()
+
+	app.clientError(rr, req, http.StatusForbidden, "go away")
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected status %d but got %d", http.StatusForbidden, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "Forbidden") || !strings.Contains(rr.Body.String(), "go away") {
+		t.Error("expected the forbidden page with the message to be rendered")
+	}
+}
+
+func Test_app_serverError(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req = addContextAndSessionToRequest(req, app)
+
+	for _, devMode := range []bool{false, true} {
+		app.DevMode = devMode
+		rr := httptest.NewRecorder()
+
+		app.serverError(rr, req, fmt.Errorf("secret details"))
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("dev mode %t: expected status %d but got %d", devMode, http.StatusInternalServerError, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), "Something Went Wrong") {
+			t.Errorf("dev mode %t: expected the server error page to be rendered", devMode)
+		}
+		if strings.Contains(rr.Body.String(), "secret details") != devMode {
+			t.Errorf("dev mode %t: error details shown when they should not be, or vice versa", devMode)
+		}
+	}
+	app.DevMode = false
+}
+
+func Test_app_renderFailsMidway(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/user/sessions", nil)
+	req = addContextAndSessionToRequest(req, app)
+	rr := httptest.NewRecorder()
+
+	// the sessions page can't range over a struct, so fails part way through
+	err := app.render(rr, req, "sessions.page.gohtml", &TemplateData{Data: map[string]any{"sessions": struct{}{}}})
+	if err == nil {
+		t.Error("expected error executing template but did not get one")
+	}
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d but got %d", http.StatusInternalServerError, rr.Code)
+	}
+	if strings.Contains(rr.Body.String(), "Your Active Sessions") {
+		t.Error("a partially rendered page was sent")
+	}
+}
+
+func Test_app_recoverPanic(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req = addContextAndSessionToRequest(req, app)
+	rr := httptest.NewRecorder()
+
+	app.recoverPanic(nextHandler).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d but got %d", http.StatusInternalServerError, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "Something Went Wrong") {
+		t.Error("expected the server error page to be rendered")
+	}
+}
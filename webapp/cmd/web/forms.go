@@ -1,8 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"html/template"
+	"net/mail"
 	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type errors map[string][]string
@@ -22,12 +30,18 @@ func (e errors) Add(field, message string) {
 type Form struct {
 	Data   url.Values
 	Errors errors
+	// Locale selects the set of built-in validation messages; see messages.
+	Locale string
+	// Messages overrides built-in validation messages, keyed by validator.
+	Messages map[string]string
 }
 
 func NewForm(data url.Values) *Form {
 	return &Form{
-		Data:   data,
-		Errors: map[string][]string{},
+		Data:     data,
+		Errors:   map[string][]string{},
+		Locale:   defaultLocale,
+		Messages: map[string]string{},
 	}
 }
 
@@ -43,7 +57,7 @@ func (f *Form) Required(fields ...string) {
 	for _, field := range fields {
 		value := f.Data.Get(field)
 		if strings.TrimSpace(value) == "" {
-			f.Errors.Add(field, "This field cannot be blank")
+			f.Errors.Add(field, f.message("required"))
 		}
 	}
 }
@@ -54,6 +68,226 @@ func (f *Form) Check(ok bool, key, message string) {
 	}
 }
 
+// value returns the trimmed value of field.
+func (f *Form) value(field string) string {
+	return strings.TrimSpace(f.Data.Get(field))
+}
+
+// Email checks that field holds a single, bare email address such as
+// "me@example.com". Empty values are left to Required.
+func (f *Form) Email(field string) {
+	value := f.value(field)
+	if value == "" {
+		return
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value {
+		f.Errors.Add(field, f.message("email"))
+	}
+}
+
+// MinLength checks that field is at least length characters long.
+func (f *Form) MinLength(field string, length int) {
+	if utf8.RuneCountInString(f.value(field)) < length {
+		f.Errors.Add(field, f.message("min_length", length))
+	}
+}
+
+// MaxLength checks that field is no more than length characters long.
+func (f *Form) MaxLength(field string, length int) {
+	if utf8.RuneCountInString(f.value(field)) > length {
+		f.Errors.Add(field, f.message("max_length", length))
+	}
+}
+
+// IntRange checks that field is a whole number between min and max,
+// inclusive. Empty values are left to Required.
+func (f *Form) IntRange(field string, min, max int) {
+	value := f.value(field)
+	if value == "" {
+		return
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		f.Errors.Add(field, f.message("integer"))
+		return
+	}
+	if n < min || n > max {
+		f.Errors.Add(field, f.message("int_range", min, max))
+	}
+}
+
+// Matches checks that field matches pattern. Empty values are left to
+// Required.
+func (f *Form) Matches(field string, pattern *regexp.Regexp) {
+	value := f.value(field)
+	if value == "" {
+		return
+	}
+	if !pattern.MatchString(value) {
+		f.Errors.Add(field, f.message("matches"))
+	}
+}
+
+// OneOf checks that field is one of the permitted values. Empty values are
+// left to Required.
+func (f *Form) OneOf(field string, permitted ...string) {
+	value := f.value(field)
+	if value == "" {
+		return
+	}
+	for _, p := range permitted {
+		if value == p {
+			return
+		}
+	}
+	f.Errors.Add(field, f.message("one_of", strings.Join(permitted, ", ")))
+}
+
+// EqualTo checks that field holds exactly the same value as other, such as
+// a password and its confirmation.
+func (f *Form) EqualTo(field, other string) {
+	if f.Data.Get(field) != f.Data.Get(other) {
+		f.Errors.Add(field, f.message("equal_to", other))
+	}
+}
+
+// Date checks that field can be parsed as a time using layout. Empty values
+// are left to Required.
+func (f *Form) Date(field, layout string) {
+	value := f.value(field)
+	if value == "" {
+		return
+	}
+	if _, err := time.Parse(layout, value); err != nil {
+		f.Errors.Add(field, f.message("date", layout))
+	}
+}
+
 func (f *Form) Valid() bool {
 	return len(f.Errors) == 0
 }
+
+// dateLayout is the layout Bind uses for time.Time fields without a layout tag.
+const dateLayout = "2006-01-02"
+
+// Bind copies the form's values onto dst, which must be a pointer to a struct.
+// Each exported field tagged `form:"name"` is set from the named form value;
+// string, bool, integer, float and time.Time fields are supported, and time.Time
+// fields are parsed using the `layout:"..."` tag, or dateLayout if there is
+// none. Values are trimmed unless the tag says `form:"name,notrim"`, as
+// passwords should be. Bind refuses to copy a form that has validation errors.
+func (f *Form) Bind(dst any) error {
+	if !f.Valid() {
+		return fmt.Errorf("form has %d invalid fields", len(f.Errors))
+	}
+
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("bind: expected a pointer to a struct but got %T", dst)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		name, opts, _ := strings.Cut(sf.Tag.Get("form"), ",")
+		if name == "" || name == "-" || !sf.IsExported() || !f.Data.Has(name) {
+			continue
+		}
+
+		value := f.value(name)
+		if opts == "notrim" {
+			value = f.Data.Get(name)
+		}
+		field := rv.Field(i)
+
+		if field.Type() == reflect.TypeOf(time.Time{}) {
+			layout := sf.Tag.Get("layout")
+			if layout == "" {
+				layout = dateLayout
+			}
+			if value == "" {
+				field.Set(reflect.ValueOf(time.Time{}))
+				continue
+			}
+			t, err := time.Parse(layout, value)
+			if err != nil {
+				return fmt.Errorf("bind %s: %w", name, err)
+			}
+			field.Set(reflect.ValueOf(t))
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			// checkboxes are only posted when ticked, typically as "on"
+			b := value == "on"
+			if !b && value != "" && value != "off" {
+				var err error
+				if b, err = strconv.ParseBool(value); err != nil {
+					return fmt.Errorf("bind %s: %w", name, err)
+				}
+			}
+			field.SetBool(b)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(zeroIfEmpty(value), 10, field.Type().Bits())
+			if err != nil {
+				return fmt.Errorf("bind %s: %w", name, err)
+			}
+			field.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(zeroIfEmpty(value), 10, field.Type().Bits())
+			if err != nil {
+				return fmt.Errorf("bind %s: %w", name, err)
+			}
+			field.SetUint(n)
+		case reflect.Float32, reflect.Float64:
+			n, err := strconv.ParseFloat(zeroIfEmpty(value), field.Type().Bits())
+			if err != nil {
+				return fmt.Errorf("bind %s: %w", name, err)
+			}
+			field.SetFloat(n)
+		default:
+			return fmt.Errorf("bind %s: unsupported field type %s", name, field.Type())
+		}
+	}
+
+	return nil
+}
+
+func zeroIfEmpty(s string) string {
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+// The template helpers below display a form's values and errors next to its
+// inputs. Each is safe to call with a nil form.
+
+// formValue returns the submitted value of field, for repopulating an input.
+func formValue(f *Form, field string) string {
+	if f == nil {
+		return ""
+	}
+	return f.Data.Get(field)
+}
+
+// fieldError renders the first error for field as bootstrap invalid feedback.
+func fieldError(f *Form, field string) template.HTML {
+	if f == nil || f.Errors.Get(field) == "" {
+		return ""
+	}
+	return template.HTML(`<div class="invalid-feedback">` + template.HTMLEscapeString(f.Errors.Get(field)) + `</div>`)
+}
+
+// invalid returns the bootstrap is-invalid class if field has an error.
+func invalid(f *Form, field string) string {
+	if f == nil || f.Errors.Get(field) == "" {
+		return ""
+	}
+	return "is-invalid"
+}
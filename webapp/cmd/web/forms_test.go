@@ -4,7 +4,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestForm_Has(t *testing.T) {
@@ -72,3 +75,258 @@ func TestForm_ErrorGet(t *testing.T) {
 		t.Error("should not have an error but got one")
 	}
 }
+
+func TestForm_Email(t *testing.T) {
+	var tests = []struct {
+		name    string
+		email   string
+		isValid bool
+	}{
+		{"valid", "me@here.com", true},
+		{"empty", "", true},
+		{"no at sign", "me.here.com", false},
+		{"no local part", "@here.com", false},
+		{"display name", "Me <me@here.com>", false},
+	}
+
+	for _, e := range tests {
+		postedData := url.Values{}
+		postedData.Add("email", e.email)
+		form := NewForm(postedData)
+
+		form.Email("email")
+		if form.Valid() != e.isValid {
+			t.Errorf("%s: expected valid to be %t but got %t", e.name, e.isValid, form.Valid())
+		}
+	}
+}
+
+func TestForm_MinLength(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("a", "abc")
+	form := NewForm(postedData)
+
+	form.MinLength("a", 4)
+	if form.Valid() {
+		t.Error("form shows min length for a value that is too short")
+	}
+	if form.Errors.Get("a") == "" {
+		t.Error("should have an error for a, but does not")
+	}
+
+	form = NewForm(postedData)
+	form.MinLength("a", 3)
+	if !form.Valid() {
+		t.Error("shows min length not met when it is")
+	}
+}
+
+func TestForm_MaxLength(t *testing.T) {
+	postedData := url.Values{}
+	postedData.Add("a", "abcd")
+	form := NewForm(postedData)
+
+	form.MaxLength("a", 3)
+	if form.Valid() {
+		t.Error("form shows max length for a value that is too long")
+	}
+
+	form = NewForm(postedData)
+	form.MaxLength("a", 4)
+	if !form.Valid() {
+		t.Error("shows max length exceeded when it is not")
+	}
+}
+
+func TestForm_IntRange(t *testing.T) {
+	var tests = []struct {
+		name    string
+		value   string
+		isValid bool
+	}{
+		{"in range", "5", true},
+		{"lower bound", "1", true},
+		{"upper bound", "10", true},
+		{"empty", "", true},
+		{"too small", "0", false},
+		{"too big", "11", false},
+		{"not a number", "five", false},
+	}
+
+	for _, e := range tests {
+		form := NewForm(url.Values{"a": {e.value}})
+		form.IntRange("a", 1, 10)
+		if form.Valid() != e.isValid {
+			t.Errorf("%s: expected valid to be %t but got %t", e.name, e.isValid, form.Valid())
+		}
+	}
+}
+
+func TestForm_Matches(t *testing.T) {
+	pattern := regexp.MustCompile(`^[a-z]+$`)
+
+	form := NewForm(url.Values{"a": {"abc"}})
+	form.Matches("a", pattern)
+	if !form.Valid() {
+		t.Error("shows no match when value matches pattern")
+	}
+
+	form = NewForm(url.Values{"a": {"ABC"}})
+	form.Matches("a", pattern)
+	if form.Valid() {
+		t.Error("shows match when value does not match pattern")
+	}
+}
+
+func TestForm_OneOf(t *testing.T) {
+	form := NewForm(url.Values{"a": {"red"}})
+	form.OneOf("a", "red", "green")
+	if !form.Valid() {
+		t.Error("shows invalid when value is permitted")
+	}
+
+	form = NewForm(url.Values{"a": {"blue"}})
+	form.OneOf("a", "red", "green")
+	if form.Valid() {
+		t.Error("shows valid when value is not permitted")
+	}
+	if !strings.Contains(form.Errors.Get("a"), "red, green") {
+		t.Errorf("expected permitted values in error but got %s", form.Errors.Get("a"))
+	}
+}
+
+func TestForm_EqualTo(t *testing.T) {
+	form := NewForm(url.Values{"password": {"secret"}, "confirm": {"secret"}})
+	form.EqualTo("confirm", "password")
+	if !form.Valid() {
+		t.Error("shows fields differ when they are equal")
+	}
+
+	form = NewForm(url.Values{"password": {"secret"}, "confirm": {"secrets"}})
+	form.EqualTo("confirm", "password")
+	if form.Valid() {
+		t.Error("shows fields equal when they differ")
+	}
+}
+
+func TestForm_Date(t *testing.T) {
+	form := NewForm(url.Values{"a": {"2022-08-19"}})
+	form.Date("a", "2006-01-02")
+	if !form.Valid() {
+		t.Error("shows invalid date when date is valid")
+	}
+
+	form = NewForm(url.Values{"a": {"19/08/2022"}})
+	form.Date("a", "2006-01-02")
+	if form.Valid() {
+		t.Error("shows valid date when date is invalid")
+	}
+}
+
+func TestForm_message(t *testing.T) {
+	form := NewForm(nil)
+	form.Required("a")
+	if form.Errors.Get("a") != "This field cannot be blank" {
+		t.Errorf("wrong default message: %s", form.Errors.Get("a"))
+	}
+
+	form = NewForm(nil)
+	form.Locale = "es"
+	form.Required("a")
+	if form.Errors.Get("a") != "Este campo no puede estar vacío" {
+		t.Errorf("wrong localized message: %s", form.Errors.Get("a"))
+	}
+
+	form = NewForm(nil)
+	form.Locale = "xx"
+	form.Required("a")
+	if form.Errors.Get("a") != "This field cannot be blank" {
+		t.Errorf("unknown locale should fall back to default, but got %s", form.Errors.Get("a"))
+	}
+
+	form = NewForm(url.Values{"a": {"ab"}})
+	form.Messages["min_length"] = "Too short, need %d"
+	form.MinLength("a", 3)
+	if form.Errors.Get("a") != "Too short, need 3" {
+		t.Errorf("wrong overridden message: %s", form.Errors.Get("a"))
+	}
+}
+
+func TestForm_Bind(t *testing.T) {
+	type signup struct {
+		Name     string    `form:"name"`
+		Age      int       `form:"age"`
+		Score    float64   `form:"score"`
+		Terms    bool      `form:"terms"`
+		Birthday time.Time `form:"birthday"`
+		Other    string
+	}
+
+	form := NewForm(url.Values{
+		"name":     {" Jack "},
+		"age":      {"42"},
+		"score":    {"9.5"},
+		"terms":    {"on"},
+		"birthday": {"1980-01-02"},
+		"Other":    {"ignored"},
+	})
+
+	var s signup
+	err := form.Bind(&s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Name != "Jack" || s.Age != 42 || s.Score != 9.5 || !s.Terms || s.Other != "" {
+		t.Errorf("form bound wrong values: %+v", s)
+	}
+	if !s.Birthday.Equal(time.Date(1980, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("wrong birthday: %s", s.Birthday)
+	}
+
+	var login struct {
+		Email    string `form:"email"`
+		Password string `form:"password,notrim"`
+	}
+	form = NewForm(url.Values{"email": {" jack@example.com "}, "password": {" secret "}})
+	if err := form.Bind(&login); err != nil {
+		t.Fatal(err)
+	}
+	if login.Email != "jack@example.com" || login.Password != " secret " {
+		t.Errorf("expected only the email to be trimmed, got %+v", login)
+	}
+
+	form = NewForm(url.Values{"age": {"old"}})
+	if err := form.Bind(&s); err == nil {
+		t.Error("expected error binding non numeric age but did not get one")
+	}
+
+	form = NewForm(nil)
+	form.Required("name")
+	if err := form.Bind(&s); err == nil {
+		t.Error("expected error binding invalid form but did not get one")
+	}
+
+	if err := NewForm(nil).Bind(s); err == nil {
+		t.Error("expected error binding to non pointer but did not get one")
+	}
+}
+
+func Test_formHelpers(t *testing.T) {
+	form := NewForm(url.Values{"a": {"value"}})
+	form.Errors.Add("a", "<bad>")
+
+	if formValue(form, "a") != "value" {
+		t.Error("formValue did not return the posted value")
+	}
+	if invalid(form, "a") != "is-invalid" {
+		t.Error("invalid did not return is-invalid for field with an error")
+	}
+	if !strings.Contains(string(fieldError(form, "a")), "&lt;bad&gt;") {
+		t.Errorf("fieldError did not escape the error: %s", fieldError(form, "a"))
+	}
+
+	if formValue(nil, "a") != "" || invalid(nil, "a") != "" || fieldError(nil, "a") != "" {
+		t.Error("helpers should return empty values for a nil form")
+	}
+}
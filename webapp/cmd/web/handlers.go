@@ -1,18 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"path"
 	"path/filepath"
+	"strings"
 	"time"
 	"webapp/pkg/data"
+	"webapp/pkg/repository"
 )
 
+// pathToTemplates is where templates are read from, and watched, in dev mode.
 var pathToTemplates = "./templates/"
 var uploadPath = "./static/img"
 
@@ -29,14 +32,100 @@ func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *application) Profile(w http.ResponseWriter, r *http.Request) {
-	_ = app.render(w, r, "profile.page.gohtml", &TemplateData{})
+	user, _ := app.Session.Get(r.Context(), "user").(data.User)
+
+	form := NewForm(url.Values{
+		"first_name": {user.FirstName},
+		"last_name":  {user.LastName},
+		"email":      {user.Email},
+	})
+	_ = app.render(w, r, "profile.page.gohtml", &TemplateData{Form: form})
+}
+
+func (app *application) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		app.clientError(w, r, http.StatusBadRequest, "The request could not be understood.")
+		return
+	}
+
+	// get the user from the session, and load the current record from the database
+	sessionUser, _ := app.Session.Get(r.Context(), "user").(data.User)
+	user, err := app.db(r).GetUser(sessionUser.ID)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.MaxLength("first_name", 255)
+	form.MaxLength("last_name", 255)
+	form.MaxLength("email", 255)
+	form.Email("email")
+
+	email := strings.TrimSpace(form.Data.Get("email"))
+
+	// changing the email address requires the current password
+	if !strings.EqualFold(email, user.Email) {
+		form.Required("password")
+		if form.Has("password") {
+			matches, err := user.PasswordMatches(form.Data.Get("password"))
+			form.Check(err == nil && matches, "password", "Incorrect password")
+		}
+		if existing, err := app.db(r).GetUserByEmail(email); err == nil && existing.ID != user.ID {
+			form.Errors.Add("email", "This email address is already in use")
+		}
+	}
+
+	if !form.Valid() {
+		_ = app.render(w, r, "profile.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	user.FirstName = strings.TrimSpace(form.Data.Get("first_name"))
+	user.LastName = strings.TrimSpace(form.Data.Get("last_name"))
+	user.Email = email
+
+	err = app.db(r).UpdateUser(*user)
+	if err == repository.ErrConflict {
+		app.Session.Put(r.Context(), "error", "Your profile was changed somewhere else at the same time; check it and try again")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// refresh the sessional variable user
+	err = app.refreshSessionUser(r, user.ID)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Profile updated")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// refreshSessionUser reloads the user with the given id from the database
+// and replaces the copy of it cached in the session.
+func (app *application) refreshSessionUser(r *http.Request, id int) error {
+	user, err := app.db(r).GetUser(id)
+	if err != nil {
+		return err
+	}
+	app.Session.Put(r.Context(), "user", *user)
+	return nil
 }
 
 func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		log.Println(err)
-		http.Error(w, "bad request", http.StatusBadRequest)
+		app.clientError(w, r, http.StatusBadRequest, "The request could not be understood.")
 		return
 	}
 	email := r.Form.Get("email")
@@ -51,7 +140,7 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := app.DB.GetUserByEmail(email)
+	user, err := app.db(r).GetUserByEmail(email)
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "Invalid login")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -61,25 +150,204 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	// authenticate user
 	// if not authenticated, redirect user with error
 
-	if !app.authenticate(r, user, password) {
-		app.Session.Put(r.Context(), "error", "Invalid login")
+	if err := app.authenticate(r, user, password); err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	// prevent fixation attack
+	// prevent fixation attack; the CSRF token goes too, as whoever planted
+	// the session may know it, and the next page gets a new one
 	_ = app.Session.RenewToken(r.Context())
+	app.Session.Remove(r.Context(), csrfSessionKey)
+	if err := app.startSessionTracking(r, user.ID); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
 
 	// store success mesage in session and redirect
 	app.Session.Put(r.Context(), "flash", "Successfully logged in")
-	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+
+	// send the user back to the page they were trying to reach, if any
+	returnTo := app.Session.PopString(r.Context(), "return_to")
+	if !safeReturnTo(returnTo) {
+		returnTo = "/user/profile"
+	}
+	http.Redirect(w, r, returnTo, http.StatusSeeOther)
+}
+
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	err := app.Session.Destroy(r.Context())
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "You have been logged out")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) Sessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := app.Session.Get(r.Context(), "user").(data.User)
+
+	sessions, err := app.userSessions(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	_ = app.render(w, r, "sessions.page.gohtml", &TemplateData{Data: map[string]any{"sessions": sessions}})
 }
 
-func (app *application) authenticate(r *http.Request, user *data.User, password string) bool {
+func (app *application) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		app.clientError(w, r, http.StatusBadRequest, "The request could not be understood.")
+		return
+	}
+
+	sessionID := r.Form.Get("session_id")
+	if sessionID == "" {
+		app.clientError(w, r, http.StatusBadRequest, "The request could not be understood.")
+		return
+	}
+
+	user, _ := app.Session.Get(r.Context(), "user").(data.User)
+	n, err := app.destroyUserSessions(r.Context(), user.ID, func(id string) bool { return id == sessionID })
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if n == 0 {
+		app.Session.Put(r.Context(), "error", "Session not found")
+	} else {
+		app.Session.Put(r.Context(), "flash", "Session revoked")
+	}
+	http.Redirect(w, r, "/user/sessions", http.StatusSeeOther)
+}
+
+func (app *application) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := app.Session.Get(r.Context(), "user").(data.User)
+	n, err := app.destroyUserSessions(r.Context(), user.ID, func(string) bool { return true })
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Revoked %d other sessions", n))
+	http.Redirect(w, r, "/user/sessions", http.StatusSeeOther)
+}
+
+func (app *application) PasswordPage(w http.ResponseWriter, r *http.Request) {
+	_ = app.render(w, r, "password.page.gohtml", &TemplateData{Form: NewForm(nil)})
+}
+
+func (app *application) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		app.clientError(w, r, http.StatusBadRequest, "The request could not be understood.")
+		return
+	}
+
+	sessionUser, _ := app.Session.Get(r.Context(), "user").(data.User)
+	user, err := app.db(r).GetUser(sessionUser.ID)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("current_password", "new_password", "confirm_password")
+	form.MinLength("new_password", 6)
+	form.EqualTo("confirm_password", "new_password")
+	if form.Has("current_password") {
+		matches, err := user.PasswordMatches(form.Data.Get("current_password"))
+		form.Check(err == nil && matches, "current_password", "Incorrect password")
+	}
+
+	if !form.Valid() {
+		_ = app.render(w, r, "password.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	err = app.db(r).ResetPassword(user.ID, form.Data.Get("new_password"))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// a changed password logs the user out everywhere, including here
+	err = app.logoutEverywhere(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Password changed; please log in again")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		app.clientError(w, r, http.StatusBadRequest, "The request could not be understood.")
+		return
+	}
+
+	sessionUser, _ := app.Session.Get(r.Context(), "user").(data.User)
+	user, err := app.db(r).GetUser(sessionUser.ID)
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if matches, err := user.PasswordMatches(r.Form.Get("password")); err != nil || !matches {
+		app.Session.Put(r.Context(), "error", "Incorrect password; your account was not deleted")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	err = app.db(r).DeleteUser(user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.logoutEverywhere(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your account has been deleted")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// loginError is a reason for refusing a login, worded for the user.
+type loginError string
+
+func (e loginError) Error() string {
+	return string(e)
+}
+
+const (
+	errInvalidLogin     loginError = "Invalid login"
+	errEmailNotVerified loginError = "Please verify your email address before logging in"
+)
+
+// authenticate logs user in if password is theirs and they have verified
+// their email address.
+func (app *application) authenticate(r *http.Request, user *data.User, password string) error {
 	if valid, err := user.PasswordMatches(password); err != nil || !valid {
-		return false
+		return errInvalidLogin
+	}
+	if !user.EmailVerified {
+		return errEmailNotVerified
 	}
 	app.Session.Put(r.Context(), "user", user)
-	return true
+	return nil
 }
 
 func (app *application) UploadProfilePic(w http.ResponseWriter, r *http.Request) {
@@ -87,7 +355,7 @@ func (app *application) UploadProfilePic(w http.ResponseWriter, r *http.Request)
 
 	files, err := app.UploadFiles(r, uploadPath)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.clientError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 	// get the user from the session
@@ -98,18 +366,17 @@ func (app *application) UploadProfilePic(w http.ResponseWriter, r *http.Request)
 		FileName: files[0].OriginalFileName,
 	}
 	// Insert user the image into user_images
-	_, err = app.DB.InsertUserImage(i)
+	_, err = app.db(r).InsertUserImage(i)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.clientError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 	// refresh the sessional variable user
-	updatedUser, err := app.DB.GetUser(user.ID)
+	err = app.refreshSessionUser(r, user.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.clientError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	app.Session.Put(r.Context(), "user", updatedUser)
 	// redirect back to profile page
 	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 }
@@ -163,35 +430,60 @@ func (app *application) UploadFiles(r *http.Request, uploadDir string) ([]*Uploa
 }
 
 type TemplateData struct {
-	IP    string
-	Data  map[string]any
-	Error string
-	Flash string
-	User  data.User
+	IP        string
+	Data      map[string]any
+	Error     string
+	Flash     string
+	Form      *Form
+	User      data.User
+	CSRFToken string
 }
 
 func (app *application) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) error {
-	// parse the template from disk
-	parsedTemplate, err := template.ParseFiles(path.Join(pathToTemplates, t), path.Join(pathToTemplates, "base.layout.gohtml"))
+	return app.renderStatus(w, r, http.StatusOK, t, td)
+}
+
+// renderStatus renders the template t with the given status. The page is
+// rendered into a buffer first, so that if anything goes wrong the user gets
+// the server error page rather than half a page; render responds in that case
+// too, so callers only need its error if they care whether the page was shown.
+func (app *application) renderStatus(w http.ResponseWriter, r *http.Request, status int, t string, td *TemplateData) error {
+	buf, err := app.executeTemplate(r, t, td)
 	if err != nil {
-		http.Error(w, "bad request", http.StatusBadRequest)
+		app.serverError(w, r, err)
 		return err
 	}
 
-	td.IP = app.ipFromContext(r.Context())
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// executeTemplate fills in the data common to every page and executes the
+// template t into a buffer.
+func (app *application) executeTemplate(r *http.Request, t string, td *TemplateData) (*bytes.Buffer, error) {
+	// get the parsed template from the cache
+	parsedTemplate, err := app.Templates.Lookup(t)
+	if err != nil {
+		return nil, err
+	}
+
+	td.IP = app.ipStringFromContext(r.Context())
 
 	td.Error = app.Session.PopString(r.Context(), "error")
 	td.Flash = app.Session.PopString(r.Context(), "flash")
+	td.CSRFToken = app.csrfToken(r.Context())
 
 	if app.Session.Exists(r.Context(), "user") {
 		td.User = app.Session.Get(r.Context(), "user").(data.User)
 	}
 
 	// execute the template, passing it data if any
-
-	err = parsedTemplate.Execute(w, td)
+	buf := new(bytes.Buffer)
+	err = parsedTemplate.Execute(buf, td)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return buf, nil
 }
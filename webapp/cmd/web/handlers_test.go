@@ -9,6 +9,7 @@ import (
 	"image/png"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -17,6 +18,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 	"webapp/pkg/data"
 )
 
@@ -31,6 +33,7 @@ func Test_application_handlers(t *testing.T) {
 		{"home", "/", http.StatusOK, "/", http.StatusOK},
 		{"404", "/fern", http.StatusNotFound, "/fern", http.StatusNotFound},
 		{"profile", "/user/profile", http.StatusOK, "/", http.StatusTemporaryRedirect},
+		{"admin", "/admin/", http.StatusOK, "/", http.StatusTemporaryRedirect},
 	}
 	routes := app.routes()
 
@@ -50,6 +53,8 @@ func Test_application_handlers(t *testing.T) {
 	}
 
 	for _, e := range tests {
+		resetDB()
+
 		resp, err := s.Client().Get(s.URL + e.url)
 		if err != nil {
 			t.Log(err)
@@ -83,6 +88,8 @@ func TestAppHome(t *testing.T) {
 	}
 
 	for _, e := range tests {
+		resetDB()
+
 		// create a request
 		req, _ := http.NewRequest("GET", "/", nil)
 		req = addContextAndSessionToRequest(req, app)
@@ -111,22 +118,39 @@ func TestAppHome(t *testing.T) {
 }
 
 func TestApp_renderWithBadTemplate(t *testing.T) {
-	// set template path to a location with a bad template
-	pathToTemplates = "./testdata/"
+	// a template that fails to parse should stop the cache being built
+	_, err := newTemplateStore(os.DirFS("./testdata/"))
+	if err == nil {
+		t.Error("Expected error from bad template but did not get one")
+	}
 
+	// a template that isn't in the cache should be a server error
 	req, _ := http.NewRequest("GET", "/", nil)
 	req = addContextAndSessionToRequest(req, app)
 	rr := httptest.NewRecorder()
 
-	err := app.render(rr, req, "bad.page.gothml", &TemplateData{})
+	err = app.render(rr, req, "bad.page.gothml", &TemplateData{})
 	if err == nil {
-		t.Error("Expected error from bad template but did not get one")
+		t.Error("Expected error from missing template but did not get one")
+	}
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d but got %d", http.StatusInternalServerError, rr.Code)
 	}
-	pathToTemplates = "./../../templates/"
+	if strings.Contains(rr.Body.String(), "bad.page.gothml") {
+		t.Error("template error details should only be shown in dev mode")
+	}
+
+	app.DevMode = true
+	rr = httptest.NewRecorder()
+	_ = app.render(rr, req, "bad.page.gothml", &TemplateData{})
+	if !strings.Contains(rr.Body.String(), "bad.page.gothml") {
+		t.Error("expected template error details in dev mode")
+	}
+	app.DevMode = false
 }
 
 func getCtx(req *http.Request) context.Context {
-	ctx := context.WithValue(req.Context(), contextUserKey, "unknown")
+	ctx := context.WithValue(req.Context(), contextUserKey, net.ParseIP("127.0.0.1"))
 	return ctx
 }
 
@@ -142,9 +166,31 @@ func Test_app_Login(t *testing.T) {
 	var tests = []struct {
 		name               string
 		postedData         url.Values
+		returnTo           string
 		expectedStatusCode int
 		expectedLoc        string
+		expectedError      string
 	}{
+		{
+			name: "valid login with return to",
+			postedData: url.Values{
+				"email":    {"admin@example.com"},
+				"password": {"secret"},
+			},
+			returnTo:           "/admin/",
+			expectedStatusCode: 303,
+			expectedLoc:        "/admin/",
+		},
+		{
+			name: "valid login with unsafe return to",
+			postedData: url.Values{
+				"email":    {"admin@example.com"},
+				"password": {"secret"},
+			},
+			returnTo:           "//evil.com",
+			expectedStatusCode: 303,
+			expectedLoc:        "/user/profile",
+		},
 		{
 			name: "valid login",
 			postedData: url.Values{
@@ -180,13 +226,30 @@ func Test_app_Login(t *testing.T) {
 			},
 			expectedStatusCode: 303,
 			expectedLoc:        "/",
+			expectedError:      "Invalid login",
+		},
+		{
+			name: "email not verified",
+			postedData: url.Values{
+				"email":    {"unverified@example.com"},
+				"password": {"secret"},
+			},
+			expectedStatusCode: 303,
+			expectedLoc:        "/",
+			expectedError:      string(errEmailNotVerified),
 		},
 	}
 
 	for _, e := range tests {
+		resetDB()
+
 		req, _ := http.NewRequest("POST", "/login", strings.NewReader(e.postedData.Encode()))
 		req = addContextAndSessionToRequest(req, app)
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if e.returnTo != "" {
+			app.Session.Put(req.Context(), "return_to", e.returnTo)
+		}
+		app.Session.Put(req.Context(), csrfSessionKey, "before-login")
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(app.Login)
 		handler.ServeHTTP(rr, req)
@@ -203,6 +266,17 @@ func Test_app_Login(t *testing.T) {
 			t.Errorf("%s: no location header set in the test", e.name)
 		}
 
+		if e.expectedError != "" {
+			if msg := app.Session.GetString(req.Context(), "error"); msg != e.expectedError {
+				t.Errorf("%s: expected error %q but got %q", e.name, e.expectedError, msg)
+			}
+			if app.Session.Exists(req.Context(), "user") {
+				t.Errorf("%s: user should not be logged in", e.name)
+			}
+		}
+		if app.Session.Exists(req.Context(), "user") && app.Session.GetString(req.Context(), csrfSessionKey) == "before-login" {
+			t.Errorf("%s: expected the CSRF token from before logging in to be replaced", e.name)
+		}
 	}
 }
 
@@ -270,6 +344,7 @@ func simulatePNGUpload(fileToUpload string, writer *multipart.Writer, t *testing
 }
 
 func Test_app_UploadProfilePic(t *testing.T) {
+	resetDB()
 	uploadPath = "./testdata/uploads"
 	filePath := "./testdata/img.png"
 
@@ -312,3 +387,355 @@ func Test_app_UploadProfilePic(t *testing.T) {
 	_ = os.Remove("./testdata/uploads/img.png")
 
 }
+
+func Test_app_UpdateProfile(t *testing.T) {
+	var tests = []struct {
+		name               string
+		postedData         url.Values
+		expectedStatusCode int
+		expectedLoc        string
+		expectedHTML       string
+	}{
+		{
+			name: "valid update",
+			postedData: url.Values{
+				"first_name": {"Administrator"},
+				"last_name":  {"User"},
+				"email":      {"admin@example.com"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectedLoc:        "/user/profile",
+		},
+		{
+			name: "missing first name",
+			postedData: url.Values{
+				"first_name": {""},
+				"last_name":  {"User"},
+				"email":      {"admin@example.com"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "This field cannot be blank",
+		},
+		{
+			name: "invalid email",
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"admin.example.com"},
+				"password":   {"secret"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "Invalid email address",
+		},
+		{
+			name: "email change without password",
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"new@example.com"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "This field cannot be blank",
+		},
+		{
+			name: "email change with wrong password",
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"new@example.com"},
+				"password":   {"password"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "Incorrect password",
+		},
+		{
+			name: "email change with password",
+			postedData: url.Values{
+				"first_name": {"Admin"},
+				"last_name":  {"User"},
+				"email":      {"new@example.com"},
+				"password":   {"secret"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectedLoc:        "/user/profile",
+		},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest("POST", "/user/profile", strings.NewReader(e.postedData.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.UpdateProfile)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: returned wrong status code; expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedLoc != "" {
+			actualLoc, err := rr.Result().Location()
+			if err != nil {
+				t.Errorf("%s: no location header set", e.name)
+			} else if actualLoc.String() != e.expectedLoc {
+				t.Errorf("%s: expected location %s but got %s", e.name, e.expectedLoc, actualLoc)
+			}
+
+			// the session copy of the user should have been refreshed
+			if _, ok := app.Session.Get(req.Context(), "user").(data.User); !ok {
+				t.Errorf("%s: expected a data.User in the session", e.name)
+			}
+		}
+
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %s in response body", e.name, e.expectedHTML)
+		}
+	}
+}
+
+// addStoredSession commits a logged in session for userID to the session
+// store, as if it had been created by another browser, and returns its token.
+func addStoredSession(t *testing.T, userID int, sessionID string) string {
+	ctx, err := app.Session.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Session.Put(ctx, "user", data.User{ID: userID})
+	app.Session.Put(ctx, "session_id", sessionID)
+	app.Session.Put(ctx, "ip", "10.0.0.1")
+	app.Session.Put(ctx, "user_agent", "test-agent")
+	app.Session.Put(ctx, "last_seen", time.Now().Unix())
+
+	token, _, err := app.Session.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.indexSession(userID, token); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func sessionIsStored(token string) bool {
+	_, found, _ := app.Session.Store.Find(token)
+	return found
+}
+
+func Test_app_Logout(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/logout", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.Logout)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("wrong status code; expected %d but got %d", http.StatusSeeOther, rr.Code)
+	}
+	if app.Session.Exists(req.Context(), "user") {
+		t.Error("user still in session after logout")
+	}
+}
+
+func Test_app_Sessions(t *testing.T) {
+	mine := addStoredSession(t, 1, "my-other-session")
+	theirs := addStoredSession(t, 2, "their-session")
+	defer app.Session.Store.Delete(mine)
+	defer app.Session.Store.Delete(theirs)
+
+	req, _ := http.NewRequest("GET", "/user/sessions", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.Sessions)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("wrong status code; expected %d but got %d", http.StatusOK, rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "my-other-session") {
+		t.Error("expected the user's other session to be listed")
+	}
+	if strings.Contains(rr.Body.String(), "their-session") {
+		t.Error("another user's session should not be listed")
+	}
+}
+
+func Test_app_RevokeSession(t *testing.T) {
+	mine := addStoredSession(t, 1, "revoke-me")
+	keep := addStoredSession(t, 1, "keep-me")
+	theirs := addStoredSession(t, 2, "not-mine")
+	defer app.Session.Store.Delete(keep)
+	defer app.Session.Store.Delete(theirs)
+
+	var tests = []struct {
+		name      string
+		sessionID string
+		revoked   string
+	}{
+		{"own session", "revoke-me", mine},
+		{"other user's session", "not-mine", ""},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		postedData := url.Values{"session_id": {e.sessionID}}
+		req, _ := http.NewRequest("POST", "/user/sessions/revoke", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.RevokeSession)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if e.revoked != "" && sessionIsStored(e.revoked) {
+			t.Errorf("%s: session was not revoked", e.name)
+		}
+	}
+
+	if !sessionIsStored(keep) || !sessionIsStored(theirs) {
+		t.Error("revoking one session should not revoke any others")
+	}
+}
+
+func Test_app_RevokeOtherSessions(t *testing.T) {
+	first := addStoredSession(t, 1, "first")
+	second := addStoredSession(t, 1, "second")
+	theirs := addStoredSession(t, 2, "theirs")
+	defer app.Session.Store.Delete(theirs)
+
+	req, _ := http.NewRequest("POST", "/user/sessions/revoke-others", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.RevokeOtherSessions)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("wrong status code; expected %d but got %d", http.StatusSeeOther, rr.Code)
+	}
+	if sessionIsStored(first) || sessionIsStored(second) {
+		t.Error("expected the user's other sessions to be revoked")
+	}
+	if !sessionIsStored(theirs) {
+		t.Error("another user's session was revoked")
+	}
+	if !app.Session.Exists(req.Context(), "user") {
+		t.Error("the current session should not be revoked")
+	}
+}
+
+func Test_app_ChangePassword(t *testing.T) {
+	var tests = []struct {
+		name               string
+		postedData         url.Values
+		expectedStatusCode int
+		expectLoggedOut    bool
+	}{
+		{
+			name: "valid",
+			postedData: url.Values{
+				"current_password": {"secret"},
+				"new_password":     {"newsecret"},
+				"confirm_password": {"newsecret"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectLoggedOut:    true,
+		},
+		{
+			name: "wrong current password",
+			postedData: url.Values{
+				"current_password": {"password"},
+				"new_password":     {"newsecret"},
+				"confirm_password": {"newsecret"},
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name: "confirmation does not match",
+			postedData: url.Values{
+				"current_password": {"secret"},
+				"new_password":     {"newsecret"},
+				"confirm_password": {"oldsecret"},
+			},
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		other := addStoredSession(t, 1, "other")
+
+		req, _ := http.NewRequest("POST", "/user/password", strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.ChangePassword)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectLoggedOut == sessionIsStored(other) {
+			t.Errorf("%s: expected other sessions logged out to be %t", e.name, e.expectLoggedOut)
+		}
+		if e.expectLoggedOut == app.Session.Exists(req.Context(), "user") {
+			t.Errorf("%s: expected current session logged out to be %t", e.name, e.expectLoggedOut)
+		}
+		_ = app.Session.Store.Delete(other)
+	}
+}
+
+func Test_app_DeleteAccount(t *testing.T) {
+	var tests = []struct {
+		name            string
+		password        string
+		expectedLoc     string
+		expectLoggedOut bool
+	}{
+		{"wrong password", "password", "/user/profile", false},
+		{"valid", "secret", "/", true},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		other := addStoredSession(t, 1, "other")
+
+		postedData := url.Values{"password": {e.password}}
+		req, _ := http.NewRequest("POST", "/user/delete", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.DeleteAccount)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, http.StatusSeeOther, rr.Code)
+		}
+		if loc, _ := rr.Result().Location(); loc == nil || loc.String() != e.expectedLoc {
+			t.Errorf("%s: expected location %s but got %v", e.name, e.expectedLoc, loc)
+		}
+		if e.expectLoggedOut == sessionIsStored(other) {
+			t.Errorf("%s: expected other sessions logged out to be %t", e.name, e.expectLoggedOut)
+		}
+		_ = app.Session.Store.Delete(other)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR
+// ranges, such as "10.0.0.0/8,127.0.0.1", into networks. A bare address is
+// treated as a network containing just that address.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR", entry)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// isTrusted reports whether ip belongs to one of the trusted networks.
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getIP works out the IP address of the client that made r. The forwarding
+// headers Forwarded, X-Forwarded-For and X-Real-IP are only believed when the
+// request came directly from a trusted proxy. The forwarding chain is then
+// walked from right to left, skipping trusted proxies, and the first address
+// that is not a trusted proxy is the client.
+func getIP(r *http.Request, trusted []*net.IPNet) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteIP := net.ParseIP(host)
+	if remoteIP == nil {
+		return nil, fmt.Errorf("userip: %q is not IP:port", r.RemoteAddr)
+	}
+
+	if !isTrusted(remoteIP, trusted) {
+		return remoteIP, nil
+	}
+
+	chain := forwardedFor(r.Header)
+	if len(chain) == 0 {
+		chain = xForwardedFor(r.Header)
+	}
+
+	if len(chain) == 0 {
+		if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+			return realIP, nil
+		}
+		return remoteIP, nil
+	}
+
+	ip := remoteIP
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseHop(chain[i])
+		if hop == nil {
+			// an unparseable or obfuscated hop can't be followed any further
+			break
+		}
+		ip = hop
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+
+	return ip, nil
+}
+
+// xForwardedFor returns the addresses listed in every X-Forwarded-For header,
+// oldest first.
+func xForwardedFor(h http.Header) []string {
+	var hops []string
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// forwardedFor returns the for= parameters of every RFC 7239 Forwarded header,
+// oldest first. Elements without a for= parameter are skipped.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, value := range h.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses one forwarding hop, which may carry a port, as in
+// "192.0.2.60:8080" and "[2001:db8::1]:4711". It returns nil for anything that
+// is not an IP address, such as the obfuscated identifiers "unknown" and
+// "_hidden" allowed by RFC 7239.
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
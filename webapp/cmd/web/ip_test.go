@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_parseTrustedProxies(t *testing.T) {
+	var tests = []struct {
+		name          string
+		list          string
+		expectedCount int
+		errorExpected bool
+	}{
+		{"empty", "", 0, false},
+		{"cidr", "10.0.0.0/8", 1, false},
+		{"bare ipv4", "127.0.0.1", 1, false},
+		{"bare ipv6", "::1", 1, false},
+		{"list", "10.0.0.0/8, 127.0.0.1,,fd00::/8", 3, false},
+		{"bad ip", "localhost", 0, true},
+		{"bad cidr", "10.0.0.0/99", 0, true},
+	}
+
+	for _, e := range tests {
+		networks, err := parseTrustedProxies(e.list)
+		if (err != nil) != e.errorExpected {
+			t.Errorf("%s: expected error to be %t but got %v", e.name, e.errorExpected, err)
+		}
+		if len(networks) != e.expectedCount {
+			t.Errorf("%s: expected %d networks but got %d", e.name, e.expectedCount, len(networks))
+		}
+	}
+
+	networks, _ := parseTrustedProxies("127.0.0.1")
+	if !isTrusted(net.ParseIP("127.0.0.1"), networks) || isTrusted(net.ParseIP("127.0.0.2"), networks) {
+		t.Error("a bare address should only trust that one address")
+	}
+}
+
+func Test_getIP(t *testing.T) {
+	trusted, _ := parseTrustedProxies("10.0.0.0/8")
+
+	var tests = []struct {
+		name          string
+		remoteAddr    string
+		headers       map[string]string
+		expectedIP    string
+		errorExpected bool
+	}{
+		{"no headers", "203.0.113.7:1234", nil, "203.0.113.7", false},
+		{"bad remote address", "nonsense", nil, "", true},
+		{"spoofed header from untrusted client", "203.0.113.7:1234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.7", false},
+		{"forwarded for from trusted proxy", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.9"}, "198.51.100.9", false},
+		{"right to left through trusted proxies", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.9, 10.0.0.2"}, "198.51.100.9", false},
+		{"all hops trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3", false},
+		{"garbage hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "garbage, 10.0.0.2"}, "10.0.0.2", false},
+		{"forwarded", "10.0.0.1:1234", map[string]string{"Forwarded": `for=192.0.2.60;proto=http;by=10.0.0.1`}, "192.0.2.60", false},
+		{"forwarded ipv6 with port", "10.0.0.1:1234", map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17", false},
+		{"forwarded list", "10.0.0.1:1234", map[string]string{"Forwarded": `for=192.0.2.43, for=198.51.100.17:80`}, "198.51.100.17", false},
+		{"forwarded preferred", "10.0.0.1:1234", map[string]string{"Forwarded": "for=192.0.2.60", "X-Forwarded-For": "198.51.100.9"}, "192.0.2.60", false},
+		{"forwarded obfuscated", "10.0.0.1:1234", map[string]string{"Forwarded": "for=unknown"}, "10.0.0.1", false},
+		{"real ip", "10.0.0.1:1234", map[string]string{"X-Real-IP": "198.51.100.9"}, "198.51.100.9", false},
+		{"untrusted real ip", "203.0.113.7:1234", map[string]string{"X-Real-IP": "198.51.100.9"}, "203.0.113.7", false},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = e.remoteAddr
+		for k, v := range e.headers {
+			req.Header.Set(k, v)
+		}
+
+		ip, err := getIP(req, trusted)
+		if (err != nil) != e.errorExpected {
+			t.Errorf("%s: expected error to be %t but got %v", e.name, e.errorExpected, err)
+			continue
+		}
+		if e.expectedIP != "" && !ip.Equal(net.ParseIP(e.expectedIP)) {
+			t.Errorf("%s: expected %s but got %s", e.name, e.expectedIP, ip)
+		}
+	}
+}
@@ -1,20 +1,55 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"flag"
+	"github.com/alexedwards/scs/postgresstore"
 	"github.com/alexedwards/scs/v2"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"time"
 	"webapp/pkg/data"
+	"webapp/pkg/dbconn"
+	"webapp/pkg/mail"
 	"webapp/pkg/repository"
 	"webapp/pkg/repository/dbrepo"
+	"webapp/pkg/urlsigner"
+	"webapp/templates"
 )
 
 type application struct {
-	DSN     string
-	DB      repository.DatabaseRepo
-	Session *scs.SessionManager
+	DSN string
+	// DBOptions size the connection pools and say how long to wait for
+	// Postgres at startup.
+	DBOptions    dbconn.Options
+	DB           repository.DatabaseRepo
+	Session      *scs.SessionManager
+	SessionStore string
+	// TrustedProxies are the networks whose forwarding headers are believed
+	// when working out a request's client IP address.
+	TrustedProxies []*net.IPNet
+	// DevMode reads templates from disk, reloading them when they change,
+	// and shows template errors in the browser.
+	DevMode   bool
+	Templates *templateStore
+	// BaseURL is the scheme and host the app is served from, used to build
+	// links that are sent by email.
+	BaseURL string
+	Mailer  mail.Mailer
+	// MailTemplates renders the app's email.
+	MailTemplates *mail.Templates
+	// MailFrom is the sender address of the app's email.
+	MailFrom string
+	// Signer signs the links in verification emails.
+	Signer urlsigner.Signer
+	// DeletedUserRetention is how long deleted users are kept, and can be
+	// restored, before they are purged for good.
+	DeletedUserRetention time.Duration
 }
 
 func main() {
@@ -24,18 +59,97 @@ func main() {
 	app := application{}
 
 	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "Postgres connection")
+	var replicaDSNs []string
+	flag.Func("replica-dsn", "Postgres connection to a read replica; repeat for each replica", func(dsn string) error {
+		replicaDSNs = append(replicaDSNs, dsn)
+		return nil
+	})
+	app.DBOptions = dbconn.DefaultOptions()
+	app.DBOptions.RegisterFlags(flag.CommandLine)
+	repoKind := flag.String("repo", "sql", "Database access for users: sql (database/sql) or pgx (a native pgx pool)")
+	flag.StringVar(&app.SessionStore, "session-store", "postgres", "Session store: memory|postgres")
+	flag.BoolVar(&app.DevMode, "dev", false, "Development mode: reload templates from disk and show template errors")
+	flag.StringVar(&app.BaseURL, "base-url", "http://localhost:8080", "Scheme and host used in links sent by email")
+	flag.StringVar(&app.MailFrom, "mail-from", "no-reply@example.com", "Sender address for email")
+	mailSender := flag.String("mail-sender", "file", "How email is sent: file|smtp")
+	mailDir := flag.String("mail-dir", "./tmp/mail", "Directory email is written to by the file sender")
+	var smtpServer mail.SMTPMailer
+	flag.StringVar(&smtpServer.Host, "smtp-host", "localhost", "SMTP server host")
+	flag.IntVar(&smtpServer.Port, "smtp-port", 587, "SMTP server port")
+	flag.StringVar(&smtpServer.Username, "smtp-user", "", "SMTP username, if the server requires authentication")
+	flag.StringVar(&smtpServer.Password, "smtp-password", "", "SMTP password")
+	linkSecret := flag.String("link-secret", "verysecret", "Secret for signing emailed links; must match the API's")
+	flag.DurationVar(&app.DeletedUserRetention, "deleted-user-retention", 30*24*time.Hour, "How long deleted users can be restored before they are purged")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma separated IPs or CIDRs of trusted reverse proxies, e.g. 10.0.0.0/8,127.0.0.1")
 	flag.Parse()
 
-	conn, err := app.connectToDB()
+	app.Signer = urlsigner.Signer{Secret: []byte(*linkSecret)}
+
+	var err error
+	app.TrustedProxies, err = parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// parse the templates once, from the binary or, in dev mode, from disk
+	if app.DevMode {
+		app.Templates, err = newTemplateStore(os.DirFS(pathToTemplates))
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.MailTemplates, err = mail.NewTemplates(os.DirFS(filepath.Join(pathToTemplates, "mail")))
+		if err != nil {
+			log.Fatal(err)
+		}
+		stop := make(chan struct{})
+		defer close(stop)
+		go app.Templates.Watch(pathToTemplates, time.Second, stop, app.MailTemplates)
+	} else {
+		app.Templates, err = newTemplateStore(templates.FS)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		mailFS, err := fs.Sub(templates.FS, "mail")
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.MailTemplates, err = mail.NewTemplates(mailFS)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the outbox and sessions stay on the primary whichever repo serves users
+	conns, err := dbrepo.Connect(dbrepo.Config{DSN: app.DSN, ReplicaDSNs: replicaDSNs, Repo: *repoKind, Options: app.DBOptions})
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer conn.Close()
+	defer conns.Close()
+	app.DB = conns.Users
 
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	// email is queued in the database and sent in the background
+	sender, err := mail.NewSender(*mailSender, *mailDir, smtpServer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outbox := &mail.Outbox{Repo: conns.Postgres, Mailer: sender}
+	app.Mailer = outbox
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go outbox.Run(ctx)
+	go app.purgeDeletedUsers(ctx, time.Hour)
 
 	// get a session manager
-	app.Session = getSession()
+	store, err := newSessionStore(app.SessionStore, conns.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if s, ok := store.(*postgresstore.PostgresStore); ok {
+		defer s.StopCleanup()
+	}
+	app.Session = getSession(store)
 
 	// print out a message
 	log.Println("Starting server on port 8080...")
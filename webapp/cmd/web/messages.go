@@ -0,0 +1,54 @@
+package main
+
+import "fmt"
+
+// defaultLocale is used when a form has no locale set, or when a message is
+// missing from the form's locale.
+const defaultLocale = "en"
+
+// messages holds the built-in validation messages for each supported locale,
+// keyed by validator. Each message is a fmt format string; the arguments are
+// documented on the validator that uses it.
+var messages = map[string]map[string]string{
+	"en": {
+		"required":   "This field cannot be blank",
+		"email":      "Invalid email address",
+		"min_length": "This field must be at least %d characters long",
+		"max_length": "This field cannot be longer than %d characters",
+		"integer":    "This field must be a whole number",
+		"int_range":  "This field must be between %d and %d",
+		"matches":    "This field is invalid",
+		"one_of":     "This field must be one of: %s",
+		"equal_to":   "This field must match %s",
+		"date":       "This field must be a valid date (%s)",
+	},
+	"es": {
+		"required":   "Este campo no puede estar vacío",
+		"email":      "Dirección de correo electrónico no válida",
+		"min_length": "Este campo debe tener al menos %d caracteres",
+		"max_length": "Este campo no puede tener más de %d caracteres",
+		"integer":    "Este campo debe ser un número entero",
+		"int_range":  "Este campo debe estar entre %d y %d",
+		"matches":    "Este campo no es válido",
+		"one_of":     "Este campo debe ser uno de: %s",
+		"equal_to":   "Este campo debe coincidir con %s",
+		"date":       "Este campo debe ser una fecha válida (%s)",
+	},
+}
+
+// message returns the validation message for key, formatted with args. A
+// message set in f.Messages takes precedence over the form's locale, which in
+// turn falls back to the default locale.
+func (f *Form) message(key string, args ...any) string {
+	format, ok := f.Messages[key]
+	if !ok {
+		format, ok = messages[f.Locale][key]
+	}
+	if !ok {
+		format = messages[defaultLocale][key]
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
@@ -2,64 +2,163 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"net"
 	"net/http"
+	"strings"
+	"time"
+	"webapp/pkg/data"
 )
 
 type contextKey string
 
 const contextUserKey contextKey = "user_ip"
 
-func (app *application) ipFromContext(ctx context.Context) string {
-	return ctx.Value(contextUserKey).(string)
+// ipFromContext returns the client IP address stored in ctx by
+// addIPToContext, or nil if it could not be determined.
+func (app *application) ipFromContext(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(contextUserKey).(net.IP)
+	return ip
+}
+
+// ipStringFromContext is ipFromContext formatted for display.
+func (app *application) ipStringFromContext(ctx context.Context) string {
+	ip := app.ipFromContext(ctx)
+	if ip == nil {
+		return "unknown"
+	}
+	return ip.String()
 }
 
 func (app *application) addIPToContext(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var ctx = context.Background()
-		ip, err := getIP(r)
+		ip, err := getIP(r, app.TrustedProxies)
 		if err != nil {
-			ip, _, _ = net.SplitHostPort(r.RemoteAddr)
-			if len(ip) == 0 {
-				ip = "unknown"
-			}
-			ctx = context.WithValue(r.Context(), contextUserKey, ip)
-		} else {
-			ctx = context.WithValue(r.Context(), contextUserKey, ip)
+			ip = nil
 		}
+		ctx := context.WithValue(r.Context(), contextUserKey, ip)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func getIP(r *http.Request) (string, error) {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return "unknown", err
-	}
+func (app *application) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.Session.Exists(r.Context(), "user") {
+			// remember where the user was going, so that Login can send them back
+			if r.Method == http.MethodGet {
+				app.Session.Put(r.Context(), "return_to", r.URL.RequestURI())
+			}
+			app.Session.Put(r.Context(), "error", "log in first")
+			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	userIP := net.ParseIP(ip)
-	if userIP == nil {
-		return "", fmt.Errorf("userip: %q is not IP:port", r.RemoteAddr)
+// authorize returns middleware that only lets through logged in users for
+// whom allowed returns true, and shows everyone else the forbidden page. It
+// must be used after auth.
+func (app *application) authorize(allowed func(user data.User) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := app.Session.Get(r.Context(), "user").(data.User)
+			if !ok || !allowed(user) {
+				app.clientError(w, r, http.StatusForbidden, "You are not authorized to view this page.")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
 	}
-	forward := r.Header.Get("X-Forwarded-For")
+}
 
-	if len(forward) > 0 {
-		ip = forward
-	}
-	if len(ip) == 0 {
-		ip = "forward"
+// requireAdmin only lets administrators through.
+func (app *application) requireAdmin(next http.Handler) http.Handler {
+	return app.authorize(func(user data.User) bool {
+		return user.IsAdmin
+	})(next)
+}
+
+// safeReturnTo reports whether returnTo is a path on this site, so that Login
+// cannot be used to redirect users elsewhere.
+func safeReturnTo(returnTo string) bool {
+	return strings.HasPrefix(returnTo, "/") &&
+		!strings.HasPrefix(returnTo, "//") &&
+		!strings.HasPrefix(returnTo, "/\\")
+}
+
+// trackSession keeps the IP address and last seen time of logged in sessions
+// up to date, for listing on the active sessions page, and makes sure they
+// are in their user's session index.
+func (app *application) trackSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.Session.Exists(r.Context(), "user") {
+			lastSeen := time.Unix(app.Session.GetInt64(r.Context(), "last_seen"), 0)
+			if time.Since(lastSeen) > lastSeenInterval {
+				app.Session.Put(r.Context(), "last_seen", time.Now().Unix())
+				app.Session.Put(r.Context(), "ip", app.ipStringFromContext(r.Context()))
+
+				// sessions from before the index existed list themselves
+				if user, ok := app.Session.Get(r.Context(), "user").(data.User); ok {
+					if err := app.indexSession(user.ID, app.Session.Token(r.Context())); err != nil {
+						app.serverError(w, r, err)
+						return
+					}
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+const (
+	// csrfSessionKey is the session key the synchronizer token is stored under.
+	csrfSessionKey = "csrf_token"
+	// csrfFieldName is the name of the hidden form input carrying the token.
+	csrfFieldName = "csrf_token"
+	// csrfHeaderName is checked when the token is not posted in the form.
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// csrfToken returns the CSRF token for the current session, generating and
+// storing one if the session does not have one yet.
+func (app *application) csrfToken(ctx context.Context) string {
+	token := app.Session.GetString(ctx, csrfSessionKey)
+	if token != "" {
+		return token
 	}
 
-	return ip, nil
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	token = base64.RawURLEncoding.EncodeToString(b)
+	app.Session.Put(ctx, csrfSessionKey, token)
+	return token
 }
 
-func (app *application) auth(next http.Handler) http.Handler {
+// csrf rejects any state changing request whose token, posted as a form field
+// or sent as a header, does not match the one stored in the session.
+func (app *application) csrf(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !app.Session.Exists(r.Context(), "user") {
-			app.Session.Put(r.Context(), "error", "log in first")
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := app.Session.GetString(r.Context(), csrfSessionKey)
+
+		actual := r.Header.Get(csrfHeaderName)
+		if actual == "" {
+			actual = r.PostFormValue(csrfFieldName)
 		}
+
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+			app.clientError(w, r, http.StatusForbidden, "Your session has expired or the form was tampered with. Please go back, reload the page and try again.")
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
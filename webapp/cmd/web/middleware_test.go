@@ -2,43 +2,51 @@ package main
 
 import (
 	"context"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"webapp/pkg/data"
 )
 
 func Test_application_addIPToContext(t *testing.T) {
 	tests := []struct {
+		name        string
 		headerName  string
 		headerValue string
 		addr        string
 		emptyAddr   bool
+		trusted     string
+		expectedIP  string
 	}{
-		{"", "", "", false},
-		{"", "", "", true},
-		{"X-Forwarded-For", "192.3.2.1", "", false},
-		{"", "", "hello:world", false},
+		{"remote address", "", "", "", false, "", "192.0.2.1"},
+		{"empty address", "", "", "", true, "", ""},
+		{"untrusted forwarded for", "X-Forwarded-For", "192.3.2.1", "", false, "", "192.0.2.1"},
+		{"trusted forwarded for", "X-Forwarded-For", "192.3.2.1", "", false, "192.0.2.0/24", "192.3.2.1"},
+		{"bad address", "", "", "hello:world", false, "", ""},
 	}
 
 	// create a dummy handler that we'll use to check the context
 
+	var gotIP net.IP
 	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// make sure that the value exists in the context
 		val := r.Context().Value(contextUserKey)
-		if val == nil {
-			t.Error(contextUserKey, "not present")
-		}
 
-		// make sure we got a string back
-		ip, ok := val.(string)
+		// make sure we got a net.IP back
+		ip, ok := val.(net.IP)
 		if !ok {
-			t.Error("not string")
+			t.Error("not net.IP")
 		}
-		t.Log(ip)
+		gotIP = ip
 	})
 
 	for _, test := range tests {
+		app.TrustedProxies, _ = parseTrustedProxies(test.trusted)
+
 		// create the handler to test
 		handlerToTest := app.addIPToContext(nextHandler)
 
@@ -57,23 +65,43 @@ func Test_application_addIPToContext(t *testing.T) {
 			req.RemoteAddr = test.addr
 		}
 
+		gotIP = nil
 		handlerToTest.ServeHTTP(httptest.NewRecorder(), req)
+
+		if test.expectedIP == "" && gotIP != nil {
+			t.Errorf("%s: expected no IP but got %s", test.name, gotIP)
+		}
+		if test.expectedIP != "" && !gotIP.Equal(net.ParseIP(test.expectedIP)) {
+			t.Errorf("%s: expected %s but got %s", test.name, test.expectedIP, gotIP)
+		}
 	}
+	app.TrustedProxies = nil
 }
 
 func Test_application_ipFromContext(t *testing.T) {
 	var ctx = context.Background()
-	ctx = context.WithValue(ctx, contextUserKey, "127.0.0.1")
+	ctx = context.WithValue(ctx, contextUserKey, net.ParseIP("127.0.0.1"))
 	ip := app.ipFromContext(ctx)
 
-	if ip != "127.0.0.1" {
+	if !ip.Equal(net.ParseIP("127.0.0.1")) {
 		t.Errorf("Expected %s but got %s", "127.0.0.1", ip)
 	}
+	if app.ipStringFromContext(ctx) != "127.0.0.1" {
+		t.Errorf("Expected %s but got %s", "127.0.0.1", app.ipStringFromContext(ctx))
+	}
+
+	if app.ipFromContext(context.Background()) != nil {
+		t.Error("expected nil IP from a context without one")
+	}
+	if app.ipStringFromContext(context.Background()) != "unknown" {
+		t.Errorf("expected unknown but got %s", app.ipStringFromContext(context.Background()))
+	}
 }
 
 func Test_app_auth(t *testing.T) {
+	nextCalled := false
 	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
+		nextCalled = true
 	})
 	var tests = []struct {
 		name   string
@@ -84,8 +112,9 @@ func Test_app_auth(t *testing.T) {
 	}
 
 	for _, e := range tests {
+		nextCalled = false
 		handlerToTest := app.auth(nextHandler)
-		req := httptest.NewRequest("GET", "http://testing", nil)
+		req := httptest.NewRequest("GET", "http://testing/user/profile?tab=1", nil)
 		req = addContextAndSessionToRequest(req, app)
 		if e.isAuth {
 			app.Session.Put(req.Context(), "user", data.User{ID: 1})
@@ -98,5 +127,154 @@ func Test_app_auth(t *testing.T) {
 		if !e.isAuth && rr.Code != http.StatusTemporaryRedirect {
 			t.Errorf("%s: exptected status code %d but got %d", e.name, http.StatusTemporaryRedirect, rr.Code)
 		}
+		if nextCalled != e.isAuth {
+			t.Errorf("%s: expected next handler called to be %t but got %t", e.name, e.isAuth, nextCalled)
+		}
+		if !e.isAuth && app.Session.GetString(req.Context(), "return_to") != "/user/profile?tab=1" {
+			t.Errorf("%s: expected return to URL to be saved but got %q", e.name, app.Session.GetString(req.Context(), "return_to"))
+		}
+	}
+}
+
+func Test_app_requireAdmin(t *testing.T) {
+	nextCalled := false
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextCalled = true
+	})
+
+	var tests = []struct {
+		name               string
+		user               *data.User
+		expectedStatusCode int
+	}{
+		{"admin", &data.User{ID: 1, IsAdmin: true}, http.StatusOK},
+		{"not admin", &data.User{ID: 2}, http.StatusForbidden},
+		{"not logged in", nil, http.StatusForbidden},
+	}
+
+	for _, e := range tests {
+		nextCalled = false
+		handlerToTest := app.requireAdmin(nextHandler)
+		req := httptest.NewRequest("GET", "/admin/", nil)
+		req = addContextAndSessionToRequest(req, app)
+		if e.user != nil {
+			app.Session.Put(req.Context(), "user", *e.user)
+		}
+		rr := httptest.NewRecorder()
+		handlerToTest.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if nextCalled != (e.expectedStatusCode == http.StatusOK) {
+			t.Errorf("%s: next handler called when it should not have been, or vice versa", e.name)
+		}
+		if rr.Code == http.StatusForbidden && !strings.Contains(rr.Body.String(), "not authorized") {
+			t.Errorf("%s: expected the forbidden page to be rendered", e.name)
+		}
+	}
+}
+
+func Test_safeReturnTo(t *testing.T) {
+	var tests = []struct {
+		returnTo string
+		safe     bool
+	}{
+		{"/user/profile", true},
+		{"/user/profile?tab=1", true},
+		{"", false},
+		{"https://evil.com", false},
+		{"//evil.com", false},
+		{"/\\evil.com", false},
+	}
+
+	for _, e := range tests {
+		if safeReturnTo(e.returnTo) != e.safe {
+			t.Errorf("%q: expected safe to be %t", e.returnTo, e.safe)
+		}
+	}
+}
+
+func Test_app_csrf(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	})
+
+	var tests = []struct {
+		name               string
+		method             string
+		token              string
+		sendTokenIn        string
+		expectedStatusCode int
+	}{
+		{"get without token", http.MethodGet, "", "", http.StatusOK},
+		{"post without token", http.MethodPost, "", "", http.StatusForbidden},
+		{"post with wrong token", http.MethodPost, "wrong", "form", http.StatusForbidden},
+		{"post with form token", http.MethodPost, "", "form", http.StatusOK},
+		{"post with header token", http.MethodPost, "", "header", http.StatusOK},
+	}
+
+	for _, e := range tests {
+		handlerToTest := app.csrf(nextHandler)
+
+		req := httptest.NewRequest(e.method, "/login", nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		// an empty token means send the valid one from the session
+		token := e.token
+		if token == "" {
+			token = app.csrfToken(req.Context())
+		}
+
+		postedData := url.Values{}
+		switch e.sendTokenIn {
+		case "form":
+			postedData.Add("csrf_token", token)
+		case "header":
+			req.Header.Set("X-CSRF-Token", token)
+		}
+		req.Body = io.NopCloser(strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rr := httptest.NewRecorder()
+		handlerToTest.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status code %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if rr.Code == http.StatusForbidden && !strings.Contains(rr.Body.String(), "Forbidden") {
+			t.Errorf("%s: expected the forbidden page to be rendered", e.name)
+		}
+	}
+}
+
+func Test_app_csrfToken(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req = addContextAndSessionToRequest(req, app)
+
+	token := app.csrfToken(req.Context())
+	if len(token) == 0 {
+		t.Fatal("expected a token to be generated")
+	}
+	if app.csrfToken(req.Context()) != token {
+		t.Error("expected the same token to be returned for the same session")
+	}
+}
+
+func Test_app_trackSession(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	handlerToTest := app.trackSession(nextHandler)
+	handlerToTest.ServeHTTP(httptest.NewRecorder(), req)
+
+	if app.Session.GetInt64(req.Context(), "last_seen") == 0 {
+		t.Error("expected last seen to be recorded for a logged in session")
+	}
+	if app.Session.GetString(req.Context(), "ip") != "127.0.0.1" {
+		t.Errorf("expected ip to be recorded but got %s", app.Session.GetString(req.Context(), "ip"))
 	}
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// purgeDeletedUsers permanently removes users deleted more than
+// app.DeletedUserRetention ago, straight away and then every interval, until
+// ctx is done.
+func (app *application) purgeDeletedUsers(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := app.DB.PurgeDeletedUsers(time.Now().Add(-app.DeletedUserRetention))
+		if err != nil {
+			log.Println("purging deleted users:", err)
+		} else if n > 0 {
+			log.Printf("purged %d deleted users", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
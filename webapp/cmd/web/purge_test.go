@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_app_purgeDeletedUsers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		app.purgeDeletedUsers(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	// let it purge a few times before stopping it
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("purgeDeletedUsers did not return once its context was done")
+	}
+}
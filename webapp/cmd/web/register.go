@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+	"webapp/pkg/verifyemail"
+)
+
+func (app *application) RegisterPage(w http.ResponseWriter, r *http.Request) {
+	_ = app.render(w, r, "register.page.gohtml", &TemplateData{Form: NewForm(nil)})
+}
+
+// Register creates an unverified user and emails them a link to verify their
+// address. Registering again with an address that is still unverified
+// replaces the name and password and sends a new link, so a lost or expired
+// link isn't a dead end, and whoever registered first can't keep an account
+// they never proved was theirs. The links sent before stop working, so
+// nobody can verify the account with someone else's password.
+func (app *application) Register(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		app.clientError(w, r, http.StatusBadRequest, "The request could not be understood.")
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("first_name", "last_name", "email", "password", "confirm_password")
+	form.MaxLength("first_name", 255)
+	form.MaxLength("last_name", 255)
+	form.MaxLength("email", 255)
+	form.Email("email")
+	form.MinLength("password", 6)
+	form.EqualTo("confirm_password", "password")
+
+	var input userForm
+	if err := form.Bind(&input); err != nil {
+		_ = app.render(w, r, "register.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	user, err := app.db(r).GetUserByEmail(input.Email)
+	switch {
+	case err == nil && user.EmailVerified:
+		form.Errors.Add("email", "This email address is already in use")
+		_ = app.render(w, r, "register.page.gohtml", &TemplateData{Form: form})
+		return
+	case err == nil:
+		user.FirstName = input.FirstName
+		user.LastName = input.LastName
+		err = app.db(r).WithTx(func(tx repository.DatabaseRepo) error {
+			if err := tx.UpdateUser(*user); err != nil {
+				return err
+			}
+			return tx.ResetPassword(user.ID, input.Password)
+		})
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		// the update moved the version on, voiding the links sent before
+		user.Version++
+	default:
+		user = &data.User{
+			FirstName: input.FirstName,
+			LastName:  input.LastName,
+			Email:     input.Email,
+			Password:  input.Password,
+			// the version every new user starts at
+			Version: 1,
+		}
+		user.ID, err = app.db(r).InsertUser(*user)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	err = app.verifier().Send(r.Context(), user)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Thanks for registering! Check your email for a link to verify your address.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// VerifyEmail handles the signed link sent by verifier, if it is the latest
+// one the user was sent.
+func (app *application) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	const invalid = "This verification link is invalid or has expired. Register again to be sent a new one."
+
+	if err := app.Signer.Verify(r.URL.RequestURI()); err != nil {
+		app.clientError(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	user, err := app.db(r).GetUserByEmail(r.URL.Query().Get("email"))
+	if err != nil {
+		app.clientError(w, r, http.StatusBadRequest, invalid)
+		return
+	}
+
+	if !user.EmailVerified {
+		if !verifyemail.Current(r.URL.Query(), user) {
+			app.clientError(w, r, http.StatusBadRequest, invalid)
+			return
+		}
+		err = app.db(r).VerifyUserEmail(user.ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your email address is verified; you can now log in")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// verifier sends links to VerifyEmail, with the app's mail settings.
+func (app *application) verifier() verifyemail.Sender {
+	return verifyemail.Sender{
+		Signer:    app.Signer,
+		Templates: app.MailTemplates,
+		Mailer:    app.Mailer,
+		From:      app.MailFrom,
+		WebURL:    app.BaseURL,
+	}
+}
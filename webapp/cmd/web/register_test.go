@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/mail"
+	"webapp/pkg/repository/dbrepo"
+)
+
+// sentMail returns every message written by the test mailer, oldest first,
+// as its To header followed by its decoded plain text body, and removes them.
+func sentMail(t *testing.T) []string {
+	dir := app.Mailer.(mail.FileMailer).Dir
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	var messages []string
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		contents, _ := os.ReadFile(path)
+		_ = os.Remove(path)
+
+		msg, err := netmail.ReadMessage(bytes.NewReader(contents))
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name(), err)
+		}
+		body := io.Reader(quotedprintable.NewReader(msg.Body))
+		if _, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type")); err == nil && params["boundary"] != "" {
+			// the plain text version comes first, and the part reader
+			// decodes it
+			part, err := multipart.NewReader(msg.Body, params["boundary"]).NextPart()
+			if err != nil {
+				t.Fatalf("%s: %s", f.Name(), err)
+			}
+			body = part
+		}
+		text, _ := io.ReadAll(body)
+		messages = append(messages, "To: "+msg.Header.Get("To")+"\n\n"+string(text))
+	}
+	return messages
+}
+
+var verifyLink = regexp.MustCompile(`http://localhost:8080/verify-email\S+`)
+
+func Test_app_Register(t *testing.T) {
+	var tests = []struct {
+		name               string
+		postedData         url.Values
+		expectedStatusCode int
+		expectedHTML       string
+		expectMailTo       string
+	}{
+		{
+			name: "new user",
+			postedData: url.Values{
+				"first_name":       {"Jack"},
+				"last_name":        {"Smith"},
+				"email":            {"jack@example.com"},
+				"password":         {"secret"},
+				"confirm_password": {"secret"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectMailTo:       "jack@example.com",
+		},
+		{
+			name: "unverified user registering again",
+			postedData: url.Values{
+				"first_name":       {"New"},
+				"last_name":        {"User"},
+				"email":            {"unverified@example.com"},
+				"password":         {"secret"},
+				"confirm_password": {"secret"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectMailTo:       "unverified@example.com",
+		},
+		{
+			name: "email in use",
+			postedData: url.Values{
+				"first_name":       {"Admin"},
+				"last_name":        {"User"},
+				"email":            {"admin@example.com"},
+				"password":         {"secret"},
+				"confirm_password": {"secret"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "This email address is already in use",
+		},
+		{
+			name: "invalid",
+			postedData: url.Values{
+				"first_name":       {"Jack"},
+				"last_name":        {""},
+				"email":            {"jack.example.com"},
+				"password":         {"abc"},
+				"confirm_password": {"abc"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedHTML:       "Invalid email address",
+		},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(e.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.Register)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+		if e.expectedHTML != "" && !strings.Contains(rr.Body.String(), e.expectedHTML) {
+			t.Errorf("%s: did not find %s in response body", e.name, e.expectedHTML)
+		}
+
+		messages := sentMail(t)
+		if e.expectMailTo == "" {
+			if len(messages) != 0 {
+				t.Errorf("%s: expected no email but %d were sent", e.name, len(messages))
+			}
+			continue
+		}
+		if len(messages) != 1 {
+			t.Errorf("%s: expected 1 email but %d were sent", e.name, len(messages))
+			continue
+		}
+		if !strings.Contains(messages[0], "To: "+e.expectMailTo) || !verifyLink.MatchString(messages[0]) {
+			t.Errorf("%s: expected a verification link sent to %s, got:\n%s", e.name, e.expectMailTo, messages[0])
+		}
+	}
+}
+
+func Test_app_VerifyEmail(t *testing.T) {
+	valid, _ := app.Signer.Sign("http://localhost:8080/verify-email?email=unverified%40example.com&version=1", time.Now().Add(time.Hour))
+	expired, _ := app.Signer.Sign("http://localhost:8080/verify-email?email=unverified%40example.com&version=1", time.Now().Add(-time.Hour))
+	stale, _ := app.Signer.Sign("http://localhost:8080/verify-email?email=unverified%40example.com&version=0", time.Now().Add(time.Hour))
+	unknown, _ := app.Signer.Sign("http://localhost:8080/verify-email?email=nobody%40example.com&version=1", time.Now().Add(time.Hour))
+
+	var tests = []struct {
+		name               string
+		link               string
+		expectedStatusCode int
+	}{
+		{"valid", valid, http.StatusSeeOther},
+		{"tampered", strings.Replace(valid, "unverified", "admin", 1), http.StatusBadRequest},
+		{"unsigned", "http://localhost:8080/verify-email?email=unverified%40example.com&version=1", http.StatusBadRequest},
+		{"expired", expired, http.StatusBadRequest},
+		{"sent before the user changed", stale, http.StatusBadRequest},
+		{"unknown user", unknown, http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		req, _ := http.NewRequest("GET", e.link, nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(app.VerifyEmail)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: wrong status code; expected %d but got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
+
+// registerForLink registers jack@example.com with password on memApp, and
+// returns the verification link it emailed.
+func registerForLink(t *testing.T, memApp application, password string) string {
+	t.Helper()
+
+	postedData := url.Values{
+		"first_name":       {"Jack"},
+		"last_name":        {"Smith"},
+		"email":            {"jack@example.com"},
+		"password":         {password},
+		"confirm_password": {password},
+	}
+	req, _ := http.NewRequest("POST", "/register", strings.NewReader(postedData.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = addContextAndSessionToRequest(req, memApp)
+	http.HandlerFunc(memApp.Register).ServeHTTP(httptest.NewRecorder(), req)
+
+	messages := sentMail(t)
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 email but %d were sent", len(messages))
+	}
+	return verifyLink.FindString(messages[0])
+}
+
+// followLink follows a verification link on memApp, and returns the status.
+func followLink(memApp application, link string) int {
+	req, _ := http.NewRequest("GET", link, nil)
+	req = addContextAndSessionToRequest(req, memApp)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(memApp.VerifyEmail).ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func Test_app_RegisterThenVerify(t *testing.T) {
+	memApp := app
+	repo := dbrepo.NewMemoryDBRepo()
+	memApp.DB = repo
+
+	link := registerForLink(t, memApp, "secret")
+	if code := followLink(memApp, link); code != http.StatusSeeOther {
+		t.Errorf("following the emailed link returned %d; expected %d", code, http.StatusSeeOther)
+	}
+	if user, err := repo.GetUserByEmail("jack@example.com"); err != nil || !user.EmailVerified {
+		t.Errorf("expected the user to be verified; got %v, %v", user, err)
+	}
+}
+
+func Test_app_RegisterAgainVoidsOldLink(t *testing.T) {
+	memApp := app
+	repo := dbrepo.NewMemoryDBRepo()
+	memApp.DB = repo
+
+	// the first link goes to the owner of the address, and the second to
+	// them too; but whoever registered second chose the password
+	first := registerForLink(t, memApp, "owner-secret")
+	second := registerForLink(t, memApp, "other-secret")
+
+	if code := followLink(memApp, first); code != http.StatusBadRequest {
+		t.Errorf("following the first link returned %d; expected %d", code, http.StatusBadRequest)
+	}
+	if user, _ := repo.GetUserByEmail("jack@example.com"); user.EmailVerified {
+		t.Fatal("expected the first link not to verify the user")
+	}
+
+	if code := followLink(memApp, second); code != http.StatusSeeOther {
+		t.Errorf("following the second link returned %d; expected %d", code, http.StatusSeeOther)
+	}
+	if user, _ := repo.GetUserByEmail("jack@example.com"); !user.EmailVerified {
+		t.Error("expected the second link to verify the user")
+	}
+}
+
+func Test_app_RegisterTwice(t *testing.T) {
+	memApp := app
+	repo := dbrepo.NewMemoryDBRepo()
+	memApp.DB = repo
+
+	for _, e := range []struct{ firstName, password string }{{"First", "first-secret"}, {"Jack", "second-secret"}} {
+		postedData := url.Values{
+			"first_name":       {e.firstName},
+			"last_name":        {"Smith"},
+			"email":            {"jack@example.com"},
+			"password":         {e.password},
+			"confirm_password": {e.password},
+		}
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, memApp)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memApp.Register).ServeHTTP(rr, req)
+		if rr.Code != http.StatusSeeOther {
+			t.Fatalf("registering as %s returned %d; expected %d", e.firstName, rr.Code, http.StatusSeeOther)
+		}
+	}
+	sentMail(t)
+
+	user, err := repo.GetUserByEmail("jack@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FirstName != "Jack" {
+		t.Errorf("expected the second registration's name, got %s", user.FirstName)
+	}
+	_ = repo.VerifyUserEmail(user.ID)
+
+	var tests = []struct {
+		name        string
+		password    string
+		expectedLoc string
+	}{
+		{"second password", "second-secret", "/user/profile"},
+		{"first password", "first-secret", "/"},
+	}
+
+	for _, e := range tests {
+		resetDB()
+
+		postedData := url.Values{"email": {"jack@example.com"}, "password": {e.password}}
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, memApp)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(memApp.Login).ServeHTTP(rr, req)
+		if loc := rr.Header().Get("Location"); loc != e.expectedLoc {
+			t.Errorf("%s: expected logging in to redirect to %s, got %s", e.name, e.expectedLoc, loc)
+		}
+	}
+}
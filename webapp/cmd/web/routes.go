@@ -13,16 +13,50 @@ func (app *application) routes() http.Handler {
 	mux.Use(middleware.Recoverer)
 	mux.Use(app.addIPToContext)
 	mux.Use(app.Session.LoadAndSave)
+	mux.Use(app.recoverPanic)
+	mux.Use(app.csrf)
+	mux.Use(app.trackSession)
+
+	mux.NotFound(app.NotFound)
+	mux.MethodNotAllowed(app.MethodNotAllowed)
 
 	// register routes
 	mux.Get("/", app.Home)
 	mux.Post("/login", app.Login)
+	mux.Post("/logout", app.Logout)
+	mux.Get("/register", app.RegisterPage)
+	mux.Post("/register", app.Register)
+	mux.Get("/verify-email", app.VerifyEmail)
 
 	mux.Route("/user", func(mux chi.Router) {
 		mux.Use(app.auth)
 		mux.Get("/profile", app.Profile)
+		mux.Post("/profile", app.UpdateProfile)
 		mux.Post("/upload-profile-pic", app.UploadProfilePic)
+		mux.Get("/password", app.PasswordPage)
+		mux.Post("/password", app.ChangePassword)
+		mux.Post("/delete", app.DeleteAccount)
+		mux.Get("/sessions", app.Sessions)
+		mux.Post("/sessions/revoke", app.RevokeSession)
+		mux.Post("/sessions/revoke-others", app.RevokeOtherSessions)
 	})
+
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.auth)
+		mux.Use(app.requireAdmin)
+		mux.Get("/", app.AdminDashboard)
+		mux.Get("/users", app.AdminUsers)
+		mux.Get("/users/deleted", app.AdminDeletedUsers)
+		mux.Get("/users/new", app.AdminNewUser)
+		mux.Post("/users/new", app.AdminCreateUser)
+		mux.Get("/users/{id}", app.AdminEditUser)
+		mux.Post("/users/{id}", app.AdminUpdateUser)
+		mux.Post("/users/{id}/toggle-admin", app.AdminToggleAdmin)
+		mux.Post("/users/{id}/password", app.AdminResetPassword)
+		mux.Post("/users/{id}/delete", app.AdminDeleteUser)
+		mux.Post("/users/{id}/restore", app.AdminRestoreUser)
+	})
+
 	// static assets
 	fileServer := http.FileServer(http.Dir("./static/"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
@@ -15,6 +15,28 @@ func Test_application_routes(t *testing.T) {
 		{"/", "GET"},
 		{"/login", "POST"},
 		{"/user/profile", "GET"},
+		{"/user/profile", "POST"},
+		{"/logout", "POST"},
+		{"/register", "GET"},
+		{"/register", "POST"},
+		{"/verify-email", "GET"},
+		{"/user/password", "GET"},
+		{"/user/password", "POST"},
+		{"/user/delete", "POST"},
+		{"/user/sessions", "GET"},
+		{"/user/sessions/revoke", "POST"},
+		{"/user/sessions/revoke-others", "POST"},
+		{"/admin/", "GET"},
+		{"/admin/users", "GET"},
+		{"/admin/users/deleted", "GET"},
+		{"/admin/users/new", "GET"},
+		{"/admin/users/new", "POST"},
+		{"/admin/users/{id}", "GET"},
+		{"/admin/users/{id}", "POST"},
+		{"/admin/users/{id}/toggle-admin", "POST"},
+		{"/admin/users/{id}/password", "POST"},
+		{"/admin/users/{id}/delete", "POST"},
+		{"/admin/users/{id}/restore", "POST"},
 		{"/static/*", "GET"},
 	}
 
@@ -1,13 +1,54 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/alexedwards/scs/postgresstore"
 	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
 	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"webapp/pkg/data"
 )
 
-func getSession() *scs.SessionManager {
+// lastSeenInterval is how stale a session's last_seen time may get before
+// trackSession updates it, so that not every request rewrites the session.
+const lastSeenInterval = time.Minute
+
+// sessionCleanupInterval is how often expired sessions are deleted from the
+// postgres session store.
+var sessionCleanupInterval = 5 * time.Minute
+
+// newSessionStore returns the session store named by kind: "memory", which
+// loses every session when the server restarts, or "postgres", which keeps
+// them in the sessions table of db so they survive deploys and can be shared
+// between instances.
+func newSessionStore(kind string, db *sql.DB) (scs.Store, error) {
+	switch kind {
+	case "memory":
+		return memstore.New(), nil
+	case "postgres":
+		return postgresstore.NewWithCleanupInterval(db, sessionCleanupInterval), nil
+	default:
+		return nil, fmt.Errorf("unknown session store %q; expected memory or postgres", kind)
+	}
+}
+
+// getSession returns a session manager using store, or the in-memory store if
+// store is nil.
+func getSession(store scs.Store) *scs.SessionManager {
 	session := scs.New()
+	if store != nil {
+		session.Store = store
+	}
 	session.Lifetime = 24 * time.Hour
 	session.Cookie.Persist = true
 	session.Cookie.SameSite = http.SameSiteLaxMode
@@ -15,3 +56,190 @@ func getSession() *scs.SessionManager {
 
 	return session
 }
+
+// sessionInfo describes one of a user's logged in sessions.
+type sessionInfo struct {
+	ID        string
+	IP        string
+	UserAgent string
+	LastSeen  time.Time
+	Current   bool
+}
+
+// sessionIndexPrefix starts the store tokens under which each user's session
+// tokens are listed, so that their sessions can be found without decoding
+// every session in the store. Session tokens never contain a colon.
+const sessionIndexPrefix = "user-sessions:"
+
+// sessionIndexMu serializes changes to the session indexes, which are read,
+// changed and written back whole.
+var sessionIndexMu sync.Mutex
+
+// startSessionTracking gives a freshly logged in session a stable id, records
+// the device and IP it was created from, and adds it to userID's session
+// index.
+func (app *application) startSessionTracking(r *http.Request, userID int) error {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	app.Session.Put(r.Context(), "session_id", hex.EncodeToString(b))
+	app.Session.Put(r.Context(), "user_agent", r.UserAgent())
+	app.Session.Put(r.Context(), "ip", app.ipStringFromContext(r.Context()))
+	app.Session.Put(r.Context(), "last_seen", time.Now().Unix())
+	return app.indexSession(userID, app.Session.Token(r.Context()))
+}
+
+// sessionIndex returns the session tokens listed for userID. Call it with
+// sessionIndexMu held.
+func (app *application) sessionIndex(userID int) ([]string, error) {
+	b, found, err := app.Session.Store.Find(sessionIndexPrefix + strconv.Itoa(userID))
+	if err != nil || !found || len(b) == 0 {
+		return nil, err
+	}
+	return strings.Split(string(b), "\n"), nil
+}
+
+// saveSessionIndex replaces the session tokens listed for userID. The list
+// lasts as long as a session made now would, and so outlives every session in
+// it. Call it with sessionIndexMu held.
+func (app *application) saveSessionIndex(userID int, tokens []string) error {
+	key := sessionIndexPrefix + strconv.Itoa(userID)
+	if len(tokens) == 0 {
+		return app.Session.Store.Delete(key)
+	}
+	return app.Session.Store.Commit(key, []byte(strings.Join(tokens, "\n")), time.Now().Add(app.Session.Lifetime))
+}
+
+// indexSession lists token among userID's sessions, if it is not there yet.
+// Sessions that have never been saved have no token, and are left out.
+func (app *application) indexSession(userID int, token string) error {
+	if token == "" {
+		return nil
+	}
+
+	sessionIndexMu.Lock()
+	defer sessionIndexMu.Unlock()
+
+	tokens, err := app.sessionIndex(userID)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(tokens, token) {
+		return nil
+	}
+	return app.saveSessionIndex(userID, append(tokens, token))
+}
+
+// storedSession is a session as it was last saved to the store.
+type storedSession struct {
+	token  string
+	values map[string]any
+}
+
+// str returns the string stored under key, or "".
+func (s storedSession) str(key string) string {
+	v, _ := s.values[key].(string)
+	return v
+}
+
+// indexedSessions reads the sessions listed for userID from the store,
+// dropping those that have expired or been destroyed from the list.
+func (app *application) indexedSessions(userID int) ([]storedSession, error) {
+	sessionIndexMu.Lock()
+	defer sessionIndexMu.Unlock()
+
+	tokens, err := app.sessionIndex(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []storedSession
+	var live []string
+	for _, token := range tokens {
+		b, found, err := app.Session.Store.Find(token)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		_, values, err := app.Session.Codec.Decode(b)
+		if err != nil {
+			return nil, err
+		}
+		if user, ok := values["user"].(data.User); !ok || user.ID != userID {
+			continue
+		}
+		live = append(live, token)
+		sessions = append(sessions, storedSession{token: token, values: values})
+	}
+
+	if len(live) != len(tokens) {
+		if err := app.saveSessionIndex(userID, live); err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+// userSessions returns the active sessions belonging to userID, most recently
+// seen first. The session in ctx is marked as current.
+func (app *application) userSessions(ctx context.Context, userID int) ([]sessionInfo, error) {
+	currentID := app.Session.GetString(ctx, "session_id")
+
+	stored, err := app.indexedSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]sessionInfo, 0, len(stored))
+	for _, s := range stored {
+		lastSeen, _ := s.values["last_seen"].(int64)
+		sessions = append(sessions, sessionInfo{
+			ID:        s.str("session_id"),
+			IP:        s.str("ip"),
+			UserAgent: s.str("user_agent"),
+			LastSeen:  time.Unix(lastSeen, 0),
+			Current:   s.str("session_id") == currentID,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+// destroyUserSessions destroys the sessions belonging to userID for which
+// match returns true, and reports how many were destroyed. It never touches the
+// session in ctx; callers that want it gone should destroy it themselves.
+func (app *application) destroyUserSessions(ctx context.Context, userID int, match func(sessionID string) bool) (int, error) {
+	currentToken := app.Session.Token(ctx)
+
+	stored, err := app.indexedSessions(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	destroyed := 0
+	for _, s := range stored {
+		if s.token == currentToken || !match(s.str("session_id")) {
+			continue
+		}
+		if err := app.Session.Store.Delete(s.token); err != nil {
+			return destroyed, err
+		}
+		destroyed++
+	}
+	return destroyed, nil
+}
+
+// logoutEverywhere destroys every session belonging to userID, including the
+// one in ctx.
+func (app *application) logoutEverywhere(ctx context.Context, userID int) error {
+	_, err := app.destroyUserSessions(ctx, userID, func(string) bool { return true })
+	if err != nil {
+		return err
+	}
+	return app.Session.Destroy(ctx)
+}
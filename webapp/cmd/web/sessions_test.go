@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"github.com/alexedwards/scs/v2/memstore"
+	"testing"
+	"webapp/pkg/data"
+)
+
+func Test_newSessionStore(t *testing.T) {
+	store, err := newSessionStore("memory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*memstore.MemStore); !ok {
+		t.Errorf("expected a memory store but got %T", store)
+	}
+
+	_, err = newSessionStore("redis", nil)
+	if err == nil {
+		t.Error("expected error for unknown session store but did not get one")
+	}
+
+	session := getSession(store)
+	if session.Store != store {
+		t.Error("session manager is not using the given store")
+	}
+}
+
+func Test_app_sessionIndex(t *testing.T) {
+	first := addStoredSession(t, 7, "first")
+	second := addStoredSession(t, 7, "second")
+	other := addStoredSession(t, 8, "other")
+	defer app.Session.Store.Delete(second)
+	defer app.Session.Store.Delete(other)
+
+	// a session missing from the index is not found by looking through the
+	// whole store
+	ctx, _ := app.Session.Load(context.Background(), "")
+	app.Session.Put(ctx, "user", data.User{ID: 7})
+	app.Session.Put(ctx, "session_id", "unindexed")
+	unindexed, _, _ := app.Session.Commit(ctx)
+	defer app.Session.Store.Delete(unindexed)
+
+	_ = app.Session.Store.Delete(first)
+
+	current, _ := app.Session.Load(context.Background(), "")
+	sessions, err := app.userSessions(current, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "second" {
+		t.Errorf("expected only the second session, got %+v", sessions)
+	}
+
+	sessionIndexMu.Lock()
+	tokens, _ := app.sessionIndex(7)
+	sessionIndexMu.Unlock()
+	if len(tokens) != 1 || tokens[0] != second {
+		t.Errorf("expected the deleted session to be dropped from the index, got %v", tokens)
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"encoding/gob"
+	"log"
 	"os"
 	"testing"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/mail"
 	"webapp/pkg/repository/dbrepo"
+	"webapp/pkg/urlsigner"
 )
 
 var app application
@@ -11,9 +17,38 @@ var app application
 // This will be executed before all the tests
 // We can use it to run setup before the tests run
 func TestMain(m *testing.M) {
+	gob.Register(data.User{})
 	pathToTemplates = "./../../templates/"
-	app.Session = getSession()
-	app.DB = &dbrepo.TestDBRepo{}
+	templates, err := newTemplateStore(os.DirFS(pathToTemplates))
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Templates = templates
+	app.Session = getSession(nil)
+	resetDB()
 
-	os.Exit(m.Run())
+	mailDir, err := os.MkdirTemp("", "webapp-mail")
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Mailer = mail.FileMailer{Dir: mailDir}
+	app.MailTemplates, err = mail.NewTemplates(os.DirFS(pathToTemplates + "mail"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.MailFrom = "no-reply@example.com"
+	app.BaseURL = "http://localhost:8080"
+	app.Signer = urlsigner.Signer{Secret: []byte("verysecret")}
+	app.DeletedUserRetention = 30 * 24 * time.Hour
+
+	code := m.Run()
+	_ = os.RemoveAll(mailDir)
+	os.Exit(code)
+}
+
+// resetDB gives app a fresh copy of the test users, so that what one test
+// writes is not seen by the next. Tests that write call it first, and table
+// tests call it for each case.
+func resetDB() {
+	app.DB = dbrepo.NewTestMemoryDBRepo()
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// assetVersion is appended to asset URLs so that browsers fetch fresh copies
+// after every restart.
+var assetVersion = strconv.FormatInt(time.Now().Unix(), 10)
+
+// functions are available to every template.
+var functions = template.FuncMap{
+	"humanDate":  humanDate,
+	"asset":      asset,
+	"csrfField":  csrfField,
+	"formValue":  formValue,
+	"fieldError": fieldError,
+	"invalid":    invalid,
+}
+
+// humanDate formats t for display, or returns an empty string for the zero time.
+func humanDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("02 Jan 2006 at 15:04")
+}
+
+// asset returns the URL of a file in the static directory.
+func asset(name string) string {
+	return "/static/" + strings.TrimPrefix(name, "/") + "?v=" + assetVersion
+}
+
+// csrfField renders the hidden input carrying a form's CSRF token.
+func csrfField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfFieldName + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
+
+// templateCache maps the name of each page template to the page parsed
+// together with every layout and partial.
+type templateCache map[string]*template.Template
+
+// newTemplateCache parses every *.page.gohtml in fsys, along with all of the
+// *.layout.gohtml and *.partial.gohtml files, which pages may use.
+func newTemplateCache(fsys fs.FS) (templateCache, error) {
+	cache := templateCache{}
+
+	pages, err := fs.Glob(fsys, "*.page.gohtml")
+	if err != nil {
+		return nil, err
+	}
+
+	var shared []string
+	for _, pattern := range []string{"*.layout.gohtml", "*.partial.gohtml"} {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		shared = append(shared, matches...)
+	}
+
+	for _, page := range pages {
+		ts, err := template.New(page).Funcs(functions).ParseFS(fsys, append([]string{page}, shared...)...)
+		if err != nil {
+			return nil, err
+		}
+		cache[page] = ts
+	}
+
+	return cache, nil
+}
+
+// templateStore holds the template cache, and can reload it when the
+// templates change on disk during development.
+type templateStore struct {
+	mu    sync.RWMutex
+	fsys  fs.FS
+	cache templateCache
+}
+
+// newTemplateStore parses the templates in fsys.
+func newTemplateStore(fsys fs.FS) (*templateStore, error) {
+	cache, err := newTemplateCache(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &templateStore{fsys: fsys, cache: cache}, nil
+}
+
+// Lookup returns the parsed page template called name.
+func (ts *templateStore) Lookup(name string) (*template.Template, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	t, ok := ts.cache[name]
+	if !ok {
+		return nil, fmt.Errorf("the template %s does not exist", name)
+	}
+	return t, nil
+}
+
+// Reload parses the templates again. If they fail to parse, the previous
+// cache is kept, so that a typo does not take down every page.
+func (ts *templateStore) Reload() error {
+	cache, err := newTemplateCache(ts.fsys)
+	if err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	ts.cache = cache
+	ts.mu.Unlock()
+	return nil
+}
+
+// reloader is anything that can parse its templates again, such as the mail
+// templates, which live in a subdirectory of the page templates.
+type reloader interface {
+	Reload() error
+}
+
+// Watch polls dir and its subdirectories every interval, and reloads the
+// templates, and then each of others, whenever a file in them is added,
+// removed or modified, until stop is closed.
+func (ts *templateStore) Watch(dir string, interval time.Duration, stop <-chan struct{}, others ...reloader) {
+	last := dirSnapshot(dir)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			current := dirSnapshot(dir)
+			if current == last {
+				continue
+			}
+			last = current
+
+			reloaded := true
+			for _, r := range append([]reloader{ts}, others...) {
+				if err := r.Reload(); err != nil {
+					log.Println("Error reloading templates:", err)
+					reloaded = false
+				}
+			}
+			if reloaded {
+				log.Println("Reloaded templates")
+			}
+		}
+	}
+}
+
+// dirSnapshot summarises the names, sizes and modification times of the
+// templates in dir and its subdirectories, so that two snapshots differ if any
+// template changed.
+func dirSnapshot(dir string) string {
+	var b strings.Builder
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || filepath.Ext(path) != ".gohtml" {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", filepath.ToSlash(rel), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return ""
+	}
+	return b.String()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"webapp/templates"
+)
+
+func Test_newTemplateCache(t *testing.T) {
+	cache, err := newTemplateCache(templates.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every page on disk should be embedded and parsed
+	pages, _ := fs.Glob(os.DirFS(pathToTemplates), "*.page.gohtml")
+	if len(pages) == 0 {
+		t.Fatal("no pages found on disk")
+	}
+	for _, page := range pages {
+		if _, ok := cache[page]; !ok {
+			t.Errorf("page %s is missing from the cache", page)
+		}
+	}
+
+	// layouts and partials are not pages
+	if _, ok := cache["base.layout.gohtml"]; ok {
+		t.Error("layouts should not be cached as pages")
+	}
+}
+
+func Test_templateStore_Reload(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "base.layout.gohtml", `{{define "base"}}{{block "content" .}}{{end}}{{end}}`)
+	writeTemplate(t, dir, "test.page.gohtml", `{{template "base" .}}{{define "content"}}before{{end}}`)
+
+	ts, err := newTemplateStore(os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := dirSnapshot(dir)
+	writeTemplate(t, dir, "test.page.gohtml", `{{template "base" .}}{{define "content"}}after!{{end}}`)
+	if dirSnapshot(dir) == before {
+		t.Error("expected the directory snapshot to change when a template changes")
+	}
+
+	// mail templates live in a subdirectory, and are watched too
+	if err := os.Mkdir(filepath.Join(dir, "mail"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	before = dirSnapshot(dir)
+	writeTemplate(t, dir, "mail/hello.text.gohtml", `{{define "subject"}}Hi{{end}}Hello`)
+	if dirSnapshot(dir) == before {
+		t.Error("expected the directory snapshot to change when a mail template changes")
+	}
+
+	if err := ts.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := ts.Lookup("test.page.gohtml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	_ = tmpl.Execute(&b, nil)
+	if b.String() != "after!" {
+		t.Errorf("expected reloaded template output but got %q", b.String())
+	}
+
+	// a broken template keeps the last good cache
+	writeTemplate(t, dir, "test.page.gohtml", `{{template "base" .}}{{define "content"}}{{.Broken{{end}}`)
+	if err := ts.Reload(); err == nil {
+		t.Error("expected error reloading a broken template")
+	}
+	if _, err := ts.Lookup("test.page.gohtml"); err != nil {
+		t.Error("the previous template should still be cached after a failed reload")
+	}
+
+	if _, err := ts.Lookup("missing.page.gohtml"); err == nil {
+		t.Error("expected error looking up a missing template")
+	}
+}
+
+func writeTemplate(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_templateFunctions(t *testing.T) {
+	if humanDate(time.Time{}) != "" {
+		t.Error("expected empty string for zero time")
+	}
+	if humanDate(time.Date(2022, 8, 19, 13, 5, 0, 0, time.UTC)) != "19 Aug 2022 at 13:05" {
+		t.Errorf("wrong date: %s", humanDate(time.Date(2022, 8, 19, 13, 5, 0, 0, time.UTC)))
+	}
+
+	if !strings.HasPrefix(asset("/img/a.png"), "/static/img/a.png?v=") {
+		t.Errorf("wrong asset URL: %s", asset("/img/a.png"))
+	}
+
+	field := string(csrfField(`"token"`))
+	if !strings.Contains(field, `name="csrf_token"`) || !strings.Contains(field, "&#34;token&#34;") {
+		t.Errorf("wrong csrf field: %s", field)
+	}
+}
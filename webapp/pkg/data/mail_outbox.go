@@ -0,0 +1,19 @@
+package data
+
+import "time"
+
+// OutboxMessage is an email waiting in the mail outbox to be sent.
+type OutboxMessage struct {
+	ID            int
+	From          string
+	To            string
+	Subject       string
+	BodyText      string
+	BodyHTML      string
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	SentAt        *time.Time
+	FailedAt      *time.Time
+	CreatedAt     time.Time
+}
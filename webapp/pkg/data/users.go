@@ -1,22 +1,33 @@
 package data
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"golang.org/x/crypto/bcrypt"
+	netmail "net/mail"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // User describes the data for the User type.
 type User struct {
-	ID         int       `json:"id"`
-	FirstName  string    `json:"first_name"`
-	LastName   string    `json:"last_name"`
-	Email      string    `json:"email"`
-	Password   string    `json:"-"`
-	IsAdmin    int       `json:"is_admin"`
-	CreatedAt  time.Time `json:"-"`
-	UpdatedAt  time.Time `json:"-"`
-	ProfilePic UserImage `json:"_"`
+	ID            int    `json:"id"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	Email         string `json:"email"`
+	Password      string `json:"-"`
+	IsAdmin       bool   `json:"is_admin"`
+	EmailVerified bool   `json:"email_verified"`
+	// Version counts the updates to the user, so concurrent edits can be
+	// detected; the API exposes it as an ETag rather than in the JSON.
+	Version   int       `json:"-"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	// DeletedAt is when the user was soft deleted, or nil.
+	DeletedAt  *time.Time `json:"-"`
+	ProfilePic UserImage  `json:"_"`
 }
 
 // PasswordMatches uses Go's bcrypt package to compare a user supplied password
@@ -36,3 +47,80 @@ func (u *User) PasswordMatches(plainText string) (bool, error) {
 
 	return true, nil
 }
+
+// AdminFlag is is_admin as users are written in JSON: 1 or 0, as it was when
+// IsAdmin was an int, so that existing API clients keep working. It reads
+// either a boolean or a number, where any number but 0 means true.
+type AdminFlag bool
+
+func (f AdminFlag) MarshalJSON() ([]byte, error) {
+	if f {
+		return []byte("1"), nil
+	}
+	return []byte("0"), nil
+}
+
+func (f *AdminFlag) UnmarshalJSON(b []byte) error {
+	switch s := string(b); s {
+	case "null":
+		// leave it unset, as encoding/json does for null
+	case "true", "false":
+		*f = s == "true"
+	default:
+		var n float64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("is_admin must be a boolean or a number, not %s", s)
+		}
+		*f = n != 0
+	}
+	return nil
+}
+
+// MarshalJSON writes is_admin as an AdminFlag.
+func (u User) MarshalJSON() ([]byte, error) {
+	type user User
+	return json.Marshal(struct {
+		user
+		IsAdmin AdminFlag `json:"is_admin"`
+	}{user(u), AdminFlag(u.IsAdmin)})
+}
+
+// UnmarshalJSON reads is_admin as an AdminFlag.
+func (u *User) UnmarshalJSON(b []byte) error {
+	type user User
+	return json.Unmarshal(b, &struct {
+		*user
+		IsAdmin *AdminFlag `json:"is_admin"`
+	}{(*user)(u), (*AdminFlag)(&u.IsAdmin)})
+}
+
+// ValidateUserDetails trims a user's names and email address in place, and
+// checks them the same way the web app's forms do.
+func ValidateUserDetails(firstName, lastName, email *string) error {
+	*firstName = strings.TrimSpace(*firstName)
+	*lastName = strings.TrimSpace(*lastName)
+	*email = strings.TrimSpace(*email)
+
+	switch {
+	case *firstName == "" || *lastName == "" || *email == "":
+		return errors.New("first_name, last_name and email are required")
+	case utf8.RuneCountInString(*firstName) > 255 || utf8.RuneCountInString(*lastName) > 255 || utf8.RuneCountInString(*email) > 255:
+		return errors.New("names and email must be no more than 255 characters")
+	}
+
+	if addr, err := netmail.ParseAddress(*email); err != nil || addr.Address != *email {
+		return errors.New("invalid email address")
+	}
+	return nil
+}
+
+// ValidatePassword checks a new password.
+func ValidatePassword(password string) error {
+	switch {
+	case password == "":
+		return errors.New("password is required")
+	case utf8.RuneCountInString(password) < 6:
+		return errors.New("password must be at least 6 characters")
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package data
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUser_MarshalJSON(t *testing.T) {
+	var tests = []struct {
+		name     string
+		isAdmin  bool
+		expected string
+	}{
+		{"admin", true, `"is_admin":1`},
+		{"not admin", false, `"is_admin":0`},
+	}
+
+	for _, e := range tests {
+		b, err := json.Marshal(User{ID: 1, Email: "admin@example.com", Password: "secret", IsAdmin: e.isAdmin})
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+		if !strings.Contains(string(b), e.expected) || strings.Count(string(b), "is_admin") != 1 {
+			t.Errorf("%s: expected %s once in %s", e.name, e.expected, b)
+		}
+		if strings.Contains(string(b), "secret") {
+			t.Errorf("%s: password should not be written: %s", e.name, b)
+		}
+	}
+}
+
+func TestUser_UnmarshalJSON(t *testing.T) {
+	var tests = []struct {
+		name          string
+		json          string
+		expectedAdmin bool
+		expectErr     bool
+	}{
+		{"true", `{"id":1,"email":"admin@example.com","is_admin":true}`, true, false},
+		{"false", `{"id":1,"is_admin":false}`, false, false},
+		{"one", `{"id":1,"is_admin":1}`, true, false},
+		{"zero", `{"id":1,"is_admin":0}`, false, false},
+		{"missing", `{"id":1}`, false, false},
+		{"null", `{"id":1,"is_admin":null}`, false, false},
+		{"string", `{"id":1,"is_admin":"yes"}`, false, true},
+		{"unknown field", `{"id":1,"foo":"bar"}`, false, false},
+	}
+
+	for _, e := range tests {
+		var u User
+		err := json.Unmarshal([]byte(e.json), &u)
+		if e.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", e.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+		if u.ID != 1 || u.IsAdmin != e.expectedAdmin {
+			t.Errorf("%s: expected id 1 and admin %t but got %+v", e.name, e.expectedAdmin, u)
+		}
+	}
+}
+
+func TestValidateUserDetails(t *testing.T) {
+	var tests = []struct {
+		name      string
+		firstName string
+		lastName  string
+		email     string
+		valid     bool
+	}{
+		{"valid", " Jack ", "Smith", " jack@example.com ", true},
+		{"blank name", "Jack", "  ", "jack@example.com", false},
+		{"invalid email", "Jack", "Smith", "jack.example.com", false},
+		{"email with name", "Jack", "Smith", "Jack <jack@example.com>", false},
+		{"long name", strings.Repeat("a", 256), "Smith", "jack@example.com", false},
+	}
+
+	for _, e := range tests {
+		err := ValidateUserDetails(&e.firstName, &e.lastName, &e.email)
+		if (err == nil) != e.valid {
+			t.Errorf("%s: expected valid to be %v, got %v", e.name, e.valid, err)
+		}
+		if e.valid && (e.firstName != "Jack" || e.email != "jack@example.com") {
+			t.Errorf("%s: expected details to be trimmed, got %q, %q", e.name, e.firstName, e.email)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	for password, valid := range map[string]bool{"secret": true, "abc": false, "": false} {
+		if err := ValidatePassword(password); (err == nil) != valid {
+			t.Errorf("%q: expected valid to be %v, got %v", password, valid, err)
+		}
+	}
+}
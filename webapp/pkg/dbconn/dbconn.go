@@ -0,0 +1,278 @@
+// Package dbconn opens the apps' Postgres connection pools: it sizes them,
+// waits for Postgres to come up, and keeps passwords out of logs and errors.
+package dbconn
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	_ "github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	_ "github.com/jackc/pgx/v4/stdlib"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// firstRetryDelay is how long Open waits after the first failed attempt;
+	// each wait after that is twice as long, up to maxRetryDelay.
+	firstRetryDelay = time.Millisecond * 250
+	maxRetryDelay   = time.Second * 5
+	// pingTimeout bounds each attempt to reach Postgres.
+	pingTimeout = time.Second * 5
+)
+
+// Options size a connection pool and say how long Open waits for Postgres.
+type Options struct {
+	MaxOpenConns int
+	MaxIdleConns int
+	// ConnMaxLifetime and ConnMaxIdleTime close connections that have been
+	// open, or idle, that long; 0 keeps them forever.
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// MaxWait is how long Open keeps retrying; 0 makes a single attempt.
+	MaxWait time.Duration
+}
+
+// DefaultOptions returns the options the apps use unless told otherwise.
+func DefaultOptions() Options {
+	return Options{
+		MaxOpenConns:    25,
+		MaxIdleConns:    25,
+		ConnMaxLifetime: time.Hour,
+		ConnMaxIdleTime: time.Minute * 5,
+		MaxWait:         time.Second * 30,
+	}
+}
+
+// RegisterFlags defines a flag for each option in fs, defaulting to o's
+// values.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.MaxOpenConns, "db-max-open", o.MaxOpenConns, "Maximum open database connections; 0 for no limit")
+	fs.IntVar(&o.MaxIdleConns, "db-max-idle", o.MaxIdleConns, "Maximum idle database connections")
+	fs.DurationVar(&o.ConnMaxLifetime, "db-max-lifetime", o.ConnMaxLifetime, "How long a database connection is reused for; 0 for ever")
+	fs.DurationVar(&o.ConnMaxIdleTime, "db-max-idle-time", o.ConnMaxIdleTime, "How long an idle database connection is kept; 0 for ever")
+	fs.DurationVar(&o.MaxWait, "db-wait", o.MaxWait, "How long to keep retrying when the database is not up at startup")
+}
+
+// Open opens a pool on dsn and pings it, retrying with exponential backoff
+// until Postgres answers or opts.MaxWait has passed. Errors never contain the
+// password.
+func Open(dsn string, opts Options) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, redactError(dsn, err)
+	}
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	db.SetMaxIdleConns(opts.MaxIdleConns)
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+
+	if err := waitFor(dsn, opts.MaxWait, db.PingContext); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// OpenPool opens a native pgx pool on dsn, like Open. The pool has no idle
+// connection limit, so opts.MaxIdleConns is unused, and a MaxOpenConns of 0
+// leaves pgxpool's default limit. afterConnect, if not nil, runs on every new
+// connection.
+func OpenPool(dsn string, opts Options, afterConnect func(context.Context, *pgx.Conn) error) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, redactError(dsn, err)
+	}
+	if opts.MaxOpenConns > 0 {
+		config.MaxConns = int32(opts.MaxOpenConns)
+	}
+	if opts.ConnMaxLifetime > 0 {
+		config.MaxConnLifetime = opts.ConnMaxLifetime
+	}
+	if opts.ConnMaxIdleTime > 0 {
+		config.MaxConnIdleTime = opts.ConnMaxIdleTime
+	}
+	config.AfterConnect = afterConnect
+	// connect in the retry below rather than here
+	config.LazyConnect = true
+
+	pool, err := pgxpool.ConnectConfig(context.Background(), config)
+	if err != nil {
+		return nil, redactError(dsn, err)
+	}
+
+	if err := waitFor(dsn, opts.MaxWait, pool.Ping); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+// OpenAll opens a pool on each of dsns, closing them all if any fails.
+func OpenAll(dsns []string, opts Options) ([]*sql.DB, error) {
+	var dbs []*sql.DB
+	for _, dsn := range dsns {
+		db, err := Open(dsn, opts)
+		if err != nil {
+			for _, db := range dbs {
+				_ = db.Close()
+			}
+			return nil, err
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, nil
+}
+
+// waitFor pings the database at dsn until it answers or maxWait has passed,
+// logging each failure.
+func waitFor(dsn string, maxWait time.Duration, ping func(ctx context.Context) error) error {
+	err := retry(maxWait, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		defer cancel()
+		return ping(ctx)
+	}, func(err error, delay time.Duration) {
+		log.Printf("Postgres at %s is not ready, retrying in %s: %s", Redact(dsn), delay, redactError(dsn, err))
+	})
+	if err != nil {
+		return fmt.Errorf("could not connect to Postgres at %s: %w", Redact(dsn), redactError(dsn, err))
+	}
+	return nil
+}
+
+// retry calls fn until it succeeds or maxWait has passed, waiting twice as long
+// each time, and returns fn's last error. It calls failed before each wait.
+func retry(maxWait time.Duration, fn func() error, failed func(err error, delay time.Duration)) error {
+	deadline := time.Now().Add(maxWait)
+	delay := firstRetryDelay
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		failed(err, delay)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// redacted replaces passwords in Redact's output.
+const redacted = "xxxxx"
+
+// urlPassword matches the password in a URL DSN, for when it does not parse.
+var urlPassword = regexp.MustCompile(`(://[^:/@]*:)[^@]*@`)
+
+// keywordPassword matches the password in a keyword/value DSN, quoted or not.
+var keywordPassword = regexp.MustCompile(`(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s']\S*)`)
+
+// Redact returns dsn, in either keyword/value or URL form, with its password
+// replaced.
+func Redact(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return urlPassword.ReplaceAllString(dsn, "${1}"+redacted+"@")
+		}
+		q := u.Query()
+		if q.Has("password") {
+			q.Set("password", redacted)
+			u.RawQuery = q.Encode()
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		return u.String()
+	}
+
+	return keywordPassword.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// redactedError is an error whose message has had a password removed.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string { return e.msg }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactError hides dsn's password where err's message has it as a password
+// value or in a URL's user info, as it does when it quotes the DSN. Elsewhere
+// the same text may be something else, such as a user named like the
+// password, and is left alone.
+func redactError(dsn string, err error) error {
+	password := passwordOf(dsn)
+	if password == "" {
+		return err
+	}
+
+	quoted := "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(password) + "'"
+	userInfo := strings.TrimPrefix(url.UserPassword("", password).String(), ":")
+	keyword := regexp.MustCompile(`(\bpassword\s*=\s*)` + anyOf(quoted, url.QueryEscape(password), password))
+	inURL := regexp.MustCompile(`(://[^:/@\s]*:)` + anyOf(userInfo, password) + `@`)
+
+	msg := keyword.ReplaceAllString(err.Error(), "${1}"+redacted)
+	msg = inURL.ReplaceAllString(msg, "${1}"+redacted+"@")
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg: msg, err: err}
+}
+
+// anyOf returns a regular expression group matching any of the literal
+// strings, trying them in order.
+func anyOf(literals ...string) string {
+	quoted := make([]string, len(literals))
+	for i, l := range literals {
+		quoted[i] = regexp.QuoteMeta(l)
+	}
+	return "(?:" + strings.Join(quoted, "|") + ")"
+}
+
+// passwordOf returns the password in dsn, or "" if there is none.
+func passwordOf(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			if m := urlPassword.FindStringSubmatch(dsn); m != nil {
+				return strings.TrimSuffix(strings.TrimPrefix(m[0], m[1]), "@")
+			}
+			return ""
+		}
+		if password := u.Query().Get("password"); password != "" {
+			return password
+		}
+		password, _ := u.User.Password()
+		return password
+	}
+
+	m := keywordPassword.FindStringSubmatch(dsn)
+	if m == nil {
+		return ""
+	}
+	password := m[2]
+	if strings.HasPrefix(password, "'") {
+		password = strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(password[1 : len(password)-1])
+	}
+	return password
+}
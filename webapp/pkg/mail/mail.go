@@ -0,0 +1,72 @@
+// Package mail sends email through a pluggable Mailer: SMTPMailer for real
+// delivery, FileMailer for development and tests, and Outbox, which queues
+// messages in the database and retries them until they are delivered.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Message is one email. Body is the plain text version; HTML, if set, is sent
+// alongside it as an alternative.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+	HTML    string
+}
+
+// Mailer sends email.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewSender returns the Mailer named by kind: "file", which writes messages
+// to dir, or "smtp", which delivers them through server.
+func NewSender(kind, dir string, server SMTPMailer) (Mailer, error) {
+	switch kind {
+	case "file":
+		return FileMailer{Dir: dir}, nil
+	case "smtp":
+		return server, nil
+	default:
+		return nil, fmt.Errorf("unknown mail sender %q; expected file or smtp", kind)
+	}
+}
+
+// FileMailer is a Mailer for development and tests. Instead of sending each
+// message it writes it to a new .eml file in Dir, which can be opened in most
+// mail clients.
+type FileMailer struct {
+	Dir string
+}
+
+// unsafeFileChars matches characters that are kept out of file names.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9@._-]+`)
+
+// Send writes msg to a file named after the time and the recipient.
+func (m FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	contents, err := msg.bytes(now)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(m.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000000000"), unsafeFileChars.ReplaceAllString(msg.To, "_"))
+	return os.WriteFile(filepath.Join(m.Dir, name), contents, 0644)
+}
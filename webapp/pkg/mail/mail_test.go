@@ -0,0 +1,68 @@
+package mail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer_Send(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer := FileMailer{Dir: dir}
+
+	msg := Message{
+		From:    "no-reply@example.com",
+		To:      "Jack Smith <jack/x@example.com>",
+		Subject: "Hello",
+		Body:    "Hi Jack",
+	}
+
+	err := mailer.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("send returned an error: %s", err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file in %s but got %d", dir, len(files))
+	}
+	if strings.ContainsAny(files[0].Name(), "/ <>") || !strings.HasSuffix(files[0].Name(), ".eml") {
+		t.Errorf("unexpected file name %q", files[0].Name())
+	}
+
+	contents, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	for _, expected := range []string{"To: Jack Smith <jack/x@example.com>\r\n", "Subject: Hello\r\n", "\r\n\r\nHi Jack"} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf("expected %q in the written message", expected)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := mailer.Send(ctx, msg); err == nil {
+		t.Error("expected an error sending with a cancelled context")
+	}
+}
+
+func TestNewSender(t *testing.T) {
+	var tests = []struct {
+		kind      string
+		expectErr bool
+	}{
+		{"file", false},
+		{"smtp", false},
+		{"carrier-pigeon", true},
+	}
+
+	for _, e := range tests {
+		mailer, err := NewSender(e.kind, t.TempDir(), SMTPMailer{Host: "localhost", Port: 25})
+		if e.expectErr != (err != nil) {
+			t.Errorf("%s: expected error to be %t but got %v", e.kind, e.expectErr, err)
+		}
+		if !e.expectErr && mailer == nil {
+			t.Errorf("%s: no mailer returned", e.kind)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// validate checks that msg can be sent: it needs a sender, a single
+// recipient and something to say, and no header may contain a line break.
+func (msg Message) validate() error {
+	if strings.ContainsAny(msg.From+msg.To+msg.Subject, "\r\n") {
+		return errors.New("mail: line break in header")
+	}
+	if _, err := mail.ParseAddress(msg.From); err != nil {
+		return fmt.Errorf("mail: invalid from address %q: %w", msg.From, err)
+	}
+	if _, err := mail.ParseAddress(msg.To); err != nil {
+		return fmt.Errorf("mail: invalid to address %q: %w", msg.To, err)
+	}
+	if msg.Body == "" && msg.HTML == "" {
+		return errors.New("mail: message has no body")
+	}
+	return nil
+}
+
+// address returns the bare email address in addr, such as me@example.com for
+// "Me <me@example.com>". addr must already have passed validate.
+func address(addr string) string {
+	a, _ := mail.ParseAddress(addr)
+	return a.Address
+}
+
+// bytes encodes msg in the internet message format, dated date. The body is
+// quoted-printable plain text or, if HTML is set, a multipart/alternative of
+// the plain text and HTML versions.
+func (msg Message) bytes(date time.Time) ([]byte, error) {
+	if err := msg.validate(); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if msg.HTML == "" {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&b, msg.Body); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", parts.Boundary())
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Body},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
@@ -0,0 +1,94 @@
+package mail
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessage_bytes(t *testing.T) {
+	msg := Message{
+		From:    "Webapp <no-reply@example.com>",
+		To:      "jack@example.com",
+		Subject: "Grüße",
+		Body:    "Hi Jack,\n\nWelcome aboard.",
+	}
+
+	raw, err := msg.bytes(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatalf("message does not parse: %s", err)
+	}
+
+	subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if subject != msg.Subject {
+		t.Errorf("expected subject %q but got %q", msg.Subject, subject)
+	}
+	// text is sent with CRLF line endings
+	crlfBody := strings.ReplaceAll(msg.Body, "\n", "\r\n")
+
+	body, _ := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if string(body) != crlfBody {
+		t.Errorf("expected body %q but got %q", msg.Body, body)
+	}
+
+	// with HTML, both versions are sent as alternatives
+	msg.HTML = "<p>Hi Jack,</p>"
+	raw, err = msg.bytes(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ = mail.ReadMessage(strings.NewReader(string(raw)))
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative but got %q", parsed.Header.Get("Content-Type"))
+	}
+
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := io.ReadAll(part)
+		parts = append(parts, part.Header.Get("Content-Type")+": "+string(body))
+	}
+	expected := []string{"text/plain; charset=utf-8: " + crlfBody, "text/html; charset=utf-8: " + msg.HTML}
+	if strings.Join(parts, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected parts %q but got %q", expected, parts)
+	}
+}
+
+func TestMessage_validate(t *testing.T) {
+	valid := Message{From: "no-reply@example.com", To: "jack@example.com", Subject: "Hi", Body: "Hello"}
+
+	var tests = []struct {
+		name      string
+		change    func(m *Message)
+		expectErr bool
+	}{
+		{"valid", func(m *Message) {}, false},
+		{"html only", func(m *Message) { m.Body, m.HTML = "", "<p>Hello</p>" }, false},
+		{"no body", func(m *Message) { m.Body = "" }, true},
+		{"bad to", func(m *Message) { m.To = "jack" }, true},
+		{"bad from", func(m *Message) { m.From = "" }, true},
+		{"header injection", func(m *Message) { m.Subject = "Hi\r\nBcc: everyone@example.com" }, true},
+	}
+
+	for _, e := range tests {
+		m := valid
+		e.change(&m)
+		if err := m.validate(); e.expectErr != (err != nil) {
+			t.Errorf("%s: expected error to be %t but got %v", e.name, e.expectErr, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package mail
+
+import (
+	"context"
+	"log"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// Outbox is a durable Mailer. Send only queues a message in Repo; Run, in the
+// background, hands due messages to Mailer and retries failures with
+// exponential backoff until MaxAttempts is reached. Several processes may run
+// an Outbox against the same database.
+type Outbox struct {
+	Repo   repository.OutboxRepo
+	Mailer Mailer
+	// MaxAttempts is how many times to try a message before giving up on
+	// it. Zero means 8.
+	MaxAttempts int
+	// BatchSize is how many messages Process claims at a time. Zero means 20.
+	BatchSize int
+	// Lease is how long a claimed message is hidden from other workers. Zero
+	// means 5 minutes.
+	Lease time.Duration
+	// PollInterval is how often Run looks for due messages. Zero means 10
+	// seconds.
+	PollInterval time.Duration
+}
+
+// retryBase and retryMax bound the wait between attempts: one minute after
+// the first failure, doubling each time, to at most an hour.
+const (
+	retryBase = time.Minute
+	retryMax  = time.Hour
+)
+
+// backoff returns how long to wait before trying again after attempt, the
+// number of attempts made so far, has failed.
+func backoff(attempt int) time.Duration {
+	d := retryBase
+	for i := 1; i < attempt && d < retryMax; i++ {
+		d *= 2
+	}
+	if d > retryMax {
+		d = retryMax
+	}
+	return d
+}
+
+// Send queues msg to be sent by Run.
+func (o *Outbox) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := msg.validate(); err != nil {
+		return err
+	}
+
+	_, err := o.Repo.EnqueueMail(data.OutboxMessage{
+		From:     msg.From,
+		To:       msg.To,
+		Subject:  msg.Subject,
+		BodyText: msg.Body,
+		BodyHTML: msg.HTML,
+	})
+	return err
+}
+
+// Process sends one batch of due messages and reports how many were sent.
+// Messages that fail are scheduled for another attempt, or given up on.
+func (o *Outbox) Process(ctx context.Context) (int, error) {
+	messages, err := o.Repo.ClaimMail(time.Now(), o.lease(), o.batchSize())
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, m := range messages {
+		if ctx.Err() != nil {
+			// unsent claims become due again when their lease runs out
+			return sent, ctx.Err()
+		}
+
+		err := o.Mailer.Send(ctx, Message{
+			From:    m.From,
+			To:      m.To,
+			Subject: m.Subject,
+			Body:    m.BodyText,
+			HTML:    m.BodyHTML,
+		})
+
+		switch {
+		case err == nil:
+			err = o.Repo.MarkMailSent(m.ID)
+			sent++
+		case m.Attempts >= o.maxAttempts():
+			log.Printf("mail: giving up on message %d to %s after %d attempts: %s", m.ID, m.To, m.Attempts, err)
+			err = o.Repo.FailMail(m.ID, err.Error())
+		default:
+			err = o.Repo.RetryMail(m.ID, err.Error(), time.Now().Add(backoff(m.Attempts)))
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	return sent, nil
+}
+
+// Run processes the outbox every PollInterval until ctx is done. Full batches
+// are followed straight away by another, so a backlog drains quickly.
+func (o *Outbox) Run(ctx context.Context) {
+	interval := o.PollInterval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			sent, err := o.Process(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("mail: processing outbox:", err)
+				}
+				break
+			}
+			if sent < o.batchSize() {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Outbox) maxAttempts() int {
+	if o.MaxAttempts == 0 {
+		return 8
+	}
+	return o.MaxAttempts
+}
+
+func (o *Outbox) batchSize() int {
+	if o.BatchSize == 0 {
+		return 20
+	}
+	return o.BatchSize
+}
+
+func (o *Outbox) lease() time.Duration {
+	if o.Lease == 0 {
+		return 5 * time.Minute
+	}
+	return o.Lease
+}
@@ -0,0 +1,233 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+)
+
+// memoryOutbox is an in-memory repository.OutboxRepo.
+type memoryOutbox struct {
+	mu       sync.Mutex
+	messages []*data.OutboxMessage
+}
+
+func (r *memoryOutbox) EnqueueMail(m data.OutboxMessage) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m.ID = len(r.messages) + 1
+	m.NextAttemptAt = time.Now()
+	r.messages = append(r.messages, &m)
+	return m.ID, nil
+}
+
+func (r *memoryOutbox) ClaimMail(now time.Time, lease time.Duration, limit int) ([]*data.OutboxMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var claimed []*data.OutboxMessage
+	for _, m := range r.messages {
+		if len(claimed) == limit {
+			break
+		}
+		if m.SentAt == nil && m.FailedAt == nil && !m.NextAttemptAt.After(now) {
+			m.Attempts++
+			m.NextAttemptAt = now.Add(lease)
+			c := *m
+			claimed = append(claimed, &c)
+		}
+	}
+	return claimed, nil
+}
+
+func (r *memoryOutbox) MarkMailSent(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.messages[id-1].SentAt = &now
+	return nil
+}
+
+func (r *memoryOutbox) RetryMail(id int, lastError string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages[id-1].LastError = lastError
+	r.messages[id-1].NextAttemptAt = at
+	return nil
+}
+
+func (r *memoryOutbox) FailMail(id int, lastError string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.messages[id-1].LastError = lastError
+	r.messages[id-1].FailedAt = &now
+	return nil
+}
+
+// makeDue makes every waiting message due now, as if time had passed.
+func (r *memoryOutbox) makeDue() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.messages {
+		m.NextAttemptAt = time.Now()
+	}
+}
+
+// flakyMailer fails its first `failures` sends, then records what it sends.
+type flakyMailer struct {
+	mu       sync.Mutex
+	failures int
+	sent     []Message
+}
+
+func (m *flakyMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("connection refused")
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *flakyMailer) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sent)
+}
+
+var testMessage = Message{From: "no-reply@example.com", To: "jack@example.com", Subject: "Hi", Body: "Hello", HTML: "<p>Hello</p>"}
+
+func TestOutbox_Send(t *testing.T) {
+	repo := &memoryOutbox{}
+	outbox := &Outbox{Repo: repo, Mailer: &flakyMailer{}}
+
+	if err := outbox.Send(context.Background(), testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.messages) != 1 || repo.messages[0].BodyHTML != testMessage.HTML {
+		t.Errorf("expected the message to be queued, got %+v", repo.messages)
+	}
+
+	if err := outbox.Send(context.Background(), Message{To: "jack@example.com"}); err == nil {
+		t.Error("expected an invalid message to be refused")
+	}
+	if len(repo.messages) != 1 {
+		t.Error("invalid message was queued")
+	}
+}
+
+func TestOutbox_Process(t *testing.T) {
+	repo := &memoryOutbox{}
+	mailer := &flakyMailer{failures: 2}
+	outbox := &Outbox{Repo: repo, Mailer: mailer}
+
+	_ = outbox.Send(context.Background(), testMessage)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		before := time.Now()
+		sent, err := outbox.Process(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := repo.messages[0]
+		if m.Attempts != attempt {
+			t.Errorf("attempt %d: expected %d attempts but got %d", attempt, attempt, m.Attempts)
+		}
+		if attempt < 3 {
+			if sent != 0 || m.LastError != "connection refused" {
+				t.Errorf("attempt %d: expected a failure to be recorded, got %+v", attempt, m)
+			}
+			if wait := m.NextAttemptAt.Sub(before); wait < backoff(attempt) {
+				t.Errorf("attempt %d: retrying after %s; expected at least %s", attempt, wait, backoff(attempt))
+			}
+
+			// not due again until the backoff has passed
+			if sent, _ := outbox.Process(context.Background()); sent != 0 || repo.messages[0].Attempts != attempt {
+				t.Errorf("attempt %d: message was retried before it was due", attempt)
+			}
+			repo.makeDue()
+			continue
+		}
+		if sent != 1 || m.SentAt == nil || mailer.count() != 1 {
+			t.Errorf("attempt %d: expected the message to be sent, got %+v", attempt, m)
+		}
+	}
+
+	if mailer.sent[0] != testMessage {
+		t.Errorf("sent %+v; expected %+v", mailer.sent[0], testMessage)
+	}
+}
+
+func TestOutbox_ProcessGivesUp(t *testing.T) {
+	repo := &memoryOutbox{}
+	outbox := &Outbox{Repo: repo, Mailer: &flakyMailer{failures: 100}, MaxAttempts: 3}
+
+	_ = outbox.Send(context.Background(), testMessage)
+
+	for i := 0; i < 5; i++ {
+		_, _ = outbox.Process(context.Background())
+		repo.makeDue()
+	}
+
+	m := repo.messages[0]
+	if m.FailedAt == nil || m.Attempts != 3 {
+		t.Errorf("expected the message to be given up on after 3 attempts, got %+v", m)
+	}
+}
+
+func TestOutbox_Run(t *testing.T) {
+	repo := &memoryOutbox{}
+	mailer := &flakyMailer{}
+	outbox := &Outbox{Repo: repo, Mailer: mailer, BatchSize: 2, PollInterval: 10 * time.Millisecond}
+
+	for i := 0; i < 5; i++ {
+		_ = outbox.Send(context.Background(), testMessage)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		outbox.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for mailer.count() < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if mailer.count() != 5 {
+		t.Errorf("expected 5 messages sent but got %d", mailer.count())
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Run did not return after its context was cancelled")
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	var tests = []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{7, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, e := range tests {
+		if got := backoff(e.attempt); got != e.expected {
+			t.Errorf("backoff(%d): expected %s but got %s", e.attempt, e.expected, got)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer accepts connections on a local port and speaks just enough
+// SMTP to receive a message. Recipients in reject are refused.
+type fakeSMTPServer struct {
+	listener net.Listener
+	reject   string
+	received chan string
+}
+
+func newFakeSMTPServer(t *testing.T, reject string) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTPServer{listener: l, reject: reject, received: make(chan string, 10)}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost fake ESMTP")
+	var transcript strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		transcript.WriteString(line + "\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch {
+		case cmd == "EHLO" || cmd == "HELO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case cmd == "AUTH":
+			reply("235 2.7.0 Authentication successful")
+		case cmd == "MAIL":
+			reply("250 OK")
+		case cmd == "RCPT":
+			if s.reject != "" && strings.Contains(line, s.reject) {
+				reply("550 No such user")
+				continue
+			}
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			for {
+				data, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if data == ".\r\n" {
+					break
+				}
+				transcript.WriteString(data)
+			}
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			s.received <- transcript.String()
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPMailer_Send(t *testing.T) {
+	server := newFakeSMTPServer(t, "nobody@example.com")
+	mailer := SMTPMailer{Host: "127.0.0.1", Port: server.port(), Username: "user", Password: "pass"}
+
+	msg := Message{
+		From:    "Webapp <no-reply@example.com>",
+		To:      "jack@example.com",
+		Subject: "Hello",
+		Body:    "Hi Jack",
+		HTML:    "<p>Hi Jack</p>",
+	}
+
+	err := mailer.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("send returned an error: %s", err)
+	}
+
+	select {
+	case transcript := <-server.received:
+		for _, expected := range []string{"AUTH PLAIN", "MAIL FROM:<no-reply@example.com>", "RCPT TO:<jack@example.com>", "Subject: Hello", "<p>Hi Jack</p>"} {
+			if !strings.Contains(transcript, expected) {
+				t.Errorf("expected %q in the SMTP transcript:\n%s", expected, transcript)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server never received the message")
+	}
+
+	msg.To = "nobody@example.com"
+	if err := mailer.Send(context.Background(), msg); err == nil {
+		t.Error("expected an error for a rejected recipient")
+	}
+}
+
+func TestSMTPMailer_SendTimeout(t *testing.T) {
+	// a server that accepts connections but never greets the client
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(2 * time.Second)
+		}
+	}()
+
+	port, _ := strconv.Atoi(strings.Split(l.Addr().String(), ":")[1])
+	mailer := SMTPMailer{Host: "127.0.0.1", Port: port, Timeout: 100 * time.Millisecond}
+
+	msg := Message{From: "no-reply@example.com", To: "jack@example.com", Subject: "Hello", Body: "Hi"}
+
+	start := time.Now()
+	if err := mailer.Send(context.Background(), msg); err == nil {
+		t.Error("expected a timeout error")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("send took %s; expected it to time out", time.Since(start))
+	}
+}
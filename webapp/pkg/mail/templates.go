@@ -0,0 +1,137 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// Templates renders messages from templates, laid out the same way as the web
+// app's pages. Each message has a plain text template, NAME.text.gohtml,
+// which must define a "subject" template, and optionally an HTML template,
+// NAME.html.gohtml. Text templates are parsed with every *.layout.text.gohtml
+// and HTML templates with every *.layout.html.gohtml.
+type Templates struct {
+	fsys fs.FS
+
+	mu   sync.RWMutex
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+// NewTemplates parses every message template in fsys.
+func NewTemplates(fsys fs.FS) (*Templates, error) {
+	t := &Templates{fsys: fsys}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload parses the templates again. If they fail to parse, the previous
+// templates are kept.
+func (t *Templates) Reload() error {
+	text, html, err := parseTemplates(t.fsys)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.text, t.html = text, html
+	t.mu.Unlock()
+	return nil
+}
+
+// parseTemplates parses every message template in fsys, keyed by message name.
+func parseTemplates(fsys fs.FS) (map[string]*texttemplate.Template, map[string]*htmltemplate.Template, error) {
+	text := map[string]*texttemplate.Template{}
+	html := map[string]*htmltemplate.Template{}
+
+	textLayouts, err := fs.Glob(fsys, "*.layout.text.gohtml")
+	if err != nil {
+		return nil, nil, err
+	}
+	htmlLayouts, err := fs.Glob(fsys, "*.layout.html.gohtml")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	texts, err := fs.Glob(fsys, "*.text.gohtml")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range texts {
+		name := strings.TrimSuffix(file, ".text.gohtml")
+		if strings.HasSuffix(name, ".layout") {
+			continue
+		}
+		ts, err := texttemplate.New(file).ParseFS(fsys, append([]string{file}, textLayouts...)...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ts.Lookup("subject") == nil {
+			return nil, nil, fmt.Errorf("mail template %s does not define a subject", file)
+		}
+		text[name] = ts
+	}
+
+	htmls, err := fs.Glob(fsys, "*.html.gohtml")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range htmls {
+		name := strings.TrimSuffix(file, ".html.gohtml")
+		if strings.HasSuffix(name, ".layout") {
+			continue
+		}
+		if text[name] == nil {
+			return nil, nil, fmt.Errorf("mail template %s has no plain text version", file)
+		}
+		ts, err := htmltemplate.New(file).ParseFS(fsys, append([]string{file}, htmlLayouts...)...)
+		if err != nil {
+			return nil, nil, err
+		}
+		html[name] = ts
+	}
+
+	return text, html, nil
+}
+
+// Render returns the message called name, with its subject and bodies
+// rendered from data. The caller fills in From and To.
+func (t *Templates) Render(name string, data any) (Message, error) {
+	var msg Message
+
+	t.mu.RLock()
+	text, ok := t.text[name]
+	html, hasHTML := t.html[name]
+	t.mu.RUnlock()
+
+	if !ok {
+		return msg, fmt.Errorf("mail template %s does not exist", name)
+	}
+
+	var subject, body bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return msg, err
+	}
+	if err := text.Execute(&body, data); err != nil {
+		return msg, err
+	}
+	msg.Subject = strings.Join(strings.Fields(subject.String()), " ")
+	msg.Body = strings.TrimSpace(body.String()) + "\n"
+
+	if hasHTML {
+		var b bytes.Buffer
+		if err := html.Execute(&b, data); err != nil {
+			return msg, err
+		}
+		msg.HTML = b.String()
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,121 @@
+package mail
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNewTemplates(t *testing.T) {
+	var tests = []struct {
+		name      string
+		fsys      fstest.MapFS
+		expectErr bool
+	}{
+		{
+			name: "text and html",
+			fsys: fstest.MapFS{
+				"hello.text.gohtml": {Data: []byte(`{{define "subject"}}Hi{{end}}Hello`)},
+				"hello.html.gohtml": {Data: []byte(`<p>Hello</p>`)},
+			},
+		},
+		{
+			name: "no subject",
+			fsys: fstest.MapFS{
+				"hello.text.gohtml": {Data: []byte(`Hello`)},
+			},
+			expectErr: true,
+		},
+		{
+			name: "html without text",
+			fsys: fstest.MapFS{
+				"hello.html.gohtml": {Data: []byte(`<p>Hello</p>`)},
+			},
+			expectErr: true,
+		},
+		{
+			name: "bad syntax",
+			fsys: fstest.MapFS{
+				"hello.text.gohtml": {Data: []byte(`{{define "subject"}}Hi{{end}}{{.Name`)},
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, e := range tests {
+		_, err := NewTemplates(e.fsys)
+		if e.expectErr != (err != nil) {
+			t.Errorf("%s: expected error to be %t but got %v", e.name, e.expectErr, err)
+		}
+	}
+}
+
+func TestTemplates_Render(t *testing.T) {
+	templates, err := NewTemplates(os.DirFS("./../../templates/mail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := templates.Render("verify-email", map[string]any{
+		"Name":  "<Jack>",
+		"Link":  "http://localhost:8080/verify-email?email=jack%40example.com&signature=abc",
+		"Hours": 24,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Subject != "Verify your email address" {
+		t.Errorf("unexpected subject %q", msg.Subject)
+	}
+	if !strings.HasPrefix(msg.Body, "Hi <Jack>,") || !strings.Contains(msg.Body, "email=jack%40example.com&signature=abc") {
+		t.Errorf("unexpected plain text body:\n%s", msg.Body)
+	}
+	if !strings.Contains(msg.HTML, "Hi &lt;Jack&gt;,") || !strings.Contains(msg.HTML, `href="http://localhost:8080/verify-email?email=jack%40example.com&amp;signature=abc"`) {
+		t.Errorf("unexpected html body:\n%s", msg.HTML)
+	}
+
+	if _, err := templates.Render("no-such-message", nil); err == nil {
+		t.Error("expected an error rendering a message that does not exist")
+	}
+}
+
+func TestTemplates_Reload(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate(t, dir, "hello.text.gohtml", `{{define "subject"}}Hi{{end}}before`)
+
+	templates, err := NewTemplates(os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTemplate(t, dir, "hello.text.gohtml", `{{define "subject"}}Hi{{end}}after`)
+	if err := templates.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := templates.Render("hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Body != "after\n" {
+		t.Errorf("expected the reloaded body but got %q", msg.Body)
+	}
+
+	// a broken template keeps the last good templates
+	writeTemplate(t, dir, "hello.text.gohtml", `{{define "subject"}}Hi{{end}}{{.Broken`)
+	if err := templates.Reload(); err == nil {
+		t.Error("expected error reloading a broken template")
+	}
+	if _, err := templates.Render("hello", nil); err != nil {
+		t.Errorf("the previous templates should still render after a failed reload, but got %v", err)
+	}
+}
+
+func writeTemplate(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
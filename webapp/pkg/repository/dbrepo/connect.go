@@ -0,0 +1,97 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"time"
+	"webapp/pkg/dbconn"
+	"webapp/pkg/repository"
+)
+
+// replicaCheckInterval is how often the read replicas' health is checked.
+const replicaCheckInterval = time.Second * 10
+
+// Config says what Connect connects to.
+type Config struct {
+	// DSN is the primary.
+	DSN string
+	// ReplicaDSNs are read replicas of the primary; only the sql repo reads
+	// from them.
+	ReplicaDSNs []string
+	// Repo is how users are read and written: "sql" for PostgresDBRepo, or
+	// "pgx" for PgxDBRepo.
+	Repo    string
+	Options dbconn.Options
+}
+
+// Conns are an app's connections to Postgres.
+type Conns struct {
+	// DB is the primary's pool, for whatever is not in a repo.
+	DB *sql.DB
+	// Postgres runs on DB, reading from the replicas if there are any. It
+	// holds the mail outbox, and the users too with the sql repo.
+	Postgres *PostgresDBRepo
+	// Users is the repo for users chosen by Config.Repo.
+	Users repository.DatabaseRepo
+
+	pool *pgxpool.Pool
+}
+
+// Connect opens the pools described by cfg, waiting for Postgres as
+// dbconn.Open does, and closes any it opened if one fails.
+func Connect(cfg Config) (*Conns, error) {
+	switch cfg.Repo {
+	case "sql":
+	case "pgx":
+		if len(cfg.ReplicaDSNs) > 0 {
+			return nil, errors.New("read replicas need the sql repo")
+		}
+	default:
+		return nil, fmt.Errorf("unknown repo %q; use sql or pgx", cfg.Repo)
+	}
+
+	db, err := dbconn.Open(cfg.DSN, cfg.Options)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Connected to Postgres at %s", dbconn.Redact(cfg.DSN))
+
+	c := &Conns{DB: db, Postgres: &PostgresDBRepo{DB: db}}
+	c.Users = c.Postgres
+
+	if len(cfg.ReplicaDSNs) > 0 {
+		replicas, err := dbconn.OpenAll(cfg.ReplicaDSNs, cfg.Options)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		log.Printf("Connected to %d read replicas", len(replicas))
+		c.Postgres.Replicas = NewReplicaSet(replicaCheckInterval, replicas...)
+	}
+
+	if cfg.Repo == "pgx" {
+		c.pool, err = dbconn.OpenPool(cfg.DSN, cfg.Options, PreparePgxStatements)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		log.Printf("Opened a pgx pool on Postgres at %s", dbconn.Redact(cfg.DSN))
+		c.Users = &PgxDBRepo{Pool: c.pool}
+	}
+
+	return c, nil
+}
+
+// Close closes every pool.
+func (c *Conns) Close() {
+	if c.pool != nil {
+		c.pool.Close()
+	}
+	if c.Postgres.Replicas != nil {
+		c.Postgres.Replicas.Close()
+	}
+	_ = c.DB.Close()
+}
@@ -0,0 +1,25 @@
+package dbrepo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConnect_invalidConfig(t *testing.T) {
+	var tests = []struct {
+		name     string
+		cfg      Config
+		expected string
+	}{
+		{"unknown repo", Config{Repo: "mongo"}, "unknown repo"},
+		{"pgx with replicas", Config{Repo: "pgx", ReplicaDSNs: []string{"host=replica"}}, "read replicas need the sql repo"},
+	}
+
+	// both fail before connecting to anything
+	for _, e := range tests {
+		_, err := Connect(e.cfg)
+		if err == nil || !strings.Contains(err.Error(), e.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", e.name, e.expected, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+//go:build integration
+
+package dbrepo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// The integration tests run against a real Postgres, started by one of these
+// engines and chosen with DBREPO_TEST_ENGINE:
+//
+//	docker  a postgres:14.5 container, through dockertest (the default)
+//	local   a throwaway cluster from the Postgres binaries in
+//	        DBREPO_TEST_POSTGRES_BIN, or on the PATH if that is not set
+//
+// The local engine needs initdb, pg_ctl and postgres, and like initdb itself
+// it cannot run as root. There is no engine-free option here: the repository
+// relies on identity columns, COPY and temporary tables, which no pure-Go
+// stand-in supports. The repotest suite runs against MemoryDBRepo without the
+// integration tag instead.
+const (
+	engineDocker = "docker"
+	engineLocal  = "local"
+)
+
+// engine is a running database server, with an open connection to dbName.
+type engine struct {
+	name string
+	dsn  string
+	db   *sql.DB
+	stop func() error
+}
+
+// startEngine starts the named engine, or the docker engine if name is empty.
+func startEngine(name string) (*engine, error) {
+	switch name {
+	case "", engineDocker:
+		return startDocker()
+	case engineLocal:
+		return startLocal(os.Getenv("DBREPO_TEST_POSTGRES_BIN"))
+	default:
+		return nil, fmt.Errorf("unknown DBREPO_TEST_ENGINE %q; use %s or %s", name, engineDocker, engineLocal)
+	}
+}
+
+func startDocker() (*engine, error) {
+	// connect to docker; fail if docker not running
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to docker; is it running? %w", err)
+	}
+
+	// set up our docker options, specifying the image and so forth
+	opts := dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "14.5",
+		Env: []string{
+			"POSTGRES_USER=" + user,
+			"POSTGRES_PASSWORD=" + password,
+			"POSTGRES_DB=" + dbName,
+		},
+		ExposedPorts: []string{"5432"},
+		PortBindings: map[docker.Port][]docker.PortBinding{
+			"5432": {
+				{HostIP: "0.0.0.0", HostPort: port},
+			},
+		},
+	}
+
+	// get a resource (docker image)
+	resource, err := pool.RunWithOptions(&opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not start resource: %w", err)
+	}
+	stop := func() error { return pool.Purge(resource) }
+
+	// start the image and wait until it's ready
+	var db *sql.DB
+	dockerDSN := fmt.Sprintf(dsn, host, port, user, password, dbName)
+	if err := pool.Retry(func() error {
+		var err error
+		db, err = sql.Open("pgx", dockerDSN)
+		if err != nil {
+			return err
+		}
+		return db.Ping()
+	}); err != nil {
+		_ = stop()
+		return nil, fmt.Errorf("could not connect to database: %w", err)
+	}
+
+	return &engine{name: engineDocker, dsn: dockerDSN, db: db, stop: stop}, nil
+}
+
+// startLocal initialises a cluster in a temporary directory with the binaries
+// in binDir, starts it on a free port and creates dbName.
+func startLocal(binDir string) (*engine, error) {
+	if binDir == "" {
+		pgCtl, err := exec.LookPath("pg_ctl")
+		if err != nil {
+			return nil, errors.New("could not find the Postgres binaries; set DBREPO_TEST_POSTGRES_BIN or add them to the PATH")
+		}
+		binDir = filepath.Dir(pgCtl)
+	}
+	bin := func(name string) string { return filepath.Join(binDir, name) }
+
+	localPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "dbrepo-postgres-")
+	if err != nil {
+		return nil, err
+	}
+	dataDir := filepath.Join(dir, "data")
+
+	run := func(name string, args ...string) error {
+		out, err := exec.Command(bin(name), args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %w\n%s", name, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	if err := run("initdb", "-D", dataDir, "-U", user, "--auth=trust", "--encoding=UTF8", "--no-sync"); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	// fsync is off, as the cluster is thrown away; the socket lives in the
+	// temporary directory so as not to need write access to /var/run
+	options := fmt.Sprintf("-p %d -c listen_addresses=%s -c unix_socket_directories=%s -c fsync=off", localPort, host, dir)
+	if err := run("pg_ctl", "start", "-w", "-D", dataDir, "-l", filepath.Join(dir, "postgres.log"), "-o", options); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	stop := func() error {
+		err := run("pg_ctl", "stop", "-w", "-D", dataDir, "-m", "fast")
+		return errors.Join(err, os.RemoveAll(dir))
+	}
+
+	localDSN := fmt.Sprintf(dsn, host, strconv.Itoa(localPort), user, password, dbName)
+	db, err := createLocalDB(localDSN, strconv.Itoa(localPort))
+	if err != nil {
+		_ = stop()
+		return nil, err
+	}
+
+	return &engine{name: engineLocal, dsn: localDSN, db: db, stop: stop}, nil
+}
+
+// createLocalDB creates dbName through the postgres database, and connects to
+// it; pg_ctl has already waited for the server to accept connections, and the
+// cluster trusts every one, so the password is unused.
+func createLocalDB(localDSN, localPort string) (*sql.DB, error) {
+	admin, err := sql.Open("pgx", fmt.Sprintf(dsn, host, localPort, user, password, "postgres"))
+	if err != nil {
+		return nil, err
+	}
+	defer admin.Close()
+
+	if _, err := admin.Exec("create database " + dbName); err != nil {
+		return nil, fmt.Errorf("could not create database: %w", err)
+	}
+
+	db, err := sql.Open("pgx", localDSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not connect to database: %w", err)
+	}
+	return db, nil
+}
+
+// freePort returns a TCP port that nothing is listening on.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,116 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+	"webapp/pkg/data"
+)
+
+// EnqueueMail adds a message to the mail outbox, due straight away.
+func (m *PostgresDBRepo) EnqueueMail(msg data.OutboxMessage) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into mail_outbox (from_address, to_address, subject, body_text, body_html, next_attempt_at, created_at)
+		values ($1, $2, $3, $4, $5, $6, $6) returning id`
+
+	err := m.db().QueryRowContext(ctx, stmt,
+		msg.From,
+		msg.To,
+		msg.Subject,
+		msg.BodyText,
+		msg.BodyHTML,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// ClaimMail returns up to limit unsent messages that are due at now, oldest
+// first. Each claimed message has an attempt counted against it and is not
+// due again until lease has passed, so concurrent workers never claim the
+// same message; a worker that dies mid-send just delays it by lease.
+func (m *PostgresDBRepo) ClaimMail(now time.Time, lease time.Duration, limit int) ([]*data.OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		update mail_outbox set
+			attempts = attempts + 1,
+			next_attempt_at = $1
+		where id in (
+			select id from mail_outbox
+			where sent_at is null and failed_at is null and next_attempt_at <= $2
+			order by next_attempt_at, id
+			limit $3
+			for update skip locked
+		)
+		returning id, from_address, to_address, subject, body_text, body_html, attempts, last_error,
+			next_attempt_at, created_at`
+
+	rows, err := m.db().QueryContext(ctx, query, now.Add(lease), now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*data.OutboxMessage
+
+	for rows.Next() {
+		var msg data.OutboxMessage
+		err := rows.Scan(
+			&msg.ID,
+			&msg.From,
+			&msg.To,
+			&msg.Subject,
+			&msg.BodyText,
+			&msg.BodyHTML,
+			&msg.Attempts,
+			&msg.LastError,
+			&msg.NextAttemptAt,
+			&msg.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, &msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// MarkMailSent records that a message has been sent.
+func (m *PostgresDBRepo) MarkMailSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update mail_outbox set sent_at = $1, last_error = '' where id = $2`
+	_, err := m.db().ExecContext(ctx, stmt, time.Now(), id)
+	return err
+}
+
+// RetryMail records why sending a message failed, and when to try again.
+func (m *PostgresDBRepo) RetryMail(id int, lastError string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update mail_outbox set last_error = $1, next_attempt_at = $2 where id = $3`
+	_, err := m.db().ExecContext(ctx, stmt, lastError, at, id)
+	return err
+}
+
+// FailMail records why sending a message failed, and gives up on it.
+func (m *PostgresDBRepo) FailMail(id int, lastError string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update mail_outbox set last_error = $1, failed_at = $2 where id = $3`
+	_, err := m.db().ExecContext(ctx, stmt, lastError, time.Now(), id)
+	return err
+}
@@ -0,0 +1,73 @@
+//go:build integration
+
+package dbrepo
+
+import (
+	"testing"
+	"time"
+	"webapp/pkg/data"
+)
+
+func TestPostgresDBRepoMailOutbox(t *testing.T) {
+	outbox := testRepo.(*PostgresDBRepo)
+
+	id, err := outbox.EnqueueMail(data.OutboxMessage{
+		From:     "no-reply@example.com",
+		To:       "jack@example.com",
+		Subject:  "Hello",
+		BodyText: "Hello, Jack",
+	})
+	if err != nil {
+		t.Fatalf("enqueue mail returned an error: %s", err)
+	}
+
+	now := time.Now()
+	claimed, err := outbox.ClaimMail(now, time.Minute, 10)
+	if err != nil {
+		t.Fatalf("claim mail returned an error: %s", err)
+	}
+	if len(claimed) != 1 || claimed[0].ID != id || claimed[0].Attempts != 1 {
+		t.Fatalf("expected to claim message %d on its first attempt, got %+v", id, claimed)
+	}
+	if claimed[0].To != "jack@example.com" || claimed[0].BodyText != "Hello, Jack" {
+		t.Errorf("claimed message was not stored as enqueued: %+v", claimed[0])
+	}
+
+	// a claimed message is leased to its worker
+	claimed, _ = outbox.ClaimMail(now, time.Minute, 10)
+	if len(claimed) != 0 {
+		t.Errorf("expected a leased message not to be claimed again, got %d", len(claimed))
+	}
+
+	err = outbox.RetryMail(id, "connection refused", now.Add(time.Hour))
+	if err != nil {
+		t.Errorf("retry mail returned an error: %s", err)
+	}
+	claimed, _ = outbox.ClaimMail(now.Add(2*time.Minute), time.Minute, 10)
+	if len(claimed) != 0 {
+		t.Errorf("expected a message not to be claimed before its retry is due, got %d", len(claimed))
+	}
+	claimed, _ = outbox.ClaimMail(now.Add(2*time.Hour), time.Minute, 10)
+	if len(claimed) != 1 || claimed[0].Attempts != 2 || claimed[0].LastError != "connection refused" {
+		t.Fatalf("expected the retried message on its second attempt, got %+v", claimed)
+	}
+
+	err = outbox.MarkMailSent(id)
+	if err != nil {
+		t.Errorf("mark mail sent returned an error: %s", err)
+	}
+	claimed, _ = outbox.ClaimMail(now.Add(24*time.Hour), time.Minute, 10)
+	if len(claimed) != 0 {
+		t.Errorf("expected a sent message never to be claimed again, got %d", len(claimed))
+	}
+
+	id, _ = outbox.EnqueueMail(data.OutboxMessage{From: "no-reply@example.com", To: "nobody@example.com", Subject: "Hello", BodyText: "Hello"})
+	err = outbox.FailMail(id, "no such user")
+	if err != nil {
+		t.Errorf("fail mail returned an error: %s", err)
+	}
+	claimed, _ = outbox.ClaimMail(now.Add(24*time.Hour), time.Minute, 10)
+	if len(claimed) != 0 {
+		t.Errorf("expected a failed message never to be claimed again, got %d", len(claimed))
+	}
+}
@@ -0,0 +1,191 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"webapp/pkg/repository"
+)
+
+// replicaCheckTimeout bounds each ping of a replica's health check.
+const replicaCheckTimeout = time.Second * 2
+
+// ReplicaSet is a group of read replicas of a PostgresDBRepo's primary. Reads
+// are shared between the healthy replicas in turn; a replica is unhealthy
+// from a failed read or health check until its next successful health check.
+type ReplicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+	// primaryReads counts the reads sent to the primary because no replica
+	// was healthy or the replica failed.
+	primaryReads atomic.Int64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     sync.WaitGroup
+}
+
+type replica struct {
+	name     string
+	db       *sql.DB
+	healthy  atomic.Bool
+	reads    atomic.Int64
+	failures atomic.Int64
+}
+
+// NewReplicaSet returns a set of the replicas, which all start out healthy,
+// and checks their health every interval until Close is called. An interval
+// of 0 turns the health checks off.
+func NewReplicaSet(interval time.Duration, dbs ...*sql.DB) *ReplicaSet {
+	s := &ReplicaSet{stop: make(chan struct{})}
+	for i, db := range dbs {
+		r := &replica{name: "replica-" + strconv.Itoa(i+1), db: db}
+		r.healthy.Store(true)
+		s.replicas = append(s.replicas, r)
+	}
+
+	if interval > 0 && len(s.replicas) > 0 {
+		s.done.Add(1)
+		go func() {
+			defer s.done.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.check()
+				case <-s.stop:
+					return
+				}
+			}
+		}()
+	}
+
+	return s
+}
+
+// Close stops the health checks and closes the replicas' connections.
+func (s *ReplicaSet) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.done.Wait()
+
+	var errs []error
+	for _, r := range s.replicas {
+		errs = append(errs, r.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// check pings every replica and records whether it is healthy.
+func (s *ReplicaSet) check() {
+	for _, r := range s.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+		err := r.db.PingContext(ctx)
+		cancel()
+
+		if err != nil {
+			r.fail(err)
+			continue
+		}
+		if !r.healthy.Swap(true) {
+			log.Printf("%s is healthy again", r.name)
+		}
+	}
+}
+
+// pick returns the next healthy replica, or nil if there are none.
+func (s *ReplicaSet) pick() *replica {
+	n := uint64(len(s.replicas))
+	if n == 0 {
+		return nil
+	}
+	start := s.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		r := s.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// fail marks r unhealthy after err.
+func (r *replica) fail(err error) {
+	r.failures.Add(1)
+	if r.healthy.Swap(false) {
+		log.Printf("%s is unhealthy: %s", r.name, err)
+	}
+}
+
+// PoolStats describes one of a PostgresDBRepo's connection pools.
+type PoolStats struct {
+	// Name is "primary", or "replica-" and the replica's position, from 1.
+	Name string
+	// Healthy is whether reads are sent to the pool; the primary is always
+	// healthy.
+	Healthy bool
+	// Reads counts the reads the repo routed to the pool. A repo without
+	// replicas sends every read straight to the primary, uncounted.
+	Reads int64
+	// Failures counts the reads and health checks that failed.
+	Failures int64
+	sql.DBStats
+}
+
+// read runs fn, which must only read, on the next healthy replica, or on the
+// primary if there is none or the repo is in a transaction. If the replica
+// fails, it is marked unhealthy and fn runs again on the primary. If it finds
+// no rows, fn runs again on the primary too, as the rows may have been written
+// too recently to have reached the replica.
+func (m *PostgresDBRepo) read(fn func(db dbtx) error) error {
+	if m.tx != nil || m.Replicas == nil {
+		return fn(m.db())
+	}
+
+	if r := m.Replicas.pick(); r != nil {
+		err := fn(r.db)
+		switch {
+		case err == nil:
+			r.reads.Add(1)
+			return nil
+		case errors.Is(err, sql.ErrNoRows):
+			r.reads.Add(1)
+		default:
+			r.fail(err)
+		}
+	}
+
+	m.Replicas.primaryReads.Add(1)
+	return fn(m.DB)
+}
+
+// Primary returns a repo that runs everything, reads included, on the
+// primary, so that its reads see its own writes.
+func (m *PostgresDBRepo) Primary() repository.DatabaseRepo {
+	return &PostgresDBRepo{DB: m.DB, tx: m.tx}
+}
+
+// Stats describes the primary's pool and then each replica's.
+func (m *PostgresDBRepo) Stats() []PoolStats {
+	stats := []PoolStats{{Name: "primary", Healthy: true, DBStats: m.DB.Stats()}}
+	if m.Replicas == nil {
+		return stats
+	}
+
+	stats[0].Reads = m.Replicas.primaryReads.Load()
+	for _, r := range m.Replicas.replicas {
+		stats = append(stats, PoolStats{
+			Name:     r.name,
+			Healthy:  r.healthy.Load(),
+			Reads:    r.reads.Load(),
+			Failures: r.failures.Load(),
+			DBStats:  r.db.Stats(),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,164 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestReplicaSet returns a repo with n replicas; none of the connections
+// are ever opened, so the tests need no database.
+func newTestReplicaSet(t *testing.T, n int) *PostgresDBRepo {
+	t.Helper()
+
+	open := func() *sql.DB {
+		db, err := sql.Open("pgx", "host=localhost port=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	var dbs []*sql.DB
+	for i := 0; i < n; i++ {
+		dbs = append(dbs, open())
+	}
+	repo := &PostgresDBRepo{DB: open(), Replicas: NewReplicaSet(0, dbs...)}
+	t.Cleanup(func() {
+		_ = repo.Replicas.Close()
+		_ = repo.DB.Close()
+	})
+	return repo
+}
+
+func TestPostgresDBRepo_read(t *testing.T) {
+	repo := newTestReplicaSet(t, 2)
+	replica1, replica2 := repo.Replicas.replicas[0], repo.Replicas.replicas[1]
+
+	var used []dbtx
+	read := func(err error) error {
+		return repo.read(func(db dbtx) error {
+			used = append(used, db)
+			if db == repo.DB {
+				return nil
+			}
+			return err
+		})
+	}
+
+	// reads take turns between the replicas
+	_ = read(nil)
+	_ = read(nil)
+	if used[0] == used[1] || used[0] == dbtx(repo.DB) || used[1] == dbtx(repo.DB) {
+		t.Errorf("expected reads to take turns between the replicas")
+	}
+
+	// not finding a row is not a failure, but a lagging replica may not have
+	// the row yet, so the primary is asked too
+	used = nil
+	if err := read(sql.ErrNoRows); err != nil {
+		t.Errorf("expected the read to succeed on the primary, got %s", err)
+	}
+	if len(used) != 2 || used[0] == dbtx(repo.DB) || used[1] != dbtx(repo.DB) {
+		t.Errorf("expected a read finding no rows to go to a replica and then the primary, got %d reads", len(used))
+	}
+	if !replica1.healthy.Load() || !replica2.healthy.Load() {
+		t.Errorf("expected a read finding no rows to leave the replica healthy")
+	}
+
+	// a failed read marks the replica unhealthy, and is tried on the primary
+	used = nil
+	if err := read(errors.New("connection refused")); err != nil {
+		t.Errorf("expected the read to succeed on the primary, got %s", err)
+	}
+	if len(used) != 2 || used[1] != dbtx(repo.DB) {
+		t.Fatalf("expected the read to go to a replica and then the primary, got %d reads", len(used))
+	}
+	failed, healthy := replica1, replica2
+	if used[0] == dbtx(replica2.db) {
+		failed, healthy = replica2, replica1
+	}
+
+	// with one replica down, every read goes to the other
+	used = nil
+	_ = read(nil)
+	_ = read(nil)
+	if used[0] != dbtx(healthy.db) || used[1] != dbtx(healthy.db) {
+		t.Errorf("expected reads to skip the unhealthy replica")
+	}
+
+	// with both down, reads go to the primary
+	healthy.healthy.Store(false)
+	used = nil
+	_ = read(nil)
+	if used[0] != dbtx(repo.DB) {
+		t.Errorf("expected reads to go to the primary with no healthy replicas")
+	}
+
+	stats := repo.Stats()
+	if len(stats) != 3 || stats[0].Name != "primary" || stats[0].Reads != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	for _, s := range stats[1:] {
+		expectedFailures := int64(0)
+		if s.Name == failed.name {
+			expectedFailures = 1
+		}
+		if s.Healthy || s.Failures != expectedFailures {
+			t.Errorf("unexpected stats for %s: %+v", s.Name, s)
+		}
+	}
+	if stats[1].Reads+stats[2].Reads != 5 {
+		t.Errorf("expected the replicas to have served 5 reads, got %d and %d", stats[1].Reads, stats[2].Reads)
+	}
+}
+
+func TestPostgresDBRepo_Primary(t *testing.T) {
+	repo := newTestReplicaSet(t, 1)
+
+	primary := repo.Primary().(*PostgresDBRepo)
+	var used dbtx
+	_ = primary.read(func(db dbtx) error {
+		used = db
+		return nil
+	})
+	if used != dbtx(repo.DB) {
+		t.Error("expected the primary repo to read from the primary")
+	}
+	if stats := repo.Stats(); stats[1].Reads != 0 {
+		t.Errorf("expected no reads from the replica, got %d", stats[1].Reads)
+	}
+}
+
+func TestReplicaSet_check(t *testing.T) {
+	repo := newTestReplicaSet(t, 1)
+	replica := repo.Replicas.replicas[0]
+
+	// the replica's connection is closed, so its health check fails
+	_ = replica.db.Close()
+	repo.Replicas.check()
+	if replica.healthy.Load() || replica.failures.Load() != 1 {
+		t.Errorf("expected a closed replica to be unhealthy after a check")
+	}
+}
+
+func TestReplicaSet_Close(t *testing.T) {
+	db, _ := sql.Open("pgx", "host=localhost port=1")
+	_ = db.Close()
+	s := NewReplicaSet(time.Millisecond, db)
+	time.Sleep(5 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		_ = s.Close()
+		_ = s.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+}
@@ -0,0 +1,602 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// memoryBcryptCost is the cost MemoryDBRepo hashes passwords with. It is the
+// lowest bcrypt allows, as the repo is for tests, which would be slow with the
+// cost PostgresDBRepo uses; the hashes work with PasswordMatches all the same.
+const memoryBcryptCost = bcrypt.MinCost
+
+// MemoryDBRepo is a DatabaseRepo that keeps everything in memory. Unlike
+// TestDBRepo it stores what it is given, and it behaves as PostgresDBRepo
+// does, down to the errors it returns, so tests can check that what they wrote
+// can be read back. Use NewMemoryDBRepo to make one; it is safe for
+// concurrent use.
+type MemoryDBRepo struct {
+	// mu guards state, and is held for the whole of a WithTx.
+	mu    *sync.Mutex
+	state *memoryState
+	// inTx is set on the repo handed out by WithTx, which runs with mu held.
+	inTx bool
+}
+
+// memoryState is the contents of a MemoryDBRepo's tables.
+type memoryState struct {
+	users       map[int]data.User
+	images      map[int]data.UserImage
+	lastUserID  int
+	lastImageID int
+}
+
+// NewMemoryDBRepo returns an empty MemoryDBRepo.
+func NewMemoryDBRepo() *MemoryDBRepo {
+	return &MemoryDBRepo{
+		mu: &sync.Mutex{},
+		state: &memoryState{
+			users:  map[int]data.User{},
+			images: map[int]data.UserImage{},
+		},
+	}
+}
+
+// clone returns a deep copy of s, for rolling back to.
+func (s *memoryState) clone() *memoryState {
+	c := *s
+	c.users = make(map[int]data.User, len(s.users))
+	for id, u := range s.users {
+		if u.DeletedAt != nil {
+			deletedAt := *u.DeletedAt
+			u.DeletedAt = &deletedAt
+		}
+		c.users[id] = u
+	}
+	c.images = make(map[int]data.UserImage, len(s.images))
+	for id, i := range s.images {
+		c.images[id] = i
+	}
+	return &c
+}
+
+// lock locks the repo for one method, unless it is already locked by WithTx,
+// and returns the function that unlocks it.
+func (m *MemoryDBRepo) lock() func() {
+	if m.inTx {
+		return func() {}
+	}
+	m.mu.Lock()
+	return m.mu.Unlock
+}
+
+// Seed stores users as they are, as if they had been loaded from a dump: the
+// Password of each must already be a bcrypt hash. A user without an ID gets
+// the next one, a zero Version becomes 1 and zero times become now. Seed
+// returns the users' ids.
+func (m *MemoryDBRepo) Seed(users ...data.User) []int {
+	defer m.lock()()
+
+	ids := make([]int, len(users))
+	now := time.Now()
+	for i, u := range users {
+		if u.ID == 0 {
+			m.state.lastUserID++
+			u.ID = m.state.lastUserID
+		} else if u.ID > m.state.lastUserID {
+			m.state.lastUserID = u.ID
+		}
+		if u.Version == 0 {
+			u.Version = 1
+		}
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = now
+		}
+		if u.UpdatedAt.IsZero() {
+			u.UpdatedAt = now
+		}
+		if u.DeletedAt != nil {
+			deletedAt := *u.DeletedAt
+			u.DeletedAt = &deletedAt
+		}
+		u.ProfilePic = data.UserImage{}
+		m.state.users[u.ID] = u
+		ids[i] = u.ID
+	}
+	return ids
+}
+
+// SeedImages stores profile images as they are, and returns their ids. As
+// with Seed, images without an ID get the next one and zero times become now.
+func (m *MemoryDBRepo) SeedImages(images ...data.UserImage) []int {
+	defer m.lock()()
+
+	ids := make([]int, len(images))
+	now := time.Now()
+	for i, image := range images {
+		if image.ID == 0 {
+			m.state.lastImageID++
+			image.ID = m.state.lastImageID
+		} else if image.ID > m.state.lastImageID {
+			m.state.lastImageID = image.ID
+		}
+		if image.CreatedAt.IsZero() {
+			image.CreatedAt = now
+		}
+		if image.UpdatedAt.IsZero() {
+			image.UpdatedAt = now
+		}
+		m.state.images[image.ID] = image
+		ids[i] = image.ID
+	}
+	return ids
+}
+
+func (m *MemoryDBRepo) Connection() *sql.DB {
+	return nil
+}
+
+// WithTx calls fn with a repo whose changes are undone if fn returns an
+// error. Transactions run one at a time, and fn must use only the repo it is
+// given: calling m from inside fn would wait forever.
+func (m *MemoryDBRepo) WithTx(fn func(repo repository.DatabaseRepo) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := m.state.clone()
+	err := fn(&MemoryDBRepo{mu: m.mu, state: m.state, inTx: true})
+	if err != nil {
+		// keep the ids handed out, as a Postgres sequence does
+		saved.lastUserID, saved.lastImageID = m.state.lastUserID, m.state.lastImageID
+		*m.state = *saved
+	}
+	return err
+}
+
+// Primary returns the repo itself, which has no replicas.
+func (m *MemoryDBRepo) Primary() repository.DatabaseRepo {
+	return m
+}
+
+// liveUsers returns copies of the users that have not been deleted, in id
+// order.
+func (m *MemoryDBRepo) liveUsers() []*data.User {
+	var users []*data.User
+	for _, u := range m.state.users {
+		if u.DeletedAt == nil {
+			u := u
+			users = append(users, &u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+// AllUsers returns all users that have not been deleted, by last name
+func (m *MemoryDBRepo) AllUsers() ([]*data.User, error) {
+	defer m.lock()()
+
+	users := m.liveUsers()
+	sort.SliceStable(users, func(i, j int) bool { return users[i].LastName < users[j].LastName })
+	return users, nil
+}
+
+// SearchUsers returns up to limit users, skipping the first offset, whose name
+// or email contains term, ignoring case, along with the total number of
+// matching users
+func (m *MemoryDBRepo) SearchUsers(term string, limit, offset int) ([]*data.User, int, error) {
+	if limit < 0 || offset < 0 {
+		// as Postgres refuses them
+		return nil, 0, fmt.Errorf("limit and offset must not be negative")
+	}
+
+	defer m.lock()()
+
+	term = strings.ToLower(term)
+	var matches []*data.User
+	for _, u := range m.liveUsers() {
+		for _, field := range []string{u.Email, u.FirstName, u.LastName, u.FirstName + " " + u.LastName} {
+			if strings.Contains(strings.ToLower(field), term) {
+				matches = append(matches, u)
+				break
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].LastName != matches[j].LastName {
+			return matches[i].LastName < matches[j].LastName
+		}
+		return matches[i].FirstName < matches[j].FirstName
+	})
+
+	total := len(matches)
+	if offset > total {
+		offset = total
+	}
+	matches = matches[offset:]
+	if limit < len(matches) {
+		matches = matches[:limit]
+	}
+	return matches, total, nil
+}
+
+// withProfilePic returns a copy of u with its profile image's file name set,
+// as the Postgres queries that join user_images do.
+func (m *MemoryDBRepo) withProfilePic(u data.User) *data.User {
+	var ids []int
+	for id, image := range m.state.images {
+		if image.UserID == u.ID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		sort.Ints(ids)
+		u.ProfilePic.FileName = m.state.images[ids[0]].FileName
+	}
+	return &u
+}
+
+// GetUser returns one user by id, unless they have been deleted, or
+// sql.ErrNoRows
+func (m *MemoryDBRepo) GetUser(id int) (*data.User, error) {
+	defer m.lock()()
+
+	u, ok := m.state.users[id]
+	if !ok || u.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+	return m.withProfilePic(u), nil
+}
+
+// GetUserByEmail returns one user by email address, unless they have been
+// deleted, or sql.ErrNoRows
+func (m *MemoryDBRepo) GetUserByEmail(email string) (*data.User, error) {
+	defer m.lock()()
+
+	for _, u := range m.liveUsers() {
+		if u.Email == email {
+			return m.withProfilePic(*u), nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// GetUsersByEmail returns the users with any of the email addresses, unless
+// they have been deleted
+func (m *MemoryDBRepo) GetUsersByEmail(emails []string) ([]*data.User, error) {
+	defer m.lock()()
+
+	wanted := make(map[string]bool, len(emails))
+	for _, email := range emails {
+		wanted[email] = true
+	}
+
+	var users []*data.User
+	for _, u := range m.liveUsers() {
+		if wanted[u.Email] {
+			users = append(users, m.withProfilePic(*u))
+		}
+	}
+	return users, nil
+}
+
+// UpdateUser updates one user's details, returning repository.ErrConflict if
+// u.Version is not their current version, or sql.ErrNoRows if there is no
+// such user
+func (m *MemoryDBRepo) UpdateUser(u data.User) error {
+	defer m.lock()()
+
+	if err := checkUser(u); err != nil {
+		return err
+	}
+
+	stored, ok := m.state.users[u.ID]
+	if !ok || stored.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	if stored.Version != u.Version {
+		return repository.ErrConflict
+	}
+
+	stored.Email = u.Email
+	stored.FirstName = u.FirstName
+	stored.LastName = u.LastName
+	stored.IsAdmin = u.IsAdmin
+	stored.Version++
+	stored.UpdatedAt = time.Now()
+	m.state.users[u.ID] = stored
+	return nil
+}
+
+// DeleteUser soft deletes one user, by id
+func (m *MemoryDBRepo) DeleteUser(id int) error {
+	defer m.lock()()
+
+	u, ok := m.state.users[id]
+	if ok && u.DeletedAt == nil {
+		now := time.Now()
+		u.DeletedAt = &now
+		m.state.users[id] = u
+	}
+	return nil
+}
+
+// DeletedUsers returns every soft deleted user, most recently deleted first
+func (m *MemoryDBRepo) DeletedUsers() ([]*data.User, error) {
+	defer m.lock()()
+
+	var users []*data.User
+	for _, u := range m.state.users {
+		if u.DeletedAt != nil {
+			u := u
+			deletedAt := *u.DeletedAt
+			u.DeletedAt = &deletedAt
+			users = append(users, &u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].DeletedAt.Equal(*users[j].DeletedAt) {
+			return users[i].DeletedAt.After(*users[j].DeletedAt)
+		}
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+// RestoreUser undoes the soft delete of one user, by id. It returns
+// sql.ErrNoRows if there is no deleted user with that id, or
+// repository.ErrConflict if another user has their email address now
+func (m *MemoryDBRepo) RestoreUser(id int) error {
+	defer m.lock()()
+
+	u, ok := m.state.users[id]
+	if !ok || u.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+	for _, live := range m.liveUsers() {
+		if live.Email == u.Email {
+			return repository.ErrConflict
+		}
+	}
+	u.DeletedAt = nil
+	u.UpdatedAt = time.Now()
+	m.state.users[id] = u
+	return nil
+}
+
+// PurgeDeletedUsers permanently deletes the users soft deleted before the
+// given time, along with their profile images, and returns how many there
+// were
+func (m *MemoryDBRepo) PurgeDeletedUsers(before time.Time) (int, error) {
+	defer m.lock()()
+
+	n := 0
+	for id, u := range m.state.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(before) {
+			delete(m.state.users, id)
+			m.deleteImages(id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// deleteImages deletes the profile images of the user with the given id.
+func (m *MemoryDBRepo) deleteImages(userID int) {
+	for id, image := range m.state.images {
+		if image.UserID == userID {
+			delete(m.state.images, id)
+		}
+	}
+}
+
+// checkLength returns the error Postgres would for a value too long for a
+// varchar(255) column.
+func checkLength(column, value string) error {
+	if utf8.RuneCountInString(value) > 255 {
+		return fmt.Errorf("%s: value too long for type character varying(255)", column)
+	}
+	return nil
+}
+
+// checkUser checks a user's columns as Postgres would.
+func checkUser(u data.User) error {
+	for _, c := range []struct{ column, value string }{
+		{"email", u.Email},
+		{"first_name", u.FirstName},
+		{"last_name", u.LastName},
+	} {
+		if err := checkLength(c.column, c.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insert stores a new user with a hash of their password, defaulting the
+// columns the database would.
+func (m *MemoryDBRepo) insert(user data.User, hash []byte) {
+	now := time.Now()
+	user.Password = string(hash)
+	user.Version = 1
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	user.DeletedAt = nil
+	user.ProfilePic = data.UserImage{}
+	m.state.users[user.ID] = user
+}
+
+// InsertUser inserts a new user, and returns their id
+func (m *MemoryDBRepo) InsertUser(user data.User) (int, error) {
+	if err := checkUser(user); err != nil {
+		return 0, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), memoryBcryptCost)
+	if err != nil {
+		return 0, err
+	}
+
+	defer m.lock()()
+
+	m.state.lastUserID++
+	user.ID = m.state.lastUserID
+	m.insert(user, hash)
+	return user.ID, nil
+}
+
+// InsertUserWithID inserts a new user with the id in user.ID, or returns
+// repository.ErrConflict if the id is taken, by a deleted user too
+func (m *MemoryDBRepo) InsertUserWithID(user data.User) error {
+	if err := checkUser(user); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), memoryBcryptCost)
+	if err != nil {
+		return err
+	}
+
+	defer m.lock()()
+
+	if _, ok := m.state.users[user.ID]; ok {
+		return repository.ErrConflict
+	}
+	if user.ID > m.state.lastUserID {
+		m.state.lastUserID = user.ID
+	}
+	m.insert(user, hash)
+	return nil
+}
+
+// ImportUsers inserts users all at once, and returns their ids in order. See
+// PostgresDBRepo.ImportUsers.
+func (m *MemoryDBRepo) ImportUsers(users []data.User, bestEffort bool) ([]int, error) {
+	seen := make(map[string]bool, len(users))
+	hashes := make([][]byte, len(users))
+	for i, u := range users {
+		if seen[u.Email] {
+			return nil, fmt.Errorf("%s appears more than once in the import", u.Email)
+		}
+		seen[u.Email] = true
+		if err := checkUser(u); err != nil {
+			return nil, err
+		}
+
+		var err error
+		hashes[i], err = bcrypt.GenerateFromPassword([]byte(u.Password), memoryBcryptCost)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	defer m.lock()()
+
+	inUse := make(map[string]bool)
+	for _, u := range m.liveUsers() {
+		inUse[u.Email] = true
+	}
+	if !bestEffort {
+		for _, u := range users {
+			if inUse[u.Email] {
+				return nil, repository.ErrConflict
+			}
+		}
+	}
+
+	ids := make([]int, len(users))
+	for i, u := range users {
+		if inUse[u.Email] {
+			continue
+		}
+		m.state.lastUserID++
+		u.ID = m.state.lastUserID
+		m.insert(u, hashes[i])
+		ids[i] = u.ID
+	}
+	return ids, nil
+}
+
+// EachUser calls fn with every user that is not deleted, in id order, until
+// fn returns an error
+func (m *MemoryDBRepo) EachUser(fn func(u *data.User) error) error {
+	unlock := m.lock()
+	users := m.liveUsers()
+	unlock()
+
+	for _, u := range users {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetPassword changes a user's password
+func (m *MemoryDBRepo) ResetPassword(id int, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), memoryBcryptCost)
+	if err != nil {
+		return err
+	}
+
+	defer m.lock()()
+
+	u, ok := m.state.users[id]
+	if ok {
+		u.Password = string(hash)
+		u.UpdatedAt = time.Now()
+		m.state.users[id] = u
+	}
+	return nil
+}
+
+// VerifyUserEmail records that the user with the given id has verified their
+// email address
+func (m *MemoryDBRepo) VerifyUserEmail(id int) error {
+	defer m.lock()()
+
+	u, ok := m.state.users[id]
+	if ok {
+		u.EmailVerified = true
+		u.Version++
+		u.UpdatedAt = time.Now()
+		m.state.users[id] = u
+	}
+	return nil
+}
+
+// InsertUserImage replaces a user's profile image, and returns the new
+// image's id. As in Postgres, the user must exist, though they may be
+// deleted.
+func (m *MemoryDBRepo) InsertUserImage(i data.UserImage) (int, error) {
+	defer m.lock()()
+
+	if _, ok := m.state.users[i.UserID]; !ok {
+		return 0, fmt.Errorf("user_images: no user with id %d", i.UserID)
+	}
+	if err := checkLength("file_name", i.FileName); err != nil {
+		return 0, err
+	}
+
+	m.deleteImages(i.UserID)
+	m.state.lastImageID++
+	now := time.Now()
+	m.state.images[m.state.lastImageID] = data.UserImage{
+		ID:        m.state.lastImageID,
+		UserID:    i.UserID,
+		FileName:  i.FileName,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	return m.state.lastImageID, nil
+}
@@ -0,0 +1,90 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"sync"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+	"webapp/pkg/repository/repotest"
+)
+
+func TestMemoryDBRepoConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repository.DatabaseRepo {
+		return NewMemoryDBRepo()
+	})
+}
+
+func TestMemoryDBRepo_Seed(t *testing.T) {
+	repo := NewMemoryDBRepo()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	deletedAt := time.Now().Add(-time.Hour)
+	ids := repo.Seed(
+		data.User{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@example.com", Password: string(hash), IsAdmin: true},
+		data.User{FirstName: "New", LastName: "User", Email: "new@example.com"},
+		data.User{ID: 5, FirstName: "Deleted", LastName: "User", Email: "deleted@example.com", DeletedAt: &deletedAt},
+	)
+	if len(ids) != 3 || ids[0] != 1 || ids[1] != 2 || ids[2] != 5 {
+		t.Fatalf("expected ids 1, 2 and 5, got %v", ids)
+	}
+	repo.SeedImages(data.UserImage{UserID: 1, FileName: "admin.jpg"})
+
+	admin, err := repo.GetUser(1)
+	if err != nil || admin.Version != 1 || admin.CreatedAt.IsZero() || admin.ProfilePic.FileName != "admin.jpg" {
+		t.Errorf("expected the seeded admin with defaults and a picture; got %+v, %v", admin, err)
+	}
+	if ok, _ := admin.PasswordMatches("secret"); !ok {
+		t.Error("expected a seeded password hash to be stored as it is")
+	}
+
+	if _, err := repo.GetUser(5); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected a user seeded as deleted to be hidden, got %v", err)
+	}
+	if err := repo.RestoreUser(5); err != nil {
+		t.Errorf("expected a user seeded as deleted to be restorable, got %v", err)
+	}
+
+	id, _ := repo.InsertUser(data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Password: "secret"})
+	if id != 6 {
+		t.Errorf("expected the first inserted user to follow the seeded ones, got %d", id)
+	}
+
+	// what a caller does with a user it read must not change the stored one
+	admin.FirstName = "Changed"
+	if stored, _ := repo.GetUser(1); stored.FirstName != "Admin" {
+		t.Errorf("expected the stored user to be unchanged, got %q", stored.FirstName)
+	}
+}
+
+func TestMemoryDBRepo_concurrentUse(t *testing.T) {
+	repo := NewMemoryDBRepo()
+	id := repo.Seed(data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com"})[0]
+
+	// each transaction reads and updates the user, so none may interleave
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := repo.WithTx(func(repo repository.DatabaseRepo) error {
+				user, err := repo.GetUser(id)
+				if err != nil {
+					return err
+				}
+				return repo.UpdateUser(*user)
+			})
+			if err != nil {
+				t.Errorf("update in a transaction returned an error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	user, _ := repo.GetUser(id)
+	if user.Version != 21 {
+		t.Errorf("expected 20 updates, but the user is at version %d", user.Version)
+	}
+}
@@ -0,0 +1,562 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// PgxDBRepo is a DatabaseRepo on a native pgx pool rather than database/sql.
+// Its hot reads run as statements prepared on every connection, so the pool
+// must be opened with PreparePgxStatements as its AfterConnect. Lookups of
+// many users are sent as one batch, and imports are loaded with COPY.
+type PgxDBRepo struct {
+	Pool *pgxpool.Pool
+	// tx is the transaction the repo runs its statements in, if it was
+	// handed out by WithTx.
+	tx pgx.Tx
+}
+
+// pgxQuerier is the part of *pgxpool.Pool and pgx.Tx that the repo's
+// statements use.
+type pgxQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// The names of the prepared statements, which pgx runs in place of SQL.
+const (
+	pgxAllUsers       = "all_users"
+	pgxGetUser        = "get_user"
+	pgxGetUserByEmail = "get_user_by_email"
+)
+
+// pgxStatements are prepared on each connection by PreparePgxStatements.
+var pgxStatements = map[string]string{
+	pgxAllUsers:       sqlAllUsers,
+	pgxGetUser:        sqlGetUser,
+	pgxGetUserByEmail: sqlGetUserByEmail,
+}
+
+// PreparePgxStatements prepares the statements PgxDBRepo runs by name on
+// conn; it is meant to be a pgxpool.Config's AfterConnect.
+func PreparePgxStatements(ctx context.Context, conn *pgx.Conn) error {
+	for name, query := range pgxStatements {
+		if _, err := conn.Prepare(ctx, name, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// q returns what the repo's statements run on: its transaction, if it has
+// one, or the pool.
+func (m *PgxDBRepo) q() pgxQuerier {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.Pool
+}
+
+// noRows turns pgx's error for a missing row into the sql.ErrNoRows that
+// callers of a DatabaseRepo check for.
+func noRows(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// scanUser scans a row of the prepared get_user statements.
+func scanUser(row pgx.Row) (*data.User, error) {
+	var user data.User
+	err := row.Scan(userFields(&user, &user.ProfilePic.FileName)...)
+	if err != nil {
+		return nil, noRows(err)
+	}
+	return &user, nil
+}
+
+// WithTx calls fn with a repo whose methods all run in one transaction, and
+// commits it if fn returns nil or rolls it back otherwise. Called on a repo
+// that is already in a transaction, it joins that transaction.
+func (m *PgxDBRepo) WithTx(fn func(repo repository.DatabaseRepo) error) error {
+	return m.inTx(func(tx *PgxDBRepo) error {
+		return fn(tx)
+	})
+}
+
+// inTx is WithTx for the repo's own methods that take several statements.
+func (m *PgxDBRepo) inTx(fn func(tx *PgxDBRepo) error) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), txTimeout)
+	defer cancel()
+
+	tx, err := m.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = fn(&PgxDBRepo{Pool: m.Pool, tx: tx})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Connection returns nil, as the repo does not use database/sql.
+func (m *PgxDBRepo) Connection() *sql.DB {
+	return nil
+}
+
+// Primary returns the repo itself, which has no replicas.
+func (m *PgxDBRepo) Primary() repository.DatabaseRepo {
+	return m
+}
+
+// AllUsers returns all users that have not been deleted, ordered by last name
+func (m *PgxDBRepo) AllUsers() ([]*data.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := m.q().Query(ctx, pgxAllUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*data.User
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(userFields(&user)...)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+// SearchUsers returns up to limit users, skipping the first offset, whose name
+// or email contains term, along with the total number of matching users. An
+// empty term matches every user. Deleted users are never matched.
+func (m *PgxDBRepo) SearchUsers(term string, limit, offset int) ([]*data.User, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	pattern := searchPattern(term)
+
+	rows, err := m.q().Query(ctx, sqlSearchUsers, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []*data.User
+	total := 0
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(userFields(&user, &total)...)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// an offset past the end returns no rows, and so no total; count them
+	if len(users) == 0 && offset > 0 {
+		err = m.q().QueryRow(ctx, sqlCountSearchUsers, pattern).Scan(&total)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return users, total, nil
+}
+
+// GetUser returns one user by id, unless they have been deleted
+func (m *PgxDBRepo) GetUser(id int) (*data.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return scanUser(m.q().QueryRow(ctx, pgxGetUser, id))
+}
+
+// GetUserByEmail returns one user by email address, unless they have been deleted
+func (m *PgxDBRepo) GetUserByEmail(email string) (*data.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	return scanUser(m.q().QueryRow(ctx, pgxGetUserByEmail, email))
+}
+
+// GetUsersByEmail returns the users with any of the email addresses, unless
+// they have been deleted, looking them all up in one batch.
+func (m *PgxDBRepo) GetUsersByEmail(emails []string) ([]*data.User, error) {
+	if len(emails) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	batch := &pgx.Batch{}
+	for _, email := range emails {
+		batch.Queue(pgxGetUserByEmail, email)
+	}
+
+	results := m.q().SendBatch(ctx, batch)
+	defer results.Close()
+
+	var users []*data.User
+	seen := make(map[int]bool, len(emails))
+	for range emails {
+		user, err := scanUser(results.QueryRow())
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// an address asked for twice finds the user twice
+		if !seen[user.ID] {
+			seen[user.ID] = true
+			users = append(users, user)
+		}
+	}
+
+	return users, results.Close()
+}
+
+// UpdateUser updates one user in the database, unless they have been updated
+// by someone else since u was read, in which case it returns
+// repository.ErrConflict. u.Version must be the version that was read; each
+// update increments it. It returns sql.ErrNoRows if there is no such user.
+func (m *PgxDBRepo) UpdateUser(u data.User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tag, err := m.q().Exec(ctx, sqlUpdateUser,
+		u.Email,
+		u.FirstName,
+		u.LastName,
+		u.IsAdmin,
+		u.ID,
+		u.Version,
+	)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		// either the version or the user is gone
+		var exists bool
+		err = m.q().QueryRow(ctx, sqlUserExists, u.ID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+		return repository.ErrConflict
+	}
+
+	return nil
+}
+
+// DeleteUser soft deletes one user, by id; see PostgresDBRepo.DeleteUser.
+func (m *PgxDBRepo) DeleteUser(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := m.q().Exec(ctx, sqlDeleteUser, id)
+	return err
+}
+
+// DeletedUsers returns every soft deleted user, most recently deleted first.
+func (m *PgxDBRepo) DeletedUsers() ([]*data.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := m.q().Query(ctx, sqlDeletedUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*data.User
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(userFields(&user, &user.DeletedAt)...)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+// RestoreUser undoes the soft delete of one user, by id. It returns
+// sql.ErrNoRows if there is no deleted user with that id, and
+// repository.ErrConflict if another user has their email address now.
+func (m *PgxDBRepo) RestoreUser(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tag, err := m.q().Exec(ctx, sqlRestoreUser, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+
+	var deleted bool
+	if err := m.q().QueryRow(ctx, sqlIsDeletedUser, id).Scan(&deleted); err != nil {
+		return err
+	}
+	if deleted {
+		return repository.ErrConflict
+	}
+	return sql.ErrNoRows
+}
+
+// PurgeDeletedUsers permanently deletes the users that were soft deleted
+// before the given time, along with their profile images, and returns how
+// many users were removed. Both deletes go to the database in one batch.
+func (m *PgxDBRepo) PurgeDeletedUsers(before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var n int64
+	err := m.inTx(func(tx *PgxDBRepo) error {
+		batch := &pgx.Batch{}
+		batch.Queue(sqlPurgeUserImages, before)
+		batch.Queue(sqlPurgeDeletedUsers, before)
+
+		results := tx.q().SendBatch(ctx, batch)
+		defer results.Close()
+
+		if _, err := results.Exec(); err != nil {
+			return err
+		}
+		tag, err := results.Exec()
+		if err != nil {
+			return err
+		}
+		n = tag.RowsAffected()
+
+		return results.Close()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
+func (m *PgxDBRepo) InsertUser(user data.User) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	err = m.q().QueryRow(ctx, sqlInsertUser,
+		user.Email,
+		user.FirstName,
+		user.LastName,
+		string(hashedPassword),
+		user.IsAdmin,
+		user.EmailVerified,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// InsertUserWithID inserts a new user with the id in user.ID; see
+// PostgresDBRepo.InsertUserWithID.
+func (m *PgxDBRepo) InsertUserWithID(user data.User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	if err != nil {
+		return err
+	}
+
+	return m.inTx(func(tx *PgxDBRepo) error {
+		tag, err := tx.q().Exec(ctx, sqlInsertUserWithID,
+			user.ID,
+			user.Email,
+			user.FirstName,
+			user.LastName,
+			string(hashedPassword),
+			user.IsAdmin,
+			user.EmailVerified,
+		)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return repository.ErrConflict
+		}
+
+		_, err = tx.q().Exec(ctx, sqlSyncUserIDSequence)
+		return err
+	})
+}
+
+// ResetPassword is the method we will use to change a user's password.
+func (m *PgxDBRepo) ResetPassword(id int, password string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.q().Exec(ctx, sqlResetPassword, string(hashedPassword), id)
+	return err
+}
+
+// VerifyUserEmail records that the user with the given id has verified their
+// email address.
+func (m *PgxDBRepo) VerifyUserEmail(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := m.q().Exec(ctx, sqlVerifyUserEmail, id)
+	return err
+}
+
+// InsertUserImage replaces a user's profile image, sending the delete and the
+// insert in one batch, and returns the new image's id.
+func (m *PgxDBRepo) InsertUserImage(i data.UserImage) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// replace the user's picture, or leave it alone if that fails
+	var newID int
+	err := m.inTx(func(tx *PgxDBRepo) error {
+		batch := &pgx.Batch{}
+		batch.Queue(sqlDeleteUserImages, i.UserID)
+		batch.Queue(sqlInsertUserImage, i.UserID, i.FileName)
+
+		results := tx.q().SendBatch(ctx, batch)
+		defer results.Close()
+
+		if _, err := results.Exec(); err != nil {
+			return err
+		}
+		if err := results.QueryRow().Scan(&newID); err != nil {
+			return err
+		}
+
+		return results.Close()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// ImportUsers inserts users with COPY, all in one transaction, and returns
+// their new ids in the order given; see PostgresDBRepo.ImportUsers. Unlike
+// that repo's, it can run inside WithTx.
+func (m *PgxDBRepo) ImportUsers(users []data.User, bestEffort bool) ([]int, error) {
+	index, err := importIndex(users)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err := hashPasswords(users)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	// inside WithTx this begins a savepoint
+	var tx pgx.Tx
+	if m.tx != nil {
+		tx, err = m.tx.Begin(ctx)
+	} else {
+		tx, err = m.Pool.Begin(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	ids, err := copyUsers(ctx, tx, users, index, hashes, bestEffort)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, tx.Commit(ctx)
+}
+
+// EachUser calls fn with every user that is not deleted, in id order, reading
+// them from the database as it goes. It stops at the first error fn returns,
+// and returns it.
+func (m *PgxDBRepo) EachUser(fn func(u *data.User) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	rows, err := m.q().Query(ctx, sqlEachUser)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(userFields(&user)...)
+		if err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
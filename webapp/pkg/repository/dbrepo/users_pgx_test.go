@@ -0,0 +1,132 @@
+//go:build integration
+
+package dbrepo
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+	"webapp/pkg/repository/repotest"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// newTestPool opens a pgx pool on the test database, as the apps do.
+func newTestPool(tb testing.TB) *pgxpool.Pool {
+	tb.Helper()
+
+	config, err := pgxpool.ParseConfig(testDSN)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	config.AfterConnect = PreparePgxStatements
+
+	pool, err := pgxpool.ConnectConfig(context.Background(), config)
+	if err != nil {
+		tb.Fatalf("could not open a pgx pool: %s", err)
+	}
+	tb.Cleanup(pool.Close)
+	return pool
+}
+
+// emptyTables empties the tables and restarts their ids, as the tests in
+// users_postgres_test.go expect.
+func emptyTables(tb testing.TB) {
+	tb.Helper()
+	_, err := testDB.Exec(`truncate users, user_images restart identity`)
+	if err != nil {
+		tb.Fatalf("error emptying the tables: %s", err)
+	}
+}
+
+func TestPgxDBRepoConformance(t *testing.T) {
+	repo := &PgxDBRepo{Pool: newTestPool(t)}
+	t.Cleanup(func() { emptyTables(t) })
+
+	repotest.Run(t, func(t *testing.T) repository.DatabaseRepo {
+		emptyTables(t)
+		return repo
+	})
+}
+
+func TestPgxDBRepo_importUsersInTx(t *testing.T) {
+	repo := &PgxDBRepo{Pool: newTestPool(t)}
+	t.Cleanup(func() { emptyTables(t) })
+
+	// unlike PostgresDBRepo's, the import joins the transaction, and can run
+	// twice in it
+	err := repo.WithTx(func(tx repository.DatabaseRepo) error {
+		for _, email := range []string{"first@example.com", "second@example.com"} {
+			_, err := tx.ImportUsers([]data.User{{FirstName: "Imported", LastName: "User", Email: email, Password: "secret"}}, false)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("import in WithTx returned an error: %s", err)
+	}
+
+	users, err := repo.GetUsersByEmail([]string{"first@example.com", "second@example.com"})
+	if err != nil || len(users) != 2 {
+		t.Errorf("expected both imported users; got %v, %v", users, err)
+	}
+}
+
+// benchmarkUsers is how many users the benchmarks read.
+const benchmarkUsers = 100
+
+// benchmarkRepos returns the two Postgres repos, reading the same
+// benchmarkUsers users.
+func benchmarkRepos(b *testing.B) []struct {
+	name string
+	repo repository.DatabaseRepo
+} {
+	emptyTables(b)
+	b.Cleanup(func() { emptyTables(b) })
+
+	users := make([]data.User, benchmarkUsers)
+	for i := range users {
+		users[i] = data.User{FirstName: "Bench", LastName: fmt.Sprintf("User %03d", i), Email: fmt.Sprintf("bench%d@example.com", i), Password: "secret"}
+	}
+	sqlRepo := &PostgresDBRepo{DB: testDB}
+	if _, err := sqlRepo.ImportUsers(users, false); err != nil {
+		b.Fatalf("error importing users: %s", err)
+	}
+
+	return []struct {
+		name string
+		repo repository.DatabaseRepo
+	}{
+		{"sql", sqlRepo},
+		{"pgx", &PgxDBRepo{Pool: newTestPool(b)}},
+	}
+}
+
+func BenchmarkAllUsers(b *testing.B) {
+	for _, e := range benchmarkRepos(b) {
+		b.Run(e.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				users, err := e.repo.AllUsers()
+				if err != nil || len(users) != benchmarkUsers {
+					b.Fatalf("expected %d users; got %d, %v", benchmarkUsers, len(users), err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetUser(b *testing.B) {
+	for _, e := range benchmarkRepos(b) {
+		b.Run(e.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := e.repo.GetUser(i%benchmarkUsers + 1); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -3,90 +3,191 @@ package dbrepo
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"github.com/jackc/pgx/v4/stdlib"
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"time"
 	"webapp/pkg/data"
+	"webapp/pkg/repository"
 )
 
 const dbTimeout = time.Second * 3
 
+// bulkTimeout bounds the statements that read or write many users at once.
+const bulkTimeout = time.Minute * 10
+
+// txTimeout bounds a transaction begun by WithTx.
+const txTimeout = time.Minute
+
 type PostgresDBRepo struct {
+	// DB is the primary, which runs everything that Replicas does not.
 	DB *sql.DB
+	// Replicas, if set, serves AllUsers, GetUser and GetUserByEmail outside
+	// transactions.
+	Replicas *ReplicaSet
+	// tx is the transaction the repo runs its statements in, if it was
+	// handed out by WithTx.
+	tx *sql.Tx
+}
+
+// dbtx is the part of *sql.DB and *sql.Tx that the repo's statements use.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// db returns what the repo's statements run on: its transaction, if it has
+// one, or the database.
+func (m *PostgresDBRepo) db() dbtx {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
+
+// WithTx calls fn with a repo whose methods all run in one transaction, and
+// commits it if fn returns nil or rolls it back otherwise. Called on a repo
+// that is already in a transaction, it joins that transaction.
+func (m *PostgresDBRepo) WithTx(fn func(repo repository.DatabaseRepo) error) error {
+	return m.inTx(func(tx *PostgresDBRepo) error {
+		return fn(tx)
+	})
+}
+
+// inTx is WithTx for the repo's own methods that take several statements.
+func (m *PostgresDBRepo) inTx(fn func(tx *PostgresDBRepo) error) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), txTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(&PostgresDBRepo{DB: m.DB, tx: tx})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (m *PostgresDBRepo) Connection() *sql.DB {
 	return m.DB
 }
 
-// AllUsers returns all users as a slice of *data.User
+// AllUsers returns all users that have not been deleted as a slice of *data.User
 func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
+	var users []*data.User
+
+	err := m.read(func(db dbtx) error {
+		ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+		defer cancel()
+
+		rows, err := db.QueryContext(ctx, sqlAllUsers)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		users = nil
+		for rows.Next() {
+			var user data.User
+			err := rows.Scan(userFields(&user)...)
+			if err != nil {
+				log.Println("Error scanning", err)
+				return err
+			}
+
+			users = append(users, &user)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// SearchUsers returns up to limit users, skipping the first offset, whose name
+// or email contains term, along with the total number of matching users. An
+// empty term matches every user. Deleted users are never matched.
+func (m *PostgresDBRepo) SearchUsers(term string, limit, offset int) ([]*data.User, int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, is_admin, created_at, updated_at
-	from users order by last_name`
+	pattern := searchPattern(term)
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.db().QueryContext(ctx, sqlSearchUsers, pattern, limit, offset)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
 	var users []*data.User
+	total := 0
 
 	for rows.Next() {
 		var user data.User
-		err := rows.Scan(
-			&user.ID,
-			&user.Email,
-			&user.FirstName,
-			&user.LastName,
-			&user.Password,
-			&user.IsAdmin,
-			&user.CreatedAt,
-			&user.UpdatedAt,
-		)
+		err := rows.Scan(userFields(&user, &total)...)
 		if err != nil {
 			log.Println("Error scanning", err)
-			return nil, err
+			return nil, 0, err
 		}
 
 		users = append(users, &user)
 	}
 
-	return users, nil
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// an offset past the end returns no rows, and so no total; count them
+	if len(users) == 0 && offset > 0 {
+		err = m.db().QueryRowContext(ctx, sqlCountSearchUsers, pattern).Scan(&total)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return users, total, nil
 }
 
-// GetUser returns one user by id
+// GetUser returns one user by id, unless they have been deleted
 func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+	var user data.User
+	err := m.read(func(db dbtx) error {
+		ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+		defer cancel()
+
+		return db.QueryRowContext(ctx, sqlGetUser, id).Scan(userFields(&user, &user.ProfilePic.FileName)...)
+	})
+
+	if err != nil {
+		return nil, err
+	}
 
-	query := `
-		select 
-			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
-			coalesce(ui.file_name, '')
-		from 
-			users u
-			left join user_images ui on (ui.user_id = u.id)
-		where 
-		    u.id = $1`
+	return &user, nil
+}
 
+// GetUserByEmail returns one user by email address, unless they have been deleted
+func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
 	var user data.User
-	row := m.DB.QueryRowContext(ctx, query, id)
-
-	err := row.Scan(
-		&user.ID,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Password,
-		&user.IsAdmin,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-		&user.ProfilePic.FileName,
-	)
+	err := m.read(func(db dbtx) error {
+		ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+		defer cancel()
+
+		return db.QueryRowContext(ctx, sqlGetUserByEmail, email).Scan(userFields(&user, &user.ProfilePic.FileName)...)
+	})
 
 	if err != nil {
 		return nil, err
@@ -95,81 +196,81 @@ func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
 	return &user, nil
 }
 
-// GetUserByEmail returns one user by email address
-func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
+// GetUsersByEmail returns the users with any of the email addresses, unless
+// they have been deleted, in one query.
+func (m *PostgresDBRepo) GetUsersByEmail(emails []string) ([]*data.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `
-		select 
-			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
-			coalesce(ui.file_name, '')
-		from 
-			users u
-			left join user_images ui on (ui.user_id = u.id)
-		where 
-		    u.email = $1`
-
-	var user data.User
-	row := m.DB.QueryRowContext(ctx, query, email)
-
-	err := row.Scan(
-		&user.ID,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Password,
-		&user.IsAdmin,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-		&user.ProfilePic.FileName,
-	)
-
+	rows, err := m.db().QueryContext(ctx, sqlGetUsersByEmail, emails)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &user, nil
+	var users []*data.User
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(userFields(&user, &user.ProfilePic.FileName)...)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
 }
 
-// UpdateUser updates one user in the database
+// UpdateUser updates one user in the database, unless they have been updated
+// by someone else since u was read, in which case it returns
+// repository.ErrConflict. u.Version must be the version that was read; each
+// update increments it. It returns sql.ErrNoRows if there is no such user.
 func (m *PostgresDBRepo) UpdateUser(u data.User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `update users set
-		email = $1,
-		first_name = $2,
-		last_name = $3,
-		is_admin = $4,
-		updated_at = $5
-		where id = $6
-	`
-
-	_, err := m.DB.ExecContext(ctx, stmt,
+	result, err := m.db().ExecContext(ctx, sqlUpdateUser,
 		u.Email,
 		u.FirstName,
 		u.LastName,
 		u.IsAdmin,
-		time.Now(),
 		u.ID,
+		u.Version,
 	)
+	if err != nil {
+		return err
+	}
 
+	n, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if n == 0 {
+		// either the version or the user is gone
+		var exists bool
+		err = m.db().QueryRowContext(ctx, sqlUserExists, u.ID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+		return repository.ErrConflict
+	}
 
 	return nil
 }
 
-// DeleteUser deletes one user from the database, by id
+// DeleteUser soft deletes one user, by id. The user is hidden from every
+// other query but kept, along with their profile image, until
+// PurgeDeletedUsers removes them, and can be brought back with RestoreUser.
 func (m *PostgresDBRepo) DeleteUser(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `delete from users where id = $1`
-
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	_, err := m.db().ExecContext(ctx, sqlDeleteUser, id)
 	if err != nil {
 		return err
 	}
@@ -177,6 +278,92 @@ func (m *PostgresDBRepo) DeleteUser(id int) error {
 	return nil
 }
 
+// DeletedUsers returns every soft deleted user, most recently deleted first.
+func (m *PostgresDBRepo) DeletedUsers() ([]*data.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := m.db().QueryContext(ctx, sqlDeletedUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*data.User
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(userFields(&user, &user.DeletedAt)...)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+// RestoreUser undoes the soft delete of one user, by id. It returns
+// sql.ErrNoRows if there is no deleted user with that id, and
+// repository.ErrConflict if another user has their email address now.
+func (m *PostgresDBRepo) RestoreUser(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	result, err := m.db().ExecContext(ctx, sqlRestoreUser, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var deleted bool
+	if err := m.db().QueryRowContext(ctx, sqlIsDeletedUser, id).Scan(&deleted); err != nil {
+		return err
+	}
+	if deleted {
+		return repository.ErrConflict
+	}
+	return sql.ErrNoRows
+}
+
+// PurgeDeletedUsers permanently deletes the users that were soft deleted
+// before the given time, along with their profile images, and returns how
+// many users were removed.
+func (m *PostgresDBRepo) PurgeDeletedUsers(before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var n int64
+	err := m.inTx(func(tx *PostgresDBRepo) error {
+		_, err := tx.db().ExecContext(ctx, sqlPurgeUserImages, before)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.db().ExecContext(ctx, sqlPurgeDeletedUsers, before)
+		if err != nil {
+			return err
+		}
+
+		n, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
 // InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
 func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
@@ -188,17 +375,13 @@ func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, is_admin, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
-
-	err = m.DB.QueryRowContext(ctx, stmt,
+	err = m.db().QueryRowContext(ctx, sqlInsertUser,
 		user.Email,
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
 		user.IsAdmin,
-		time.Now(),
-		time.Now(),
+		user.EmailVerified,
 	).Scan(&newID)
 
 	if err != nil {
@@ -208,6 +391,44 @@ func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 	return newID, nil
 }
 
+// InsertUserWithID inserts a new user with the id in user.ID. It returns
+// repository.ErrConflict if the id is taken, by a deleted user too, and moves
+// the id sequence past the new id so that InsertUser never hands it out.
+func (m *PostgresDBRepo) InsertUserWithID(user data.User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	if err != nil {
+		return err
+	}
+
+	return m.inTx(func(tx *PostgresDBRepo) error {
+		result, err := tx.db().ExecContext(ctx, sqlInsertUserWithID,
+			user.ID,
+			user.Email,
+			user.FirstName,
+			user.LastName,
+			hashedPassword,
+			user.IsAdmin,
+			user.EmailVerified,
+		)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return repository.ErrConflict
+		}
+
+		_, err = tx.db().ExecContext(ctx, sqlSyncUserIDSequence)
+		return err
+	})
+}
+
 // ResetPassword is the method we will use to change a user's password.
 func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
@@ -218,8 +439,7 @@ func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
 		return err
 	}
 
-	stmt := `update users set password = $1 where id = $2`
-	_, err = m.DB.ExecContext(ctx, stmt, hashedPassword, id)
+	_, err = m.db().ExecContext(ctx, sqlResetPassword, hashedPassword, id)
 	if err != nil {
 		return err
 	}
@@ -227,29 +447,120 @@ func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
 	return nil
 }
 
-// InsertUserImage inserts a user profile image into the database.
-func (m *PostgresDBRepo) InsertUserImage(i data.UserImage) (int, error) {
+// VerifyUserEmail records that the user with the given id has verified their
+// email address.
+func (m *PostgresDBRepo) VerifyUserEmail(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
-	stmt := `delete from user_images where user_id =$1`
-	_, err := m.DB.ExecContext(ctx, stmt, i.UserID)
+
+	_, err := m.db().ExecContext(ctx, sqlVerifyUserEmail, id)
 	if err != nil {
-		return 0, err
+		return err
 	}
+
+	return nil
+}
+
+// InsertUserImage inserts a user profile image into the database.
+func (m *PostgresDBRepo) InsertUserImage(i data.UserImage) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// replace the user's picture, or leave it alone if that fails
 	var newID int
-	stmt = `insert into user_images (user_id, file_name, created_at, updated_at)
-		values ($1, $2, $3, $4) returning id`
-
-	err = m.DB.QueryRowContext(ctx, stmt,
-		i.UserID,
-		i.FileName,
-		time.Now(),
-		time.Now(),
-	).Scan(&newID)
+	err := m.inTx(func(tx *PostgresDBRepo) error {
+		_, err := tx.db().ExecContext(ctx, sqlDeleteUserImages, i.UserID)
+		if err != nil {
+			return err
+		}
 
+		return tx.db().QueryRowContext(ctx, sqlInsertUserImage,
+			i.UserID,
+			i.FileName,
+		).Scan(&newID)
+	})
 	if err != nil {
 		return 0, err
 	}
 
 	return newID, nil
 }
+
+// ImportUsers inserts users in a single transaction, loading them with COPY,
+// and returns their new ids in the order given. Email addresses must be
+// unique within users. If bestEffort is false and any of the addresses is
+// already in use, nothing is inserted and it returns repository.ErrConflict;
+// otherwise those users are skipped and their ids are 0. COPY needs a
+// connection of its own, so ImportUsers can't be called inside WithTx.
+func (m *PostgresDBRepo) ImportUsers(users []data.User, bestEffort bool) ([]int, error) {
+	if m.tx != nil {
+		return nil, errors.New("ImportUsers runs its own transaction, and can't be called inside WithTx")
+	}
+
+	index, err := importIndex(users)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err := hashPasswords(users)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var ids []int
+	err = conn.Raw(func(driverConn any) error {
+		tx, err := driverConn.(*stdlib.Conn).Conn().Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		ids, err = copyUsers(ctx, tx, users, index, hashes, bestEffort)
+		if err != nil {
+			return err
+		}
+
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// EachUser calls fn with every user that is not deleted, in id order, reading
+// them from the database as it goes so that the whole table is never held in
+// memory. It stops at the first error fn returns, and returns it.
+func (m *PostgresDBRepo) EachUser(fn func(u *data.User) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+
+	rows, err := m.db().QueryContext(ctx, sqlEachUser)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(userFields(&user)...)
+		if err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
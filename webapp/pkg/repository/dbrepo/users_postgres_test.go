@@ -4,19 +4,20 @@ package dbrepo
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 	"webapp/pkg/data"
 	"webapp/pkg/repository"
+	"webapp/pkg/repository/repotest"
 
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
-	"github.com/ory/dockertest/v3"
-	"github.com/ory/dockertest/v3/docker"
 )
 
 var (
@@ -28,61 +29,23 @@ var (
 	dsn      = "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable timezone=UTC connect_timeout=5"
 )
 
-var resource *dockertest.Resource
-var pool *dockertest.Pool
 var testDB *sql.DB
+var testDSN string
 var testRepo repository.DatabaseRepo
 
 func TestMain(m *testing.M) {
-	// connect to docker; fail if docker not running
-	p, err := dockertest.NewPool("")
+	// start the database engine chosen by DBREPO_TEST_ENGINE
+	eng, err := startEngine(os.Getenv("DBREPO_TEST_ENGINE"))
 	if err != nil {
-		log.Fatalf("could not connect to docker; is it running? %s", err)
-	}
-
-	pool = p
-
-	// set up our docker options, specifying the image and so forth
-	opts := dockertest.RunOptions{
-		Repository: "postgres",
-		Tag:        "14.5",
-		Env: []string{
-			"POSTGRES_USER=" + user,
-			"POSTGRES_PASSWORD=" + password,
-			"POSTGRES_DB=" + dbName,
-		},
-		ExposedPorts: []string{"5432"},
-		PortBindings: map[docker.Port][]docker.PortBinding{
-			"5432": {
-				{HostIP: "0.0.0.0", HostPort: port},
-			},
-		},
-	}
-
-	// get a resource (docker image)
-	resource, err = pool.RunWithOptions(&opts)
-	if err != nil {
-		_ = pool.Purge(resource)
-		log.Fatalf("could not start resource: %s", err)
+		log.Fatal(err)
 	}
 
-	// start the image and wait until it's ready
-	if err := pool.Retry(func() error {
-		var err error
-		testDB, err = sql.Open("pgx", fmt.Sprintf(dsn, host, port, user, password, dbName))
-		if err != nil {
-			log.Println("Error:", err)
-			return err
-		}
-		return testDB.Ping()
-	}); err != nil {
-		_ = pool.Purge(resource)
-		log.Fatalf("could not connect to database: %s", err)
-	}
+	testDB, testDSN = eng.db, eng.dsn
 
 	// populate the database with empty tables
 	err = createTables()
 	if err != nil {
+		_ = eng.stop()
 		log.Fatalf("error creating tables: %s", err)
 	}
 
@@ -92,8 +55,9 @@ func TestMain(m *testing.M) {
 	code := m.Run()
 
 	// clean up
-	if err := pool.Purge(resource); err != nil {
-		log.Fatalf("could not purge resource: %s", err)
+	_ = testDB.Close()
+	if err := eng.stop(); err != nil {
+		log.Fatalf("could not stop %s: %s", eng.name, err)
 	}
 
 	os.Exit(code)
@@ -128,7 +92,7 @@ func TestPostgresDBRepoInsertUser(t *testing.T) {
 		LastName:  "User",
 		Email:     "admin@example.com",
 		Password:  "secret",
-		IsAdmin:   1,
+		IsAdmin:   true,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -156,7 +120,7 @@ func TestPostgresDBRepoAllUsers(t *testing.T) {
 		LastName:  "Smith",
 		Email:     "Jack@example.com",
 		Password:  "secret",
-		IsAdmin:   1,
+		IsAdmin:   true,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -170,6 +134,38 @@ func TestPostgresDBRepoAllUsers(t *testing.T) {
 	}
 }
 
+func TestPostgresDBRepoSearchUsers(t *testing.T) {
+	var tests = []struct {
+		name          string
+		term          string
+		limit         int
+		offset        int
+		expectedCount int
+		expectedTotal int
+	}{
+		{"everyone", "", 10, 0, 2, 2},
+		{"by first name", "jack", 10, 0, 1, 1},
+		{"by full name", "admin user", 10, 0, 1, 1},
+		{"by email", "@EXAMPLE.com", 10, 0, 2, 2},
+		{"second page", "", 1, 1, 1, 2},
+		{"past the end", "", 10, 5, 0, 2},
+		{"wildcards are literal", "%", 10, 0, 0, 0},
+	}
+
+	for _, e := range tests {
+		users, total, err := testRepo.SearchUsers(e.term, e.limit, e.offset)
+		if err != nil {
+			t.Errorf("%s: search users returned an error: %s", e.name, err)
+		}
+		if len(users) != e.expectedCount {
+			t.Errorf("%s: expected %d users but got %d", e.name, e.expectedCount, len(users))
+		}
+		if total != e.expectedTotal {
+			t.Errorf("%s: expected total %d but got %d", e.name, e.expectedTotal, total)
+		}
+	}
+}
+
 func TestPostgresDBRepoGetUser(t *testing.T) {
 	user, err := testRepo.GetUser(1)
 	if err != nil {
@@ -179,6 +175,9 @@ func TestPostgresDBRepoGetUser(t *testing.T) {
 	if user.Email != "admin@example.com" {
 		t.Errorf("wrong email returned by getUser; Expcted admin@example.com but got %s", user.Email)
 	}
+	if !user.IsAdmin || user.CreatedAt.IsZero() || user.UpdatedAt.IsZero() {
+		t.Errorf("expected an admin with timestamps set by the database, got %+v", user)
+	}
 
 	_, err = testRepo.GetUser(3)
 	if err == nil {
@@ -209,10 +208,30 @@ func TestPostgresDBRepoUpdateUser(t *testing.T) {
 		t.Errorf("Error updating user %d: %s", 2, err)
 	}
 
+	stale := *user
+
 	user, _ = testRepo.GetUser(2)
 	if user.FirstName != "Jane" || user.Email != "jane@example.com" {
 		t.Errorf("expected updated record to have first name jane and email jane@example.com but got %s %s", user.FirstName, user.Email)
 	}
+	if user.Version != stale.Version+1 {
+		t.Errorf("expected the update to increment the version to %d but got %d", stale.Version+1, user.Version)
+	}
+
+	stale.FirstName = "Janet"
+	err = testRepo.UpdateUser(stale)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected repository.ErrConflict updating with a stale version, got %v", err)
+	}
+	user, _ = testRepo.GetUser(2)
+	if user.FirstName != "Jane" {
+		t.Errorf("a conflicting update changed the first name to %s", user.FirstName)
+	}
+
+	err = testRepo.UpdateUser(data.User{ID: 99, Email: "nobody@example.com", Version: 1})
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows updating a user that does not exist, got %v", err)
+	}
 }
 
 func TestPostgresDBRepoDeleteUser(t *testing.T) {
@@ -225,6 +244,64 @@ func TestPostgresDBRepoDeleteUser(t *testing.T) {
 	if err == nil {
 		t.Error("Retrieved user id 2 who should have been deleted")
 	}
+	_, err = testRepo.GetUserByEmail("jane@example.com")
+	if err == nil {
+		t.Error("Retrieved deleted user 2 by email")
+	}
+	users, _ := testRepo.AllUsers()
+	if len(users) != 1 {
+		t.Errorf("all users should not include deleted users; expected 1 but got %d", len(users))
+	}
+
+	deleted, err := testRepo.DeletedUsers()
+	if err != nil {
+		t.Errorf("Error listing deleted users: %s", err)
+	}
+	if len(deleted) != 1 || deleted[0].ID != 2 || deleted[0].DeletedAt == nil {
+		t.Errorf("expected user 2 to be listed as deleted, got %v", deleted)
+	}
+}
+
+func TestPostgresDBRepoRestoreUser(t *testing.T) {
+	err := testRepo.RestoreUser(2)
+	if err != nil {
+		t.Errorf("Error restoring user 2: %s", err)
+	}
+
+	user, err := testRepo.GetUser(2)
+	if err != nil || user.Email != "jane@example.com" {
+		t.Errorf("expected restored user 2 to be back as jane@example.com; got %v, %v", user, err)
+	}
+
+	err = testRepo.RestoreUser(2)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows restoring a user that is not deleted, got %v", err)
+	}
+}
+
+func TestPostgresDBRepoPurgeDeletedUsers(t *testing.T) {
+	_ = testRepo.DeleteUser(2)
+
+	n, err := testRepo.PurgeDeletedUsers(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Errorf("Error purging deleted users: %s", err)
+	}
+	if n != 0 {
+		t.Errorf("expected a recently deleted user to be kept, but %d were purged", n)
+	}
+
+	n, err = testRepo.PurgeDeletedUsers(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Errorf("Error purging deleted users: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 user to be purged, but %d were", n)
+	}
+
+	err = testRepo.RestoreUser(2)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected a purged user not to be restorable, got %v", err)
+	}
 }
 
 func TestPostgresDBRepoResetPassword(t *testing.T) {
@@ -244,6 +321,23 @@ func TestPostgresDBRepoResetPassword(t *testing.T) {
 	}
 }
 
+func TestPostgresDBRepoVerifyUserEmail(t *testing.T) {
+	user, _ := testRepo.GetUser(1)
+	if user.EmailVerified {
+		t.Error("new users should not have a verified email address")
+	}
+
+	err := testRepo.VerifyUserEmail(1)
+	if err != nil {
+		t.Error("Error verifying user's email: ", err)
+	}
+
+	user, _ = testRepo.GetUserByEmail("admin@example.com")
+	if !user.EmailVerified {
+		t.Error("user's email address was not marked as verified")
+	}
+}
+
 func TestPostgresDBRepoInsertUserImage(t *testing.T) {
 	id, err := testRepo.InsertUserImage(data.UserImage{1, 1, "test.jpg", time.Now(), time.Now()})
 	if err != nil {
@@ -258,3 +352,243 @@ func TestPostgresDBRepoInsertUserImage(t *testing.T) {
 		t.Errorf("Exepcted error inserting image with userID 2; which should not exist")
 	}
 }
+
+func TestPostgresDBRepoInsertUserWithID(t *testing.T) {
+	testUser := data.User{
+		ID:        10,
+		FirstName: "Ten",
+		LastName:  "User",
+		Email:     "ten@example.com",
+		Password:  "secret",
+	}
+
+	err := testRepo.InsertUserWithID(testUser)
+	if err != nil {
+		t.Errorf("insert user with id returned an error: %s", err)
+	}
+	user, err := testRepo.GetUser(10)
+	if err != nil || user.Email != "ten@example.com" {
+		t.Errorf("expected user 10 to be ten@example.com; got %v, %v", user, err)
+	}
+
+	testUser.Email = "another@example.com"
+	err = testRepo.InsertUserWithID(testUser)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict inserting a taken id, got %v", err)
+	}
+
+	// the sequence has moved past the chosen id
+	id, err := testRepo.InsertUser(data.User{FirstName: "Next", LastName: "User", Email: "next@example.com", Password: "secret"})
+	if err != nil {
+		t.Errorf("insert user returned an error: %s", err)
+	}
+	if id != 11 {
+		t.Errorf("expected the next user to get id 11, got %d", id)
+	}
+}
+
+func TestPostgresDBRepoImportUsers(t *testing.T) {
+	users := []data.User{
+		{FirstName: "Amy", LastName: "Import", Email: "amy@example.com", Password: "secret", EmailVerified: true},
+		{FirstName: "Bob", LastName: "Import", Email: "bob@example.com", Password: "secret", IsAdmin: true},
+	}
+	ids, err := testRepo.ImportUsers(users, false)
+	if err != nil {
+		t.Fatalf("import users returned an error: %s", err)
+	}
+	for i, id := range ids {
+		user, err := testRepo.GetUser(id)
+		if err != nil || user.Email != users[i].Email || user.IsAdmin != users[i].IsAdmin || user.EmailVerified != users[i].EmailVerified {
+			t.Errorf("expected user %d to be imported as %s; got %v, %v", id, users[i].Email, user, err)
+			continue
+		}
+		if ok, _ := user.PasswordMatches("secret"); !ok {
+			t.Errorf("imported user %d's password does not match", id)
+		}
+	}
+
+	users = []data.User{
+		{FirstName: "Cat", LastName: "Import", Email: "cat@example.com", Password: "secret"},
+		{FirstName: "Amy", LastName: "Again", Email: "amy@example.com", Password: "secret"},
+	}
+	_, err = testRepo.ImportUsers(users, false)
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict importing an email address in use, got %v", err)
+	}
+	if _, err := testRepo.GetUserByEmail("cat@example.com"); err == nil {
+		t.Error("expected nothing to be imported when an email address is in use")
+	}
+
+	ids, err = testRepo.ImportUsers(users, true)
+	if err != nil {
+		t.Fatalf("best effort import returned an error: %s", err)
+	}
+	if len(ids) != 2 || ids[0] == 0 || ids[1] != 0 {
+		t.Errorf("expected cat@example.com to be imported and amy@example.com skipped, got ids %v", ids)
+	}
+
+	_, err = testRepo.ImportUsers([]data.User{users[0], users[0]}, true)
+	if err == nil {
+		t.Error("expected an error importing the same email address twice")
+	}
+}
+
+func TestPostgresDBRepoEachUser(t *testing.T) {
+	all, _ := testRepo.AllUsers()
+
+	var ids []int
+	err := testRepo.EachUser(func(u *data.User) error {
+		ids = append(ids, u.ID)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("each user returned an error: %s", err)
+	}
+	if len(ids) != len(all) {
+		t.Errorf("expected each user to visit %d users, got %d", len(all), len(ids))
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Errorf("expected users in id order, got %v", ids)
+			break
+		}
+	}
+
+	stop := errors.New("stop")
+	visited := 0
+	err = testRepo.EachUser(func(u *data.User) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("expected each user to stop at the first error, got %v after %d users", err, visited)
+	}
+}
+
+func TestPostgresDBRepoInsertUserImageKeepsOldImageOnFailure(t *testing.T) {
+	// user 1 has test.jpg, from TestPostgresDBRepoInsertUserImage
+	_, err := testRepo.InsertUserImage(data.UserImage{UserID: 1, FileName: strings.Repeat("a", 300) + ".jpg"})
+	if err == nil {
+		t.Fatal("expected an error inserting an image with too long a file name")
+	}
+
+	user, _ := testRepo.GetUser(1)
+	if user.ProfilePic.FileName != "test.jpg" {
+		t.Errorf("expected a failed insert to keep the old image, got %q", user.ProfilePic.FileName)
+	}
+}
+
+func TestPostgresDBRepoWithTx(t *testing.T) {
+	failed := errors.New("failed")
+	err := testRepo.WithTx(func(repo repository.DatabaseRepo) error {
+		_, err := repo.InsertUser(data.User{FirstName: "Rolled", LastName: "Back", Email: "rolled-back@example.com", Password: "secret"})
+		if err != nil {
+			return err
+		}
+		if _, err := repo.GetUserByEmail("rolled-back@example.com"); err != nil {
+			t.Errorf("expected the transaction to see its own insert, got %s", err)
+		}
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected WithTx to return fn's error, got %v", err)
+	}
+	if _, err := testRepo.GetUserByEmail("rolled-back@example.com"); err == nil {
+		t.Error("expected the insert to be rolled back")
+	}
+
+	var id int
+	err = testRepo.WithTx(func(repo repository.DatabaseRepo) error {
+		var err error
+		id, err = repo.InsertUser(data.User{FirstName: "Committed", LastName: "User", Email: "committed@example.com", Password: "secret"})
+		if err != nil {
+			return err
+		}
+		// a nested WithTx joins the transaction
+		return repo.WithTx(func(repo repository.DatabaseRepo) error {
+			return repo.VerifyUserEmail(id)
+		})
+	})
+	if err != nil {
+		t.Errorf("WithTx returned an error: %s", err)
+	}
+	user, err := testRepo.GetUser(id)
+	if err != nil || !user.EmailVerified {
+		t.Errorf("expected the committed user to be verified; got %v, %v", user, err)
+	}
+
+	err = testRepo.WithTx(func(repo repository.DatabaseRepo) error {
+		_, err := repo.ImportUsers([]data.User{{FirstName: "Imported", LastName: "User", Email: "imported@example.com", Password: "secret"}}, false)
+		return err
+	})
+	if err == nil {
+		t.Error("expected ImportUsers to refuse to run inside WithTx")
+	}
+}
+
+func TestPostgresDBRepoReplicas(t *testing.T) {
+	// the "replica" is a second pool on the same database
+	replicaDB, err := sql.Open("pgx", testDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &PostgresDBRepo{DB: testDB, Replicas: NewReplicaSet(0, replicaDB)}
+
+	replicaReads := func() int64 {
+		return repo.Stats()[1].Reads
+	}
+
+	id, err := repo.InsertUser(data.User{FirstName: "Replica", LastName: "User", Email: "replica@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatalf("insert user returned an error: %s", err)
+	}
+
+	if _, err := repo.GetUser(id); err != nil {
+		t.Errorf("get user returned an error: %s", err)
+	}
+	if _, err := repo.GetUserByEmail("replica@example.com"); err != nil {
+		t.Errorf("get user by email returned an error: %s", err)
+	}
+	if _, err := repo.AllUsers(); err != nil {
+		t.Errorf("all users returned an error: %s", err)
+	}
+	if _, _, err := repo.SearchUsers("replica", 10, 0); err != nil {
+		t.Errorf("search users returned an error: %s", err)
+	}
+	if n := replicaReads(); n != 3 {
+		t.Errorf("expected 3 reads from the replica, got %d", n)
+	}
+
+	// transactions and the primary repo read from the primary
+	_ = repo.WithTx(func(repo repository.DatabaseRepo) error {
+		_, err := repo.GetUser(id)
+		return err
+	})
+	_, _ = repo.Primary().GetUser(id)
+	if n := replicaReads(); n != 3 {
+		t.Errorf("expected no more reads from the replica, got %d", n-3)
+	}
+
+	// when the replica goes away, reads fall back to the primary
+	_ = repo.Replicas.Close()
+	if _, err := repo.GetUser(id); err != nil {
+		t.Errorf("expected get user to fall back to the primary, got %s", err)
+	}
+	stats := repo.Stats()
+	if stats[0].Reads != 1 || stats[1].Healthy || stats[1].Failures != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	_ = repo.DeleteUser(id)
+}
+
+func TestPostgresDBRepoConformance(t *testing.T) {
+	// this empties the tables, so it must run after the tests above
+	repotest.Run(t, func(t *testing.T) repository.DatabaseRepo {
+		_, err := testDB.Exec(`truncate users, user_images restart identity`)
+		if err != nil {
+			t.Fatalf("error emptying the tables: %s", err)
+		}
+		return testRepo
+	})
+}
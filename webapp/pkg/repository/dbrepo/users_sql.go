@@ -0,0 +1,208 @@
+package dbrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/crypto/bcrypt"
+	"runtime"
+	"strings"
+	"sync"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// The SQL that PostgresDBRepo and PgxDBRepo share. Queries selecting
+// userColumns are scanned with userFields.
+const (
+	userColumns = `id, email, first_name, last_name, password, is_admin, email_verified, version, created_at, updated_at`
+
+	// selectUserWithPicture is followed by a where clause on u, and adds the
+	// profile picture's file name to userColumns.
+	selectUserWithPicture = `select u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.email_verified, u.version, u.created_at, u.updated_at,
+			coalesce(ui.file_name, '')
+		from users u left join user_images ui on (ui.user_id = u.id)`
+
+	// searchUsersWhere matches the users whose name or email matches $1,
+	// made with searchPattern.
+	searchUsersWhere = `where deleted_at is null and (email ilike $1 or first_name ilike $1 or last_name ilike $1
+		or (first_name || ' ' || last_name) ilike $1)`
+
+	sqlAllUsers        = `select ` + userColumns + ` from users where deleted_at is null order by last_name`
+	sqlGetUser         = selectUserWithPicture + ` where u.id = $1 and u.deleted_at is null`
+	sqlGetUserByEmail  = selectUserWithPicture + ` where u.email = $1 and u.deleted_at is null`
+	sqlGetUsersByEmail = selectUserWithPicture + ` where u.email = any($1) and u.deleted_at is null`
+	sqlEachUser        = `select ` + userColumns + ` from users where deleted_at is null order by id`
+
+	// sqlSearchUsers adds the number of matches to userColumns.
+	sqlSearchUsers = `select ` + userColumns + `, count(*) over()
+		from users ` + searchUsersWhere + `
+		order by last_name, first_name, id
+		limit $2 offset $3`
+	sqlCountSearchUsers = `select count(*) from users ` + searchUsersWhere
+
+	sqlUpdateUser = `update users set
+		email = $1,
+		first_name = $2,
+		last_name = $3,
+		is_admin = $4,
+		version = version + 1,
+		updated_at = now()
+		where id = $5 and version = $6 and deleted_at is null`
+	sqlUserExists = `select exists(select 1 from users where id = $1 and deleted_at is null)`
+
+	sqlDeleteUser = `update users set deleted_at = now() where id = $1 and deleted_at is null`
+	// sqlDeletedUsers adds deleted_at to userColumns.
+	sqlDeletedUsers = `select ` + userColumns + `, deleted_at
+		from users where deleted_at is not null order by deleted_at desc, id`
+	// sqlRestoreUser leaves the user deleted if someone else has taken their
+	// email address since; sqlIsDeletedUser tells that apart from there being
+	// no such deleted user.
+	sqlRestoreUser = `update users set deleted_at = null, updated_at = now()
+		where id = $1 and deleted_at is not null
+		and not exists (select 1 from users live where live.email = users.email and live.deleted_at is null)`
+	sqlIsDeletedUser     = `select exists(select 1 from users where id = $1 and deleted_at is not null)`
+	sqlPurgeUserImages   = `delete from user_images where user_id in (select id from users where deleted_at < $1)`
+	sqlPurgeDeletedUsers = `delete from users where deleted_at < $1`
+
+	sqlInsertUser = `insert into users (email, first_name, last_name, password, is_admin, email_verified)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+	sqlInsertUserWithID = `insert into users (id, email, first_name, last_name, password, is_admin, email_verified)
+		overriding system value
+		values ($1, $2, $3, $4, $5, $6, $7) on conflict (id) do nothing`
+	// sqlSyncUserIDSequence moves the id sequence past every id in use, so
+	// that it never hands out one inserted with sqlInsertUserWithID.
+	sqlSyncUserIDSequence = `select setval(pg_get_serial_sequence('users', 'id'), greatest((select max(id) from users), 1))`
+
+	sqlResetPassword   = `update users set password = $1, updated_at = now() where id = $2`
+	sqlVerifyUserEmail = `update users set email_verified = true, version = version + 1, updated_at = now() where id = $1`
+
+	sqlDeleteUserImages = `delete from user_images where user_id = $1`
+	sqlInsertUserImage  = `insert into user_images (user_id, file_name) values ($1, $2) returning id`
+)
+
+// userFields returns where to scan userColumns into u, followed by extra.
+func userFields(u *data.User, extra ...any) []any {
+	return append([]any{
+		&u.ID,
+		&u.Email,
+		&u.FirstName,
+		&u.LastName,
+		&u.Password,
+		&u.IsAdmin,
+		&u.EmailVerified,
+		&u.Version,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	}, extra...)
+}
+
+// searchPattern turns a search term into an ilike pattern matching anything
+// that contains it.
+func searchPattern(term string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term) + "%"
+}
+
+// importIndex maps each of the users' email addresses to the user's position,
+// and checks that none of them appears twice.
+func importIndex(users []data.User) (map[string]int, error) {
+	index := make(map[string]int, len(users))
+	for i, u := range users {
+		if _, ok := index[u.Email]; ok {
+			return nil, fmt.Errorf("%s appears more than once in the import", u.Email)
+		}
+		index[u.Email] = i
+	}
+	return index, nil
+}
+
+// copyUsers is the body of ImportUsers, shared by both Postgres repos: it
+// loads the users, with their hashed passwords, into a temporary table with
+// COPY, and inserts them from there in tx.
+func copyUsers(ctx context.Context, tx pgx.Tx, users []data.User, index map[string]int, hashes [][]byte, bestEffort bool) ([]int, error) {
+	stmt := `create temporary table user_import (like users including defaults) on commit drop`
+	_, err := tx.Exec(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []string{"id", "email", "first_name", "last_name", "password", "is_admin", "email_verified"}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"user_import"}, columns, pgx.CopyFromSlice(len(users), func(i int) ([]any, error) {
+		u := users[i]
+		// the id only orders the rows; users get new ones
+		return []any{i, u.Email, u.FirstName, u.LastName, string(hashes[i]), u.IsAdmin, u.EmailVerified}, nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	if !bestEffort {
+		var taken bool
+		query := `select exists (select 1 from user_import i join users u on u.email = i.email and u.deleted_at is null)`
+		err = tx.QueryRow(ctx, query).Scan(&taken)
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			return nil, repository.ErrConflict
+		}
+	}
+
+	query := `insert into users (email, first_name, last_name, password, is_admin, email_verified)
+		select email, first_name, last_name, password, is_admin, email_verified
+		from user_import i
+		where not exists (select 1 from users u where u.email = i.email and u.deleted_at is null)
+		order by i.id
+		returning id, email`
+	rows, err := tx.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(users))
+	for rows.Next() {
+		var id int
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids[index[email]] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the table would only be dropped at the end of an enclosing transaction
+	_, err = tx.Exec(ctx, `drop table user_import`)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// hashPasswords hashes the users' passwords, several at a time as bcrypt is
+// slow by design.
+func hashPasswords(users []data.User) ([][]byte, error) {
+	hashes := make([][]byte, len(users))
+	errs := make([]error, len(users))
+
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, runtime.NumCPU())
+	for i := range users {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			hashes[i], errs[i] = bcrypt.GenerateFromPassword([]byte(users[i].Password), 12)
+		}(i)
+	}
+	wg.Wait()
+
+	return hashes, errors.Join(errs...)
+}
@@ -3,80 +3,241 @@ package dbrepo
 import (
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 	"webapp/pkg/data"
+	"webapp/pkg/repository"
 )
 
+// TestDBRepo is a DatabaseRepo that answers from canned data and stores
+// nothing. See NewTestMemoryDBRepo for the same users in a repo that keeps
+// what it is given.
 type TestDBRepo struct{}
 
 func (m *TestDBRepo) Connection() *sql.DB {
 	return nil
 }
 
+// WithTx calls fn with the repo itself, as the test repo keeps nothing to roll
+// back
+func (m *TestDBRepo) WithTx(fn func(repo repository.DatabaseRepo) error) error {
+	return fn(m)
+}
+
+// Primary returns the repo itself, which has no replicas.
+func (m *TestDBRepo) Primary() repository.DatabaseRepo {
+	return m
+}
+
 // AllUsers returns all users as a slice of *data.User
 func (m *TestDBRepo) AllUsers() ([]*data.User, error) {
 	var users = []*data.User{}
 	return users, nil
 }
 
+// SearchUsers returns the admin user if it matches term
+func (m *TestDBRepo) SearchUsers(term string, limit, offset int) ([]*data.User, int, error) {
+	admin, _ := m.GetUser(1)
+	text := strings.ToLower(admin.FirstName + " " + admin.LastName + " " + admin.Email)
+	if !strings.Contains(text, strings.ToLower(term)) {
+		return []*data.User{}, 0, nil
+	}
+	if offset > 0 || limit < 1 {
+		return []*data.User{}, 1, nil
+	}
+	return []*data.User{admin}, 1, nil
+}
+
 // GetUser returns one user by id
 func (m *TestDBRepo) GetUser(id int) (*data.User, error) {
-	var user = data.User{}
-	if id == 1 {
-		user = data.User{
-			ID:        1,
-			FirstName: "Admin",
-			LastName:  "User",
-			Email:     "admin@example.com",
-		}
-		return &user, nil
+	switch id {
+	case 1:
+		return m.GetUserByEmail("admin@example.com")
+	case 3:
+		return m.GetUserByEmail("unverified@example.com")
 	}
-	return nil, errors.New("user not found")
+	return nil, sql.ErrNoRows
 }
 
 // GetUserByEmail returns one user by email address
 func (m *TestDBRepo) GetUserByEmail(email string) (*data.User, error) {
 	if email == "admin@example.com" {
 		user := data.User{
-			ID:        1,
-			FirstName: "Admin",
+			ID:            1,
+			FirstName:     "Admin",
+			LastName:      "User",
+			Email:         "admin@example.com",
+			Password:      "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK",
+			IsAdmin:       true,
+			CreatedAt:     time.Now(),
+			UpdatedAt:     time.Now(),
+			EmailVerified: true,
+			Version:       1,
+			ProfilePic:    data.UserImage{FileName: "lateralus.jpeg"},
+		}
+		return &user, nil
+	}
+	if email == "unverified@example.com" {
+		user := data.User{
+			ID:        3,
+			FirstName: "New",
 			LastName:  "User",
-			Email:     "admin@example.com",
+			Email:     "unverified@example.com",
 			Password:  "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK",
-			IsAdmin:   1,
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
+			Version:   1,
 		}
 		return &user, nil
 	}
-	return nil, errors.New("not found")
+	return nil, sql.ErrNoRows
 }
 
-// UpdateUser updates one user in the database
+// GetUsersByEmail returns the admin and unverified users, if their addresses
+// are among emails
+func (m *TestDBRepo) GetUsersByEmail(emails []string) ([]*data.User, error) {
+	var users []*data.User
+	for _, email := range emails {
+		if user, err := m.GetUserByEmail(email); err == nil {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// UpdateUser updates one user in the database; users 1 and 3 are at version 1
 func (m *TestDBRepo) UpdateUser(u data.User) error {
-	if u.ID == 1 {
-		return nil
+	if u.ID != 1 && u.ID != 3 {
+		return sql.ErrNoRows
 	}
-	return errors.New("update failed - no user found")
+	if u.Version != 1 {
+		return repository.ErrConflict
+	}
+	return nil
 }
 
-// DeleteUser deletes one user from the database, by id
+// DeleteUser soft deletes one user, by id
 func (m *TestDBRepo) DeleteUser(id int) error {
 	return nil
 }
 
+// DeletedUsers returns every soft deleted user, most recently deleted first.
+// User 5 is always deleted, and so is invisible to GetUser.
+func (m *TestDBRepo) DeletedUsers() ([]*data.User, error) {
+	deletedAt := time.Now().Add(-time.Hour)
+	user := data.User{
+		ID:            5,
+		FirstName:     "Deleted",
+		LastName:      "User",
+		Email:         "deleted@example.com",
+		Password:      "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK",
+		EmailVerified: true,
+		DeletedAt:     &deletedAt,
+	}
+	return []*data.User{&user}, nil
+}
+
+// RestoreUser undoes the soft delete of one user, by id
+func (m *TestDBRepo) RestoreUser(id int) error {
+	if id == 5 {
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// PurgeDeletedUsers permanently deletes users soft deleted before the given time
+func (m *TestDBRepo) PurgeDeletedUsers(before time.Time) (int, error) {
+	return 0, nil
+}
+
 // InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
 func (m *TestDBRepo) InsertUser(user data.User) (int, error) {
 
 	return 2, nil
 }
 
+// InsertUserWithID inserts a new user with the id the caller chose
+func (m *TestDBRepo) InsertUserWithID(user data.User) error {
+	if user.ID == 5 {
+		// the deleted user still holds its id
+		return repository.ErrConflict
+	}
+	return nil
+}
+
+// ImportUsers inserts users, numbering them from 2. Only admin@example.com is
+// in use.
+func (m *TestDBRepo) ImportUsers(users []data.User, bestEffort bool) ([]int, error) {
+	ids := make([]int, len(users))
+	next := 2
+	for i, u := range users {
+		if u.Email == "admin@example.com" {
+			if !bestEffort {
+				return nil, repository.ErrConflict
+			}
+			continue
+		}
+		ids[i] = next
+		next++
+	}
+	return ids, nil
+}
+
+// EachUser calls fn with the admin user, then the unverified user
+func (m *TestDBRepo) EachUser(fn func(u *data.User) error) error {
+	for _, id := range []int{1, 3} {
+		user, _ := m.GetUser(id)
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ResetPassword is the method we will use to change a user's password.
 func (m *TestDBRepo) ResetPassword(id int, password string) error {
 	return nil
 }
 
-// InsertUserImage inserts a user profile image into the database.
+// VerifyUserEmail records that the user with the given id has verified their
+// email address.
+func (m *TestDBRepo) VerifyUserEmail(id int) error {
+	return nil
+}
+
+// InsertUserImage inserts a user profile image into the database; users 1, 3
+// and the deleted user 5 exist.
 func (m *TestDBRepo) InsertUserImage(i data.UserImage) (int, error) {
+	if i.UserID != 1 && i.UserID != 3 && i.UserID != 5 {
+		return 0, errors.New("user_images: no such user")
+	}
 	return 1, nil
 }
+
+// NewTestMemoryDBRepo returns a MemoryDBRepo holding the users TestDBRepo
+// answers with: the admin 1, with their profile picture, the unverified user 3
+// and user 5, deleted an hour ago. Their password is "secret". Unlike
+// TestDBRepo it keeps what tests write, so each test that writes should start
+// from a repo of its own.
+func NewTestMemoryDBRepo() *MemoryDBRepo {
+	canned := &TestDBRepo{}
+	admin, _ := canned.GetUser(1)
+	unverified, _ := canned.GetUser(3)
+	deleted, _ := canned.DeletedUsers()
+
+	repo := NewMemoryDBRepo()
+	for _, u := range []*data.User{admin, unverified, deleted[0]} {
+		u.Password = "secret"
+		if err := repo.InsertUserWithID(*u); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := repo.InsertUserImage(data.UserImage{UserID: admin.ID, FileName: admin.ProfilePic.FileName}); err != nil {
+		panic(err)
+	}
+
+	u := repo.state.users[deleted[0].ID]
+	u.DeletedAt = deleted[0].DeletedAt
+	repo.state.users[u.ID] = u
+	return repo
+}
@@ -0,0 +1,24 @@
+package dbrepo
+
+import (
+	"testing"
+	"webapp/pkg/repository/repotest"
+)
+
+// TestDBRepo answers from canned data and stores nothing, so it is exempt
+// from repotest.Run: every other check writes something and reads it back,
+// which a repo that keeps nothing can't pass. Only the checks that write
+// nothing apply to it. It is only the fixture NewTestMemoryDBRepo is seeded
+// from, and tests use that instead.
+func TestTestDBRepo_notFound(t *testing.T) {
+	repotest.CheckNotFound(t, &TestDBRepo{})
+}
+
+func TestTestDBRepo_profilePic(t *testing.T) {
+	repo := &TestDBRepo{}
+	byID, _ := repo.GetUser(1)
+	byEmail, _ := repo.GetUserByEmail("admin@example.com")
+	if byID.ProfilePic.FileName == "" || byID.ProfilePic != byEmail.ProfilePic {
+		t.Errorf("expected the admin's profile picture by id and by email, got %q and %q", byID.ProfilePic.FileName, byEmail.ProfilePic.FileName)
+	}
+}
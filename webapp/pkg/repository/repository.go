@@ -2,17 +2,81 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
+	"net/http"
+	"time"
 	"webapp/pkg/data"
 )
 
+// ErrConflict is returned when a record can't be updated because it was
+// changed by someone else after it was read.
+var ErrConflict = errors.New("the record was changed by someone else")
+
 type DatabaseRepo interface {
 	Connection() *sql.DB
+	// WithTx calls fn with a repo whose methods all run in one transaction,
+	// which is committed if fn returns nil and rolled back otherwise.
+	WithTx(fn func(repo DatabaseRepo) error) error
+	// Primary returns a repo that never reads from a replica, so that its
+	// reads see the writes made through it.
+	Primary() DatabaseRepo
 	AllUsers() ([]*data.User, error)
+	SearchUsers(term string, limit, offset int) ([]*data.User, int, error)
 	GetUser(id int) (*data.User, error)
 	GetUserByEmail(email string) (*data.User, error)
+	// GetUsersByEmail returns the users with any of the email addresses, in
+	// no particular order, leaving out deleted users and unknown addresses.
+	GetUsersByEmail(emails []string) ([]*data.User, error)
+	// UpdateUser returns ErrConflict unless u.Version is the user's current
+	// version, and increments the version otherwise.
 	UpdateUser(u data.User) error
+	// DeleteUser soft deletes a user; see DeletedUsers, RestoreUser and
+	// PurgeDeletedUsers.
 	DeleteUser(id int) error
+	DeletedUsers() ([]*data.User, error)
+	// RestoreUser returns ErrConflict if another user has taken the deleted
+	// user's email address since.
+	RestoreUser(id int) error
+	// PurgeDeletedUsers permanently removes users deleted before the given
+	// time, and returns how many there were.
+	PurgeDeletedUsers(before time.Time) (int, error)
 	InsertUser(user data.User) (int, error)
+	// InsertUserWithID inserts a user with the id the caller chose, and
+	// returns ErrConflict if a user, deleted or not, already has it.
+	InsertUserWithID(user data.User) error
+	// ImportUsers inserts many users at once and returns their ids in order.
+	// If bestEffort is false it inserts all of them or, if any email address
+	// is in use, none and returns ErrConflict; otherwise it skips those users,
+	// whose ids are 0.
+	ImportUsers(users []data.User, bestEffort bool) ([]int, error)
+	// EachUser calls fn with every user in id order, without loading them
+	// all into memory, until fn returns an error.
+	EachUser(fn func(u *data.User) error) error
 	ResetPassword(id int, password string) error
+	VerifyUserEmail(id int) error
 	InsertUserImage(i data.UserImage) (int, error)
 }
+
+// ForRequest returns repo for handling r. Requests that may write get its
+// Primary, so that their reads see their own writes; others may read from a
+// replica.
+func ForRequest(repo DatabaseRepo, r *http.Request) DatabaseRepo {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return repo
+	}
+	return repo.Primary()
+}
+
+// OutboxRepo stores the email queued by the mail outbox until it is sent.
+type OutboxRepo interface {
+	EnqueueMail(m data.OutboxMessage) (int, error)
+	// ClaimMail returns up to limit messages that are due at now, counting
+	// an attempt against each and hiding them from other callers for lease.
+	ClaimMail(now time.Time, lease time.Duration, limit int) ([]*data.OutboxMessage, error)
+	MarkMailSent(id int) error
+	// RetryMail records a failed attempt and makes the message due again at.
+	RetryMail(id int, lastError string, at time.Time) error
+	// FailMail records a failed attempt and gives up on the message.
+	FailMail(id int, lastError string) error
+}
@@ -0,0 +1,565 @@
+// Package repotest is a conformance test suite for implementations of
+// repository.DatabaseRepo, so that a repo used in place of Postgres, in tests
+// or elsewhere, behaves as Postgres does. Every implementation's tests should
+// call Run, or, for a repo that doesn't store what it is given, CheckNotFound.
+package repotest
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// Run runs the whole suite against the repos made by newRepo, each check as
+// a subtest with a repo of its own. newRepo must return an empty repo each
+// time it is called.
+func Run(t *testing.T, newRepo func(t *testing.T) repository.DatabaseRepo) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo repository.DatabaseRepo)
+	}{
+		{"NotFound", CheckNotFound},
+		{"InsertUser", checkInsertUser},
+		{"AllUsers", checkAllUsers},
+		{"GetUsersByEmail", checkGetUsersByEmail},
+		{"SearchUsers", checkSearchUsers},
+		{"UpdateUser", checkUpdateUser},
+		{"DeleteAndRestoreUser", checkDeleteAndRestoreUser},
+		{"RestoreUserEmailTaken", checkRestoreUserEmailTaken},
+		{"PurgeDeletedUsers", checkPurgeDeletedUsers},
+		{"ResetPassword", checkResetPassword},
+		{"VerifyUserEmail", checkVerifyUserEmail},
+		{"InsertUserImage", checkInsertUserImage},
+		{"InsertUserWithID", checkInsertUserWithID},
+		{"InsertUserWithFirstID", checkInsertUserWithFirstID},
+		{"ImportUsers", checkImportUsers},
+		{"EachUser", checkEachUser},
+		{"WithTx", checkWithTx},
+	}
+
+	for _, e := range tests {
+		t.Run(e.name, func(t *testing.T) {
+			e.test(t, newRepo(t))
+		})
+	}
+}
+
+// notFoundID and notFoundEmail are a user id and email address that no
+// repo's test data may use.
+const (
+	notFoundID    = 1_000_000
+	notFoundEmail = "not-found@example.com"
+)
+
+// CheckNotFound checks that repo reports a missing user as Postgres does. It
+// writes nothing, so it suits repos with canned data too.
+func CheckNotFound(t *testing.T, repo repository.DatabaseRepo) {
+	if _, err := repo.GetUser(notFoundID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows getting an unknown user, got %v", err)
+	}
+	if _, err := repo.GetUserByEmail(notFoundEmail); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows getting an unknown email address, got %v", err)
+	}
+	if err := repo.UpdateUser(data.User{ID: notFoundID, FirstName: "Not", LastName: "Found", Email: notFoundEmail, Version: 1}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows updating an unknown user, got %v", err)
+	}
+	if err := repo.RestoreUser(notFoundID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows restoring an unknown user, got %v", err)
+	}
+	if users, err := repo.GetUsersByEmail([]string{notFoundEmail}); err != nil || len(users) != 0 {
+		t.Errorf("expected no users getting an unknown email address; got %v, %v", users, err)
+	}
+	if _, err := repo.InsertUserImage(data.UserImage{UserID: notFoundID, FileName: "not-found.jpg"}); err == nil {
+		t.Error("expected an error inserting an image for an unknown user")
+	}
+}
+
+// insertTestUser inserts a user with the given names, an email address made
+// from them and the password "secret", and returns their id.
+func insertTestUser(t *testing.T, repo repository.DatabaseRepo, firstName, lastName string) int {
+	t.Helper()
+	id, err := repo.InsertUser(data.User{
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     strings.ToLower(firstName+"."+lastName) + "@example.com",
+		Password:  "secret",
+	})
+	if err != nil {
+		t.Fatalf("insert user returned an error: %s", err)
+	}
+	return id
+}
+
+func checkInsertUser(t *testing.T, repo repository.DatabaseRepo) {
+	before := time.Now().Add(-time.Minute)
+	id, err := repo.InsertUser(data.User{FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", Password: "secret", IsAdmin: true})
+	if err != nil {
+		t.Fatalf("insert user returned an error: %s", err)
+	}
+	if id < 1 {
+		t.Errorf("expected a positive id, got %d", id)
+	}
+
+	user, err := repo.GetUser(id)
+	if err != nil {
+		t.Fatalf("get user returned an error: %s", err)
+	}
+	if user.ID != id || user.FirstName != "Jack" || user.LastName != "Smith" || user.Email != "jack@example.com" || !user.IsAdmin || user.EmailVerified {
+		t.Errorf("user was not stored as inserted: %+v", user)
+	}
+	if user.Version != 1 || user.CreatedAt.Before(before) || user.UpdatedAt.Before(before) || user.DeletedAt != nil {
+		t.Errorf("user's defaults were not set: %+v", user)
+	}
+	if ok, _ := user.PasswordMatches("secret"); !ok {
+		t.Error("stored password does not match")
+	}
+
+	byEmail, err := repo.GetUserByEmail("jack@example.com")
+	if err != nil || byEmail.ID != id {
+		t.Errorf("expected to find user %d by email; got %v, %v", id, byEmail, err)
+	}
+
+	next := insertTestUser(t, repo, "Jill", "Smith")
+	if next <= id {
+		t.Errorf("expected ids to increase, got %d after %d", next, id)
+	}
+
+	if _, err := repo.GetUser(next + 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows getting an unknown user, got %v", err)
+	}
+	if _, err := repo.GetUserByEmail("nobody@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows getting an unknown email address, got %v", err)
+	}
+	if _, err := repo.GetUserByEmail("JACK@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected email addresses to be matched exactly, got %v", err)
+	}
+
+	_, err = repo.InsertUser(data.User{FirstName: strings.Repeat("a", 256), LastName: "Long", Email: "long@example.com", Password: "secret"})
+	if err == nil {
+		t.Error("expected an error inserting a name longer than 255 characters")
+	}
+}
+
+func checkAllUsers(t *testing.T, repo repository.DatabaseRepo) {
+	users, err := repo.AllUsers()
+	if err != nil || len(users) != 0 {
+		t.Fatalf("expected no users in an empty repo; got %d, %v", len(users), err)
+	}
+
+	insertTestUser(t, repo, "Jack", "Smith")
+	insertTestUser(t, repo, "Amy", "Adams")
+	deleted := insertTestUser(t, repo, "Zed", "Brown")
+	_ = repo.DeleteUser(deleted)
+
+	users, err = repo.AllUsers()
+	if err != nil {
+		t.Fatalf("all users returned an error: %s", err)
+	}
+	if len(users) != 2 || users[0].LastName != "Adams" || users[1].LastName != "Smith" {
+		t.Errorf("expected Adams then Smith, got %+v", users)
+	}
+}
+
+func checkGetUsersByEmail(t *testing.T, repo repository.DatabaseRepo) {
+	jack := insertTestUser(t, repo, "Jack", "Smith")
+	jill := insertTestUser(t, repo, "Jill", "Smith")
+	deleted := insertTestUser(t, repo, "Deleted", "Smith")
+	if err := repo.DeleteUser(deleted); err != nil {
+		t.Fatalf("delete user returned an error: %s", err)
+	}
+	if _, err := repo.InsertUserImage(data.UserImage{UserID: jill, FileName: "jill.jpg"}); err != nil {
+		t.Fatalf("insert user image returned an error: %s", err)
+	}
+
+	users, err := repo.GetUsersByEmail([]string{"jack.smith@example.com", "jill.smith@example.com", "deleted.smith@example.com", "nobody@example.com", "JACK.SMITH@example.com"})
+	if err != nil {
+		t.Fatalf("get users by email returned an error: %s", err)
+	}
+	found := make(map[int]*data.User)
+	for _, u := range users {
+		found[u.ID] = u
+	}
+	if len(users) != 2 || found[jack] == nil || found[jill] == nil {
+		t.Fatalf("expected users %d and %d, got %v", jack, jill, users)
+	}
+	if found[jill].ProfilePic.FileName != "jill.jpg" || found[jack].Password == "secret" {
+		t.Errorf("users were not read in full: %+v", found[jill])
+	}
+
+	if users, err := repo.GetUsersByEmail(nil); err != nil || len(users) != 0 {
+		t.Errorf("expected no users for no email addresses; got %v, %v", users, err)
+	}
+}
+
+func checkSearchUsers(t *testing.T, repo repository.DatabaseRepo) {
+	insertTestUser(t, repo, "Jack", "Smith")
+	insertTestUser(t, repo, "Amy", "Smith")
+	insertTestUser(t, repo, "Bob", "Jones")
+	deleted := insertTestUser(t, repo, "Zed", "Smith")
+	_ = repo.DeleteUser(deleted)
+
+	var tests = []struct {
+		term          string
+		limit, offset int
+		expected      []string
+		expectedTotal int
+	}{
+		{"", 10, 0, []string{"Bob", "Amy", "Jack"}, 3},
+		{"smith", 10, 0, []string{"Amy", "Jack"}, 2},
+		{"JACK S", 10, 0, []string{"Jack"}, 1},
+		{"bob.jones@", 10, 0, []string{"Bob"}, 1},
+		{"", 2, 1, []string{"Amy", "Jack"}, 3},
+		{"", 10, 5, nil, 3},
+		{"%", 10, 0, nil, 0},
+		{"nobody", 10, 0, nil, 0},
+	}
+
+	for _, e := range tests {
+		users, total, err := repo.SearchUsers(e.term, e.limit, e.offset)
+		if err != nil {
+			t.Errorf("%q: search users returned an error: %s", e.term, err)
+			continue
+		}
+		var names []string
+		for _, u := range users {
+			names = append(names, u.FirstName)
+		}
+		if strings.Join(names, ",") != strings.Join(e.expected, ",") || total != e.expectedTotal {
+			t.Errorf("%q, %d, %d: expected %v of %d, got %v of %d", e.term, e.limit, e.offset, e.expected, e.expectedTotal, names, total)
+		}
+	}
+}
+
+func checkUpdateUser(t *testing.T, repo repository.DatabaseRepo) {
+	id := insertTestUser(t, repo, "Jack", "Smith")
+	user, _ := repo.GetUser(id)
+
+	user.FirstName = "John"
+	user.Email = "john@example.com"
+	user.IsAdmin = true
+	err := repo.UpdateUser(*user)
+	if err != nil {
+		t.Fatalf("update user returned an error: %s", err)
+	}
+	updated, _ := repo.GetUser(id)
+	if updated.FirstName != "John" || updated.Email != "john@example.com" || !updated.IsAdmin || updated.Version != 2 {
+		t.Errorf("user was not updated: %+v", updated)
+	}
+	if updated.Password != user.Password || updated.EmailVerified {
+		t.Errorf("update user changed fields it should not have: %+v", updated)
+	}
+
+	// user still holds the version that was just replaced
+	user.LastName = "Jones"
+	if err := repo.UpdateUser(*user); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict updating a stale version, got %v", err)
+	}
+
+	unknown := *updated
+	unknown.ID = id + 100
+	if err := repo.UpdateUser(unknown); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows updating an unknown user, got %v", err)
+	}
+
+	_ = repo.DeleteUser(id)
+	if err := repo.UpdateUser(*updated); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows updating a deleted user, got %v", err)
+	}
+}
+
+func checkDeleteAndRestoreUser(t *testing.T, repo repository.DatabaseRepo) {
+	first := insertTestUser(t, repo, "Jack", "Smith")
+	second := insertTestUser(t, repo, "Jill", "Smith")
+
+	if err := repo.DeleteUser(first); err != nil {
+		t.Fatalf("delete user returned an error: %s", err)
+	}
+	if err := repo.DeleteUser(first + 100); err != nil {
+		t.Errorf("expected deleting an unknown user to do nothing, got %s", err)
+	}
+	if _, err := repo.GetUser(first); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows getting a deleted user, got %v", err)
+	}
+	if _, err := repo.GetUserByEmail("jack.smith@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows getting a deleted user by email, got %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	_ = repo.DeleteUser(second)
+
+	deleted, err := repo.DeletedUsers()
+	if err != nil {
+		t.Fatalf("deleted users returned an error: %s", err)
+	}
+	if len(deleted) != 2 || deleted[0].ID != second || deleted[1].ID != first || deleted[0].DeletedAt == nil {
+		t.Errorf("expected the deleted users, most recent first, got %+v", deleted)
+	}
+
+	if err := repo.RestoreUser(first); err != nil {
+		t.Fatalf("restore user returned an error: %s", err)
+	}
+	if user, err := repo.GetUser(first); err != nil || user.DeletedAt != nil {
+		t.Errorf("expected the restored user back; got %v, %v", user, err)
+	}
+	if err := repo.RestoreUser(first); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows restoring a user that is not deleted, got %v", err)
+	}
+	if err := repo.RestoreUser(first + 100); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected sql.ErrNoRows restoring an unknown user, got %v", err)
+	}
+}
+
+func checkRestoreUserEmailTaken(t *testing.T, repo repository.DatabaseRepo) {
+	deleted := insertTestUser(t, repo, "Jack", "Smith")
+	_ = repo.DeleteUser(deleted)
+	taken := insertTestUser(t, repo, "Jack", "Smith")
+
+	if err := repo.RestoreUser(deleted); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict restoring a user whose email address was taken, got %v", err)
+	}
+	if _, err := repo.GetUser(deleted); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the user to stay deleted, got %v", err)
+	}
+
+	_ = repo.DeleteUser(taken)
+	if err := repo.RestoreUser(deleted); err != nil {
+		t.Errorf("expected the user to be restorable once their email address was free, got %v", err)
+	}
+}
+
+func checkPurgeDeletedUsers(t *testing.T, repo repository.DatabaseRepo) {
+	kept := insertTestUser(t, repo, "Jack", "Smith")
+	purged := insertTestUser(t, repo, "Jill", "Smith")
+	_, _ = repo.InsertUserImage(data.UserImage{UserID: purged, FileName: "jill.jpg"})
+	_ = repo.DeleteUser(purged)
+
+	n, err := repo.PurgeDeletedUsers(time.Now().Add(-time.Hour))
+	if err != nil || n != 0 {
+		t.Errorf("expected a recently deleted user to be kept; got %d, %v", n, err)
+	}
+
+	n, err = repo.PurgeDeletedUsers(time.Now().Add(time.Minute))
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 user to be purged; got %d, %v", n, err)
+	}
+	if err := repo.RestoreUser(purged); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected a purged user not to be restorable, got %v", err)
+	}
+	if _, err := repo.InsertUserImage(data.UserImage{UserID: purged, FileName: "jill.jpg"}); err == nil {
+		t.Error("expected a purged user to be gone for good")
+	}
+	if _, err := repo.GetUser(kept); err != nil {
+		t.Errorf("expected a user who was not deleted to be kept, got %v", err)
+	}
+}
+
+func checkResetPassword(t *testing.T, repo repository.DatabaseRepo) {
+	id := insertTestUser(t, repo, "Jack", "Smith")
+
+	if err := repo.ResetPassword(id, "changed"); err != nil {
+		t.Fatalf("reset password returned an error: %s", err)
+	}
+	user, _ := repo.GetUser(id)
+	if ok, _ := user.PasswordMatches("changed"); !ok {
+		t.Error("password was not changed")
+	}
+	if user.Version != 1 {
+		t.Errorf("expected a password change not to change the version, got %d", user.Version)
+	}
+	if err := repo.ResetPassword(id+100, "changed"); err != nil {
+		t.Errorf("expected resetting an unknown user's password to do nothing, got %s", err)
+	}
+}
+
+func checkVerifyUserEmail(t *testing.T, repo repository.DatabaseRepo) {
+	id := insertTestUser(t, repo, "Jack", "Smith")
+
+	if err := repo.VerifyUserEmail(id); err != nil {
+		t.Fatalf("verify user email returned an error: %s", err)
+	}
+	user, _ := repo.GetUser(id)
+	if !user.EmailVerified || user.Version != 2 {
+		t.Errorf("expected a verified user at version 2, got %+v", user)
+	}
+	if err := repo.VerifyUserEmail(id + 100); err != nil {
+		t.Errorf("expected verifying an unknown user to do nothing, got %s", err)
+	}
+}
+
+func checkInsertUserImage(t *testing.T, repo repository.DatabaseRepo) {
+	id := insertTestUser(t, repo, "Jack", "Smith")
+
+	first, err := repo.InsertUserImage(data.UserImage{UserID: id, FileName: "first.jpg"})
+	if err != nil {
+		t.Fatalf("insert user image returned an error: %s", err)
+	}
+	second, err := repo.InsertUserImage(data.UserImage{UserID: id, FileName: "second.jpg"})
+	if err != nil || second <= first {
+		t.Fatalf("expected a new image with a later id; got %d, %v", second, err)
+	}
+	user, _ := repo.GetUser(id)
+	if user.ProfilePic.FileName != "second.jpg" {
+		t.Errorf("expected the image to be replaced, got %q", user.ProfilePic.FileName)
+	}
+	user, _ = repo.GetUserByEmail("jack.smith@example.com")
+	if user.ProfilePic.FileName != "second.jpg" {
+		t.Errorf("expected the image by email too, got %q", user.ProfilePic.FileName)
+	}
+
+	if _, err := repo.InsertUserImage(data.UserImage{UserID: id, FileName: strings.Repeat("a", 300) + ".jpg"}); err == nil {
+		t.Error("expected an error inserting an image with too long a file name")
+	}
+	user, _ = repo.GetUser(id)
+	if user.ProfilePic.FileName != "second.jpg" {
+		t.Errorf("expected a failed insert to keep the old image, got %q", user.ProfilePic.FileName)
+	}
+
+	if _, err := repo.InsertUserImage(data.UserImage{UserID: id + 100, FileName: "nobody.jpg"}); err == nil {
+		t.Error("expected an error inserting an image for an unknown user")
+	}
+}
+
+func checkInsertUserWithID(t *testing.T, repo repository.DatabaseRepo) {
+	deleted := insertTestUser(t, repo, "Jack", "Smith")
+	_ = repo.DeleteUser(deleted)
+
+	err := repo.InsertUserWithID(data.User{ID: 10, FirstName: "Ten", LastName: "User", Email: "ten@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatalf("insert user with id returned an error: %s", err)
+	}
+	user, err := repo.GetUser(10)
+	if err != nil || user.Email != "ten@example.com" || user.Version != 1 {
+		t.Errorf("expected user 10 to be ten@example.com; got %v, %v", user, err)
+	}
+
+	err = repo.InsertUserWithID(data.User{ID: 10, FirstName: "Ten", LastName: "Again", Email: "again@example.com", Password: "secret"})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict inserting a taken id, got %v", err)
+	}
+	err = repo.InsertUserWithID(data.User{ID: deleted, FirstName: "Jack", LastName: "Again", Email: "again@example.com", Password: "secret"})
+	if !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict inserting the id of a deleted user, got %v", err)
+	}
+
+	if id := insertTestUser(t, repo, "Next", "User"); id <= 10 {
+		t.Errorf("expected the next user's id to be past 10, got %d", id)
+	}
+}
+
+// checkInsertUserWithFirstID puts user 1 into an empty repo, where the id
+// sequence has not handed out anything yet.
+func checkInsertUserWithFirstID(t *testing.T, repo repository.DatabaseRepo) {
+	err := repo.InsertUserWithID(data.User{ID: 1, FirstName: "One", LastName: "User", Email: "one@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatalf("insert user with id 1 returned an error: %s", err)
+	}
+
+	if id := insertTestUser(t, repo, "Next", "User"); id <= 1 {
+		t.Errorf("expected the next user's id to be past 1, got %d", id)
+	}
+}
+
+func checkImportUsers(t *testing.T, repo repository.DatabaseRepo) {
+	insertTestUser(t, repo, "Jack", "Smith")
+
+	users := []data.User{
+		{FirstName: "Amy", LastName: "Import", Email: "amy@example.com", Password: "secret", EmailVerified: true},
+		{FirstName: "Bob", LastName: "Import", Email: "bob@example.com", Password: "secret", IsAdmin: true},
+	}
+	ids, err := repo.ImportUsers(users, false)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("expected 2 ids; got %v, %v", ids, err)
+	}
+	for i, id := range ids {
+		user, err := repo.GetUser(id)
+		if err != nil || user.Email != users[i].Email || user.IsAdmin != users[i].IsAdmin || user.EmailVerified != users[i].EmailVerified {
+			t.Errorf("expected user %d to be imported as %s; got %v, %v", id, users[i].Email, user, err)
+			continue
+		}
+		if ok, _ := user.PasswordMatches("secret"); !ok {
+			t.Errorf("imported user %d's password does not match", id)
+		}
+	}
+
+	users = []data.User{
+		{FirstName: "Cat", LastName: "Import", Email: "cat@example.com", Password: "secret"},
+		{FirstName: "Jack", LastName: "Again", Email: "jack.smith@example.com", Password: "secret"},
+	}
+	if _, err := repo.ImportUsers(users, false); !errors.Is(err, repository.ErrConflict) {
+		t.Errorf("expected ErrConflict importing an email address in use, got %v", err)
+	}
+	if _, err := repo.GetUserByEmail("cat@example.com"); err == nil {
+		t.Error("expected nothing to be imported when an email address is in use")
+	}
+
+	ids, err = repo.ImportUsers(users, true)
+	if err != nil || len(ids) != 2 || ids[0] == 0 || ids[1] != 0 {
+		t.Errorf("expected cat@example.com to be imported and jack.smith@example.com skipped; got %v, %v", ids, err)
+	}
+
+	if _, err := repo.ImportUsers([]data.User{users[0], users[0]}, true); err == nil {
+		t.Error("expected an error importing the same email address twice")
+	}
+}
+
+func checkEachUser(t *testing.T, repo repository.DatabaseRepo) {
+	first := insertTestUser(t, repo, "Jack", "Smith")
+	deleted := insertTestUser(t, repo, "Amy", "Adams")
+	last := insertTestUser(t, repo, "Bob", "Jones")
+	_ = repo.DeleteUser(deleted)
+
+	var ids []int
+	err := repo.EachUser(func(u *data.User) error {
+		ids = append(ids, u.ID)
+		return nil
+	})
+	if err != nil || len(ids) != 2 || ids[0] != first || ids[1] != last {
+		t.Errorf("expected users %d and %d in id order; got %v, %v", first, last, ids, err)
+	}
+
+	stop := errors.New("stop")
+	visited := 0
+	err = repo.EachUser(func(u *data.User) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("expected each user to stop at the first error, got %v after %d users", err, visited)
+	}
+}
+
+func checkWithTx(t *testing.T, repo repository.DatabaseRepo) {
+	failed := errors.New("failed")
+	err := repo.WithTx(func(repo repository.DatabaseRepo) error {
+		id := insertTestUser(t, repo, "Rolled", "Back")
+		if _, err := repo.GetUser(id); err != nil {
+			t.Errorf("expected the transaction to see its own insert, got %s", err)
+		}
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected WithTx to return fn's error, got %v", err)
+	}
+	if _, err := repo.GetUserByEmail("rolled.back@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected the insert to be rolled back, got %v", err)
+	}
+
+	var id int
+	err = repo.WithTx(func(repo repository.DatabaseRepo) error {
+		id = insertTestUser(t, repo, "Committed", "User")
+		// a nested WithTx joins the transaction
+		return repo.WithTx(func(repo repository.DatabaseRepo) error {
+			return repo.VerifyUserEmail(id)
+		})
+	})
+	if err != nil {
+		t.Errorf("WithTx returned an error: %s", err)
+	}
+	if user, err := repo.GetUser(id); err != nil || !user.EmailVerified {
+		t.Errorf("expected the committed user to be verified; got %v, %v", user, err)
+	}
+}
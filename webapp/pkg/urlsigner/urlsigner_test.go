@@ -0,0 +1,43 @@
+package urlsigner
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	signer := Signer{Secret: []byte("secret")}
+
+	signed, err := signer.Sign("http://localhost:8080/verify-email?email=jack%40example.com", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(signed)
+
+	tamperedEmail := strings.Replace(u.RequestURI(), "jack", "jill", 1)
+	otherPath := strings.Replace(u.RequestURI(), "/verify-email", "/reset-password", 1)
+	expired, _ := signer.Sign("/verify-email?email=jack%40example.com", time.Now().Add(-time.Minute))
+
+	var tests = []struct {
+		name     string
+		link     string
+		signer   Signer
+		expected error
+	}{
+		{"full link", signed, signer, nil},
+		{"path and query only", u.RequestURI(), signer, nil},
+		{"tampered query", tamperedEmail, signer, ErrInvalidSignature},
+		{"different path", otherPath, signer, ErrInvalidSignature},
+		{"unsigned", "/verify-email?email=jack%40example.com", signer, ErrInvalidSignature},
+		{"wrong secret", signed, Signer{Secret: []byte("other")}, ErrInvalidSignature},
+		{"expired", expired, signer, ErrExpired},
+	}
+
+	for _, e := range tests {
+		if err := e.signer.Verify(e.link); err != e.expected {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, err)
+		}
+	}
+}
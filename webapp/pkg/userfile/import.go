@@ -0,0 +1,123 @@
+package userfile
+
+import (
+	"errors"
+	"fmt"
+	"webapp/pkg/data"
+	"webapp/pkg/repository"
+)
+
+// ImportOptions control how Import treats a file with problems in it.
+type ImportOptions struct {
+	// DryRun checks every record, and reports what importing them would do,
+	// without inserting anything.
+	DryRun bool
+	// BestEffort imports the records that are valid and skips the rest. By
+	// default, a file is imported all or nothing.
+	BestEffort bool
+}
+
+// RowError is a record that was not, or would not be, imported.
+type RowError struct {
+	Line    int    `json:"line"`
+	Email   string `json:"email,omitempty"`
+	Message string `json:"error"`
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ImportResult reports the outcome of an import.
+type ImportResult struct {
+	DryRun bool `json:"dry_run"`
+	// Rows is how many records there were, and Imported how many were, or
+	// on a dry run would be, inserted.
+	Rows     int        `json:"rows"`
+	Imported int        `json:"imported"`
+	Errors   []RowError `json:"errors"`
+}
+
+// Import validates records and inserts them into db as verified users, as an
+// admin vouches for them. Errors in records are reported in the result; an
+// error is returned only if the import itself failed, in which case nothing
+// was inserted.
+func Import(db repository.DatabaseRepo, records []Record, opts ImportOptions) (*ImportResult, error) {
+	result := &ImportResult{DryRun: opts.DryRun, Rows: len(records), Errors: []RowError{}}
+
+	// look up every address in one go, rather than a row at a time
+	emails := make([]string, len(records))
+	for i, record := range records {
+		emails[i] = record.Email
+	}
+	existing, err := db.GetUsersByEmail(emails)
+	if err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool, len(existing))
+	for _, u := range existing {
+		inUse[u.Email] = true
+	}
+
+	var valid []Record
+	seen := make(map[string]int, len(records))
+	for _, record := range records {
+		fail := func(message string) {
+			result.Errors = append(result.Errors, RowError{Line: record.Line, Email: record.Email, Message: message})
+		}
+		if err := record.Validate(); err != nil {
+			fail(err.Error())
+			continue
+		}
+		if line, ok := seen[record.Email]; ok {
+			fail(fmt.Sprintf("email address is already used on line %d", line))
+			continue
+		}
+		seen[record.Email] = record.Line
+		if inUse[record.Email] {
+			fail("email address is already in use")
+			continue
+		}
+		valid = append(valid, record)
+	}
+
+	if opts.DryRun || (len(result.Errors) > 0 && !opts.BestEffort) {
+		if opts.DryRun && (opts.BestEffort || len(result.Errors) == 0) {
+			result.Imported = len(valid)
+		}
+		return result, nil
+	}
+	if len(valid) == 0 {
+		return result, nil
+	}
+
+	users := make([]data.User, len(valid))
+	for i, record := range valid {
+		users[i] = data.User{
+			FirstName:     record.FirstName,
+			LastName:      record.LastName,
+			Email:         record.Email,
+			Password:      record.Password,
+			IsAdmin:       record.IsAdmin,
+			EmailVerified: true,
+		}
+	}
+
+	ids, err := db.ImportUsers(users, opts.BestEffort)
+	if errors.Is(err, repository.ErrConflict) {
+		return nil, errors.New("a user was added with one of the email addresses while importing; try again")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range ids {
+		if id == 0 {
+			// someone else took the address since it was checked
+			result.Errors = append(result.Errors, RowError{Line: valid[i].Line, Email: valid[i].Email, Message: "email address is already in use"})
+			continue
+		}
+		result.Imported++
+	}
+	return result, nil
+}
@@ -0,0 +1,64 @@
+package userfile
+
+import (
+	"strings"
+	"testing"
+	"webapp/pkg/repository/dbrepo"
+)
+
+func TestImport(t *testing.T) {
+	valid := "first_name,last_name,email,password\n" +
+		"Jack,Smith,jack@example.com,secret\n" +
+		"Jill,Smith,jill@example.com,secret\n"
+	invalid := valid +
+		"Admin,User,admin@example.com,secret\n" +
+		"Jo,Smith,jack@example.com,secret\n" +
+		"Jo,,jo@example.com,secret\n"
+
+	var tests = []struct {
+		name             string
+		file             string
+		opts             ImportOptions
+		expectedImported int
+		expectedErrors   []string
+	}{
+		{"valid", valid, ImportOptions{}, 2, nil},
+		{"valid dry run", valid, ImportOptions{DryRun: true}, 2, nil},
+		{"invalid", invalid, ImportOptions{}, 0, []string{
+			"line 4: email address is already in use",
+			"line 5: email address is already used on line 2",
+			"line 6: first_name, last_name and email are required",
+		}},
+		{"invalid dry run", invalid, ImportOptions{DryRun: true}, 0, []string{"line 4", "line 5", "line 6"}},
+		{"invalid best effort", invalid, ImportOptions{BestEffort: true}, 2, []string{"line 4", "line 5", "line 6"}},
+		{"invalid best effort dry run", invalid, ImportOptions{BestEffort: true, DryRun: true}, 2, []string{"line 4", "line 5", "line 6"}},
+	}
+
+	for _, e := range tests {
+		records, err := Read(strings.NewReader(e.file), CSV)
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		result, err := Import(dbrepo.NewTestMemoryDBRepo(), records, e.opts)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+		if result.Rows != len(records) || result.DryRun != e.opts.DryRun {
+			t.Errorf("%s: result does not describe the import: %+v", e.name, result)
+		}
+		if result.Imported != e.expectedImported {
+			t.Errorf("%s: expected %d imported, got %d", e.name, e.expectedImported, result.Imported)
+		}
+		if len(result.Errors) != len(e.expectedErrors) {
+			t.Errorf("%s: expected %d errors, got %v", e.name, len(e.expectedErrors), result.Errors)
+			continue
+		}
+		for i, expected := range e.expectedErrors {
+			if !strings.Contains(result.Errors[i].Error(), expected) {
+				t.Errorf("%s: expected error %q, got %q", e.name, expected, result.Errors[i])
+			}
+		}
+	}
+}
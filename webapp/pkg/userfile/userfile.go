@@ -0,0 +1,313 @@
+// Package userfile reads users from, and writes them to, CSV and NDJSON
+// files, so that they can be imported and exported in bulk.
+package userfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+	"webapp/pkg/data"
+)
+
+// Format is a file format for users.
+type Format string
+
+const (
+	CSV    Format = "csv"
+	NDJSON Format = "ndjson"
+)
+
+// ParseFormat returns the format with the given name, file extension or media
+// type, such as "csv", ".jsonl" or "application/x-ndjson".
+func ParseFormat(s string) (Format, error) {
+	name := strings.ToLower(strings.TrimPrefix(s, "."))
+	if mediaType, _, err := mime.ParseMediaType(name); err == nil {
+		name = mediaType
+	}
+	switch name {
+	case "csv", "text/csv":
+		return CSV, nil
+	case "ndjson", "jsonl", "application/x-ndjson", "application/jsonl":
+		return NDJSON, nil
+	}
+	return "", fmt.Errorf("unsupported format %q; use csv or ndjson", s)
+}
+
+// MediaType returns the media type of files in the format.
+func (f Format) MediaType() string {
+	if f == NDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// importColumns are the columns of an import file; importRequired must all be
+// present, in any order.
+var (
+	importColumns  = []string{"first_name", "last_name", "email", "password", "is_admin"}
+	importRequired = []string{"first_name", "last_name", "email", "password"}
+)
+
+// exportColumns are the columns of an export file.
+var exportColumns = []string{"id", "first_name", "last_name", "email", "is_admin", "email_verified", "created_at"}
+
+// Record is a user read from an import file.
+type Record struct {
+	// Line is where the user starts in the file, for reporting errors.
+	Line      int
+	FirstName string
+	LastName  string
+	Email     string
+	Password  string
+	IsAdmin   bool
+
+	// err is why the row could not be read, if it could not.
+	err error
+}
+
+// Validate checks the record as the API checks a new user, trimming its names
+// and email address.
+func (r *Record) Validate() error {
+	if r.err != nil {
+		return r.err
+	}
+	if err := data.ValidateUserDetails(&r.FirstName, &r.LastName, &r.Email); err != nil {
+		return err
+	}
+	return data.ValidatePassword(r.Password)
+}
+
+// Read reads every record from r. A row that can't be read is returned as a
+// record whose Validate reports why, so that every problem in a file can be
+// shown at once; an error is returned only if the file as a whole is unusable,
+// such as a CSV file without the required columns.
+func Read(r io.Reader, f Format) ([]Record, error) {
+	if f == NDJSON {
+		return readNDJSON(r)
+	}
+	return readCSV(r)
+}
+
+func readCSV(r io.Reader) ([]Record, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	column := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !contains(importColumns, name) {
+			return nil, fmt.Errorf("unknown column %q; the columns are %s", name, strings.Join(importColumns, ", "))
+		}
+		if _, ok := column[name]; ok {
+			return nil, fmt.Errorf("column %q appears more than once", name)
+		}
+		column[name] = i
+	}
+	for _, name := range importRequired {
+		if _, ok := column[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	var records []Record
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if err != nil {
+			records = append(records, Record{Line: line, err: fmt.Errorf("expected %d fields, found %d", len(header), len(row))})
+			continue
+		}
+
+		record := Record{
+			Line:      line,
+			FirstName: row[column["first_name"]],
+			LastName:  row[column["last_name"]],
+			Email:     row[column["email"]],
+			Password:  row[column["password"]],
+		}
+		if i, ok := column["is_admin"]; ok {
+			record.IsAdmin, record.err = parseFlag(row[i])
+		}
+		records = append(records, record)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("the file has no users")
+	}
+	return records, nil
+}
+
+// parseFlag reads an is_admin value: empty, a boolean or a number, where any
+// number but 0 means true.
+func parseFlag(s string) (bool, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return false, nil
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b, nil
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return n != 0, nil
+	}
+	return false, fmt.Errorf("is_admin must be true or false, not %q", s)
+}
+
+// ndjsonRecord is a line of an NDJSON import file.
+type ndjsonRecord struct {
+	FirstName string          `json:"first_name"`
+	LastName  string          `json:"last_name"`
+	Email     string          `json:"email"`
+	Password  string          `json:"password"`
+	IsAdmin   json.RawMessage `json:"is_admin"`
+}
+
+func readNDJSON(r io.Reader) ([]Record, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var records []Record
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var row ndjsonRecord
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&row); err != nil {
+			records = append(records, Record{Line: line, err: err})
+			continue
+		}
+		if dec.More() {
+			records = append(records, Record{Line: line, err: errors.New("a line must hold one JSON object")})
+			continue
+		}
+
+		record := Record{
+			Line:      line,
+			FirstName: row.FirstName,
+			LastName:  row.LastName,
+			Email:     row.Email,
+			Password:  row.Password,
+		}
+		if s := string(row.IsAdmin); s != "" && s != "null" {
+			record.IsAdmin, record.err = parseFlag(strings.Trim(s, `"`))
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("the file has no users")
+	}
+	return records, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Writer writes users to an export file. It buffers its output, so Flush must
+// be called once every user is written.
+type Writer struct {
+	format      Format
+	csv         *csv.Writer
+	buf         *bufio.Writer
+	json        *json.Encoder
+	wroteHeader bool
+}
+
+// NewWriter returns a Writer that writes users to w in the given format.
+func NewWriter(w io.Writer, f Format) *Writer {
+	if f == NDJSON {
+		buf := bufio.NewWriter(w)
+		return &Writer{format: f, buf: buf, json: json.NewEncoder(buf)}
+	}
+	return &Writer{format: f, csv: csv.NewWriter(w)}
+}
+
+// exportRecord is a line of an NDJSON export file.
+type exportRecord struct {
+	ID            int       `json:"id"`
+	FirstName     string    `json:"first_name"`
+	LastName      string    `json:"last_name"`
+	Email         string    `json:"email"`
+	IsAdmin       bool      `json:"is_admin"`
+	EmailVerified bool      `json:"email_verified"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Write writes one user. Passwords are never exported.
+func (w *Writer) Write(u *data.User) error {
+	if w.format == NDJSON {
+		return w.json.Encode(exportRecord{
+			ID:            u.ID,
+			FirstName:     u.FirstName,
+			LastName:      u.LastName,
+			Email:         u.Email,
+			IsAdmin:       u.IsAdmin,
+			EmailVerified: u.EmailVerified,
+			CreatedAt:     u.CreatedAt.UTC(),
+		})
+	}
+
+	if !w.wroteHeader {
+		if err := w.csv.Write(exportColumns); err != nil {
+			return err
+		}
+		w.wroteHeader = true
+	}
+	return w.csv.Write([]string{
+		strconv.Itoa(u.ID),
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		strconv.FormatBool(u.IsAdmin),
+		strconv.FormatBool(u.EmailVerified),
+		u.CreatedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// Flush writes any buffered output, and the CSV header if no user was
+// written.
+func (w *Writer) Flush() error {
+	if w.format == NDJSON {
+		return w.buf.Flush()
+	}
+	if !w.wroteHeader {
+		if err := w.csv.Write(exportColumns); err != nil {
+			return err
+		}
+		w.wroteHeader = true
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
@@ -0,0 +1,182 @@
+package userfile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"webapp/pkg/data"
+)
+
+func TestParseFormat(t *testing.T) {
+	var tests = []struct {
+		name     string
+		expected Format
+		valid    bool
+	}{
+		{"csv", CSV, true},
+		{".CSV", CSV, true},
+		{"text/csv; charset=utf-8", CSV, true},
+		{"ndjson", NDJSON, true},
+		{".jsonl", NDJSON, true},
+		{"application/x-ndjson", NDJSON, true},
+		{"application/json", "", false},
+		{"", "", false},
+	}
+
+	for _, e := range tests {
+		f, err := ParseFormat(e.name)
+		if f != e.expected || (err == nil) != e.valid {
+			t.Errorf("%q: expected %q, %v; got %q, %v", e.name, e.expected, e.valid, f, err)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	var tests = []struct {
+		name           string
+		format         Format
+		file           string
+		expectedErr    string
+		expectedLines  []int
+		expectedErrors map[int]string
+	}{
+		{
+			name:   "csv",
+			format: CSV,
+			file: "email,first_name,last_name,password,is_admin\n" +
+				"jack@example.com,Jack,Smith,secret,\n" +
+				"jill@example.com, Jill ,Smith,secret,1\n",
+			expectedLines: []int{2, 3},
+		},
+		{
+			name:   "csv without is_admin",
+			format: CSV,
+			file: "first_name,last_name,email,password\n" +
+				"Jack,Smith,jack@example.com,secret\n",
+			expectedLines: []int{2},
+		},
+		{
+			name:   "csv with bad rows",
+			format: CSV,
+			file: "first_name,last_name,email,password,is_admin\n" +
+				"Jack,Smith,jack@example.com\n" +
+				"Jill,Smith,jill.example.com,secret,false\n" +
+				"\"Multi\nLine\",Smith,multi@example.com,secret,maybe\n",
+			expectedLines:  []int{2, 3, 4},
+			expectedErrors: map[int]string{2: "expected 5 fields", 3: "invalid email address", 4: "is_admin must be true or false"},
+		},
+		{"csv missing column", CSV, "first_name,last_name,email\nJack,Smith,jack@example.com\n", `missing column "password"`, nil, nil},
+		{"csv unknown column", CSV, "first_name,last_name,email,password,id\n", `unknown column "id"`, nil, nil},
+		{"csv without users", CSV, "first_name,last_name,email,password\n", "the file has no users", nil, nil},
+		{"csv empty", CSV, "", "the file is empty", nil, nil},
+		{
+			name:   "ndjson",
+			format: NDJSON,
+			file: `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret"}` + "\n\n" +
+				`{"first_name":"Jill","last_name":"Smith","email":"jill@example.com","password":"secret","is_admin":true}` + "\n",
+			expectedLines: []int{1, 3},
+		},
+		{
+			name:   "ndjson with bad rows",
+			format: NDJSON,
+			file: `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com","password":"secret","id":7}` + "\n" +
+				`{"first_name":"Jill",` + "\n" +
+				`{"first_name":"Jo","last_name":"Smith","email":"jo@example.com","password":"abc"}` + "\n",
+			expectedLines:  []int{1, 2, 3},
+			expectedErrors: map[int]string{1: `unknown field "id"`, 2: "unexpected EOF", 3: "password must be at least 6 characters"},
+		},
+		{"ndjson empty", NDJSON, "\n", "the file has no users", nil, nil},
+	}
+
+	for _, e := range tests {
+		records, err := Read(strings.NewReader(e.file), e.format)
+		if e.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), e.expectedErr) {
+				t.Errorf("%s: expected error %q, got %v", e.name, e.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+		if len(records) != len(e.expectedLines) {
+			t.Errorf("%s: expected %d records, got %d", e.name, len(e.expectedLines), len(records))
+			continue
+		}
+		for i, record := range records {
+			if record.Line != e.expectedLines[i] {
+				t.Errorf("%s: expected record %d on line %d, got %d", e.name, i, e.expectedLines[i], record.Line)
+			}
+			err := record.Validate()
+			expected := e.expectedErrors[record.Line]
+			switch {
+			case expected == "" && err != nil:
+				t.Errorf("%s: line %d: unexpected error: %s", e.name, record.Line, err)
+			case expected != "" && (err == nil || !strings.Contains(err.Error(), expected)):
+				t.Errorf("%s: line %d: expected error %q, got %v", e.name, record.Line, expected, err)
+			}
+		}
+	}
+}
+
+func TestRead_values(t *testing.T) {
+	file := "first_name,last_name,email,password,is_admin\n Jill , Smith , jill@example.com ,secret,true\n"
+	records, err := Read(strings.NewReader(file), CSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := records[0]
+	if err := record.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if record.FirstName != "Jill" || record.LastName != "Smith" || record.Email != "jill@example.com" || record.Password != "secret" || !record.IsAdmin {
+		t.Errorf("record was not read correctly: %+v", record)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	created := time.Date(2022, 8, 19, 0, 0, 0, 0, time.UTC)
+	users := []*data.User{
+		{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@example.com", Password: "hash", IsAdmin: true, EmailVerified: true, CreatedAt: created},
+		{ID: 3, FirstName: "New", LastName: "User, Jr", Email: "new@example.com", Password: "hash", CreatedAt: created},
+	}
+
+	var tests = []struct {
+		name     string
+		format   Format
+		users    []*data.User
+		expected string
+	}{
+		{
+			"csv", CSV, users,
+			"id,first_name,last_name,email,is_admin,email_verified,created_at\n" +
+				"1,Admin,User,admin@example.com,true,true,2022-08-19T00:00:00Z\n" +
+				"3,New,\"User, Jr\",new@example.com,false,false,2022-08-19T00:00:00Z\n",
+		},
+		{"csv without users", CSV, nil, "id,first_name,last_name,email,is_admin,email_verified,created_at\n"},
+		{
+			"ndjson", NDJSON, users,
+			`{"id":1,"first_name":"Admin","last_name":"User","email":"admin@example.com","is_admin":true,"email_verified":true,"created_at":"2022-08-19T00:00:00Z"}` + "\n" +
+				`{"id":3,"first_name":"New","last_name":"User, Jr","email":"new@example.com","is_admin":false,"email_verified":false,"created_at":"2022-08-19T00:00:00Z"}` + "\n",
+		},
+		{"ndjson without users", NDJSON, nil, ""},
+	}
+
+	for _, e := range tests {
+		var buf bytes.Buffer
+		w := NewWriter(&buf, e.format)
+		for _, u := range e.users {
+			if err := w.Write(u); err != nil {
+				t.Fatalf("%s: %s", e.name, err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+		if buf.String() != e.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", e.name, e.expected, buf.String())
+		}
+	}
+}
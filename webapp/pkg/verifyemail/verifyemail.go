@@ -0,0 +1,60 @@
+// Package verifyemail sends the signed links with which users prove that an
+// email address is theirs. Both apps send them; the web app checks them.
+package verifyemail
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+	"webapp/pkg/data"
+	"webapp/pkg/mail"
+	"webapp/pkg/urlsigner"
+)
+
+// TTL is how long an emailed verification link stays valid.
+const TTL = 24 * time.Hour
+
+// Path is the web app's verification page, which the links point to.
+const Path = "/verify-email"
+
+// Sender emails verification links rendered from the verify-email template.
+type Sender struct {
+	Signer    urlsigner.Signer
+	Templates *mail.Templates
+	Mailer    mail.Mailer
+	From      string
+	// WebURL is the scheme and host of the web app.
+	WebURL string
+}
+
+// Send emails user a signed link to the web app's verification page. The link
+// includes the address and the user's version, so it stops working if either
+// changes: registering again updates the user, and so voids the links sent
+// before.
+func (s Sender) Send(ctx context.Context, user *data.User) error {
+	query := url.Values{"email": {user.Email}, "version": {strconv.Itoa(user.Version)}}
+	link, err := s.Signer.Sign(s.WebURL+Path+"?"+query.Encode(), time.Now().Add(TTL))
+	if err != nil {
+		return err
+	}
+
+	msg, err := s.Templates.Render("verify-email", map[string]any{
+		"Name":  user.FirstName,
+		"Link":  link,
+		"Hours": int(TTL.Hours()),
+	})
+	if err != nil {
+		return err
+	}
+	msg.From = s.From
+	msg.To = user.Email
+
+	return s.Mailer.Send(ctx, msg)
+}
+
+// Current reports whether query, from a link that Send signed, was sent to
+// user as they are now.
+func Current(query url.Values, user *data.User) bool {
+	return query.Get("version") == strconv.Itoa(user.Version)
+}
@@ -0,0 +1,67 @@
+package verifyemail
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"webapp/pkg/data"
+	"webapp/pkg/mail"
+	"webapp/pkg/urlsigner"
+)
+
+func TestSender_Send(t *testing.T) {
+	templates, err := mail.NewTemplates(os.DirFS("./../../templates/mail"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	signer := urlsigner.Signer{Secret: []byte("secret")}
+	sender := Sender{
+		Signer:    signer,
+		Templates: templates,
+		Mailer:    mail.FileMailer{Dir: dir},
+		From:      "no-reply@example.com",
+		WebURL:    "http://localhost:8080",
+	}
+
+	user := &data.User{FirstName: "Jack", Email: "jack+test@example.com", Version: 2}
+	err = sender.Send(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected 1 email but %d were sent", len(files))
+	}
+	contents, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if !strings.Contains(string(contents), "To: jack+test@example.com") {
+		t.Errorf("expected the email to be sent to the user, got:\n%s", contents)
+	}
+
+	// the plain text part is quoted-printable, so the link may be wrapped
+	text := strings.ReplaceAll(string(contents), "=\r\n", "")
+	link := regexp.MustCompile(`http://localhost:8080/verify-email\?[^\s<"]+`).FindString(strings.ReplaceAll(text, "=3D", "="))
+	if link == "" {
+		t.Fatalf("expected a verification link, got:\n%s", contents)
+	}
+	if err := signer.Verify(link); err != nil {
+		t.Errorf("expected the link %s to verify, got %s", link, err)
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Current(u.Query(), user) {
+		t.Errorf("expected the link %s to be current", link)
+	}
+	user.Version++
+	if Current(u.Query(), user) {
+		t.Errorf("expected the link %s to be void once the user changes", link)
+	}
+}
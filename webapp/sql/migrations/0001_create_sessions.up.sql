@@ -0,0 +1,14 @@
+--
+-- Adds the sessions table, where the web app keeps its sessions when run with
+-- -session-store=postgres. The migrations are applied in order, each with:
+--
+--     psql "$DSN" -v ON_ERROR_STOP=1 -f sql/migrations/0001_create_sessions.up.sql
+--
+
+CREATE TABLE IF NOT EXISTS public.sessions (
+    token text NOT NULL PRIMARY KEY,
+    data bytea NOT NULL,
+    expiry timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_expiry_idx ON public.sessions USING btree (expiry);
@@ -0,0 +1,12 @@
+--
+-- Records whether each user has verified their email address. Users created
+-- before registration are taken to have verified theirs, so that they can
+-- still log in; new users have not.
+--
+
+BEGIN;
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS email_verified boolean DEFAULT true NOT NULL;
+ALTER TABLE public.users ALTER COLUMN email_verified SET DEFAULT false;
+
+COMMIT;
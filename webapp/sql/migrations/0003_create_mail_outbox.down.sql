@@ -0,0 +1 @@
+DROP TABLE public.mail_outbox;
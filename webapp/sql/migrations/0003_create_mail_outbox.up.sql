@@ -0,0 +1,24 @@
+--
+-- Adds the mail_outbox table, where email waits until it has been sent.
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS public.mail_outbox (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    from_address character varying(255) NOT NULL,
+    to_address character varying(255) NOT NULL,
+    subject text NOT NULL,
+    body_text text NOT NULL,
+    body_html text DEFAULT ''::text NOT NULL,
+    attempts integer DEFAULT 0 NOT NULL,
+    last_error text DEFAULT ''::text NOT NULL,
+    next_attempt_at timestamp with time zone NOT NULL,
+    sent_at timestamp with time zone,
+    failed_at timestamp with time zone,
+    created_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS mail_outbox_due_idx ON public.mail_outbox USING btree (next_attempt_at) WHERE ((sent_at IS NULL) AND (failed_at IS NULL));
+
+COMMIT;
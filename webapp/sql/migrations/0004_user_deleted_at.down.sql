@@ -0,0 +1,7 @@
+-- soft deleted users would reappear, so they are removed for good
+BEGIN;
+
+DELETE FROM public.users WHERE deleted_at IS NOT NULL;
+ALTER TABLE public.users DROP COLUMN deleted_at;
+
+COMMIT;
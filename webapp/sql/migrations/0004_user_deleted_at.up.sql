@@ -0,0 +1,12 @@
+--
+-- Adds deleted_at to users, for soft deletes. Like the other timestamps at
+-- this point it has no time zone; 0005_harden_users.up.sql changes them all.
+--
+
+BEGIN;
+
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS deleted_at timestamp without time zone;
+
+CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON public.users USING btree (deleted_at) WHERE (deleted_at IS NOT NULL);
+
+COMMIT;
@@ -0,0 +1,37 @@
+--
+-- Reverts 0005_harden_users.up.sql, apart from deleting orphaned images and
+-- sessions. The foreign key is kept, as it was already part of sql/users.sql.
+--
+
+BEGIN;
+
+ALTER TABLE public.users
+    ALTER COLUMN first_name DROP NOT NULL,
+    ALTER COLUMN last_name DROP NOT NULL,
+    ALTER COLUMN email DROP NOT NULL,
+    ALTER COLUMN password DROP NOT NULL,
+    ALTER COLUMN is_admin DROP DEFAULT,
+    ALTER COLUMN is_admin DROP NOT NULL,
+    ALTER COLUMN is_admin TYPE integer USING CASE WHEN is_admin THEN 1 ELSE 0 END,
+    ALTER COLUMN created_at DROP DEFAULT,
+    ALTER COLUMN created_at DROP NOT NULL,
+    ALTER COLUMN created_at TYPE timestamp without time zone USING created_at AT TIME ZONE 'UTC',
+    ALTER COLUMN updated_at DROP DEFAULT,
+    ALTER COLUMN updated_at DROP NOT NULL,
+    ALTER COLUMN updated_at TYPE timestamp without time zone USING updated_at AT TIME ZONE 'UTC',
+    ALTER COLUMN deleted_at TYPE timestamp without time zone USING deleted_at AT TIME ZONE 'UTC';
+
+ALTER TABLE public.user_images
+    ALTER COLUMN user_id DROP NOT NULL,
+    ALTER COLUMN file_name DROP NOT NULL,
+    ALTER COLUMN created_at DROP DEFAULT,
+    ALTER COLUMN created_at DROP NOT NULL,
+    ALTER COLUMN created_at TYPE timestamp without time zone USING created_at AT TIME ZONE 'UTC',
+    ALTER COLUMN updated_at DROP DEFAULT,
+    ALTER COLUMN updated_at DROP NOT NULL,
+    ALTER COLUMN updated_at TYPE timestamp without time zone USING updated_at AT TIME ZONE 'UTC';
+
+-- sessions written since the up migration hold a bool is_admin
+DELETE FROM public.sessions;
+
+COMMIT;
@@ -0,0 +1,68 @@
+--
+-- Hardens the users and user_images tables of a database created from an
+-- older sql/users.sql: NOT NULL columns, a boolean is_admin, timestamptz
+-- columns with database defaults, and a cascading foreign key from
+-- user_images to users. Apply it after 0001 to 0004 with:
+--
+--     psql "$DSN" -v ON_ERROR_STOP=1 -f sql/migrations/0005_harden_users.up.sql
+--
+-- Existing timestamps were written by the apps with timezone=UTC, so they
+-- are read as UTC.
+--
+
+BEGIN;
+
+-- images of users that no longer exist would block the foreign key
+DELETE FROM public.user_images
+WHERE user_id IS NULL OR user_id NOT IN (SELECT id FROM public.users);
+
+UPDATE public.user_images SET
+    file_name = coalesce(file_name, ''),
+    created_at = coalesce(created_at, now() AT TIME ZONE 'UTC'),
+    updated_at = coalesce(updated_at, created_at, now() AT TIME ZONE 'UTC');
+
+-- users without an email address or password can't log in and are left for
+-- the NOT NULL constraints below to report
+UPDATE public.users SET
+    first_name = coalesce(first_name, ''),
+    last_name = coalesce(last_name, ''),
+    is_admin = coalesce(is_admin, 0),
+    created_at = coalesce(created_at, now() AT TIME ZONE 'UTC'),
+    updated_at = coalesce(updated_at, created_at, now() AT TIME ZONE 'UTC');
+
+ALTER TABLE public.users
+    ALTER COLUMN first_name SET NOT NULL,
+    ALTER COLUMN last_name SET NOT NULL,
+    ALTER COLUMN email SET NOT NULL,
+    ALTER COLUMN password SET NOT NULL,
+    ALTER COLUMN is_admin TYPE boolean USING is_admin <> 0,
+    ALTER COLUMN is_admin SET DEFAULT false,
+    ALTER COLUMN is_admin SET NOT NULL,
+    ALTER COLUMN created_at TYPE timestamp with time zone USING created_at AT TIME ZONE 'UTC',
+    ALTER COLUMN created_at SET DEFAULT now(),
+    ALTER COLUMN created_at SET NOT NULL,
+    ALTER COLUMN updated_at TYPE timestamp with time zone USING updated_at AT TIME ZONE 'UTC',
+    ALTER COLUMN updated_at SET DEFAULT now(),
+    ALTER COLUMN updated_at SET NOT NULL,
+    ALTER COLUMN deleted_at TYPE timestamp with time zone USING deleted_at AT TIME ZONE 'UTC';
+
+ALTER TABLE public.user_images
+    ALTER COLUMN user_id SET NOT NULL,
+    ALTER COLUMN file_name SET NOT NULL,
+    ALTER COLUMN created_at TYPE timestamp with time zone USING created_at AT TIME ZONE 'UTC',
+    ALTER COLUMN created_at SET DEFAULT now(),
+    ALTER COLUMN created_at SET NOT NULL,
+    ALTER COLUMN updated_at TYPE timestamp with time zone USING updated_at AT TIME ZONE 'UTC',
+    ALTER COLUMN updated_at SET DEFAULT now(),
+    ALTER COLUMN updated_at SET NOT NULL;
+
+ALTER TABLE public.user_images DROP CONSTRAINT IF EXISTS user_images_user_id_fkey;
+ALTER TABLE ONLY public.user_images
+    ADD CONSTRAINT user_images_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+-- sessions hold a gob encoded data.User, whose is_admin field changes type
+-- with this migration, so they can no longer be decoded; everyone has to log
+-- in again
+DELETE FROM public.sessions;
+
+COMMIT;
@@ -0,0 +1,6 @@
+--
+-- Adds a version to users, incremented on every update, so that concurrent
+-- edits can be detected.
+--
+
+ALTER TABLE public.users ADD COLUMN version integer DEFAULT 1 NOT NULL;
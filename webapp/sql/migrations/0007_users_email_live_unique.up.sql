@@ -0,0 +1,8 @@
+--
+-- Makes email addresses unique among users that have not been deleted, so
+-- that restoring a deleted user can't give two live users the same address.
+-- It fails if there are already such users; delete or rename all but one of
+-- them first.
+--
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_live_idx ON public.users USING btree (email) WHERE (deleted_at IS NULL);
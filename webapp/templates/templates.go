@@ -0,0 +1,10 @@
+// Package templates embeds the web app's templates, so that the binary does
+// not depend on the templates directory being deployed next to it.
+package templates
+
+import "embed"
+
+// FS holds every template in this directory, and the email templates in mail.
+//
+//go:embed *.gohtml mail/*.gohtml
+var FS embed.FS